@@ -94,6 +94,70 @@ func (ck *Clerk) Get(key string) string {
 	return res
 }
 
+// 返回[startKey, endKey)中按key排序的最多limit个键值对，以及下一页的startKey。
+// endKey为""表示没有上界，limit<=0表示不限制数量；next为""表示已经扫描完。
+// 每一页是线性一致的，不同页之间不是同一个时刻的状态
+func (ck *Clerk) Scan(startKey string, endKey string, limit int) (keys []string, values []string, next string) {
+	ck.mu.Lock()
+	i := 0
+	if ck.lastLeader != -1 {
+		i = ck.lastLeader
+	}
+	ck.seqNumber += 1
+	args := ScanArgs{
+		StartKey: startKey,
+		EndKey:   endKey,
+		Limit:    limit,
+		Id:       ck.id,
+		SeqNum:   ck.seqNumber,
+	}
+	ck.mu.Unlock()
+	for {
+		reply := ScanReply{}
+		ok := ck.servers[i].Call("KVServer.Scan", &args, &reply)
+		if ok && reply.Err == OK {
+			ck.mu.Lock()
+			ck.lastLeader = i
+			ck.mu.Unlock()
+			DPrintf("Client %v Scan(%v, %v) got %v keys", ck.id, startKey, endKey, len(reply.Keys))
+			return reply.Keys, reply.Values, reply.Next
+		}
+		// 出错或者不是leader，尝试下一个server
+		i = (i + 1) % len(ck.servers)
+		DPrintf("Client %v retry Scan(%v, %v) on %v", ck.id, startKey, endKey, i)
+	}
+}
+
+// ScanPrefix每次读取的键值对数量
+const scanPageSize = 100
+
+// 返回所有以prefix开头的键值对
+func (ck *Clerk) ScanPrefix(prefix string) (keys []string, values []string) {
+	end := prefixEnd(prefix)
+	next := prefix
+	for {
+		k, v, n := ck.Scan(next, end, scanPageSize)
+		keys = append(keys, k...)
+		values = append(values, v...)
+		if n == "" {
+			return keys, values
+		}
+		next = n
+	}
+}
+
+// 大于所有以prefix开头的key的最小字符串，prefix全是0xff时返回""
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
 // shared by Put and Append.
 //
 // you can send an RPC with code like this:
@@ -154,3 +218,148 @@ func (ck *Clerk) Put(key string, value string) {
 func (ck *Clerk) Append(key string, value string) {
 	ck.PutAppend(key, value, "Append")
 }
+
+// 删除key，之后Get返回""，直到它再次被写入
+func (ck *Clerk) Delete(key string) {
+	ck.PutAppend(key, "", "Delete")
+}
+
+// key的值等于expected时把它改为value。返回key当前的值以及是否写入，
+// key不存在时返回"", false
+func (ck *Clerk) CompareAndSwap(key string, expected string, value string) (string, bool) {
+	return ck.condPut(key, expected, value, "CAS")
+}
+
+// key不存在时写入value。返回key当前的值以及是否写入
+func (ck *Clerk) PutIfAbsent(key string, value string) (string, bool) {
+	return ck.condPut(key, "", value, "PutIfAbsent")
+}
+
+// key的值等于expected时删除它。返回key当前的值以及是否删除
+func (ck *Clerk) DeleteIfEquals(key string, expected string) (string, bool) {
+	return ck.condPut(key, expected, "", "DeleteIfEquals")
+}
+
+// 基本原理和PutAppend相同
+func (ck *Clerk) condPut(key string, expected string, value string, op string) (string, bool) {
+	ck.mu.Lock()
+	i := 0
+	if ck.lastLeader != -1 {
+		i = ck.lastLeader
+	}
+	ck.seqNumber += 1
+	args := CondPutArgs{
+		Key:      key,
+		Expected: expected,
+		Value:    value,
+		Op:       op,
+		Id:       ck.id,
+		SeqNum:   ck.seqNumber,
+	}
+	ck.mu.Unlock()
+	for {
+		reply := CondPutReply{}
+		ok := ck.servers[i].Call("KVServer.CondPut", &args, &reply)
+		if ok && reply.Err != ErrWrongLeader {
+			ck.mu.Lock()
+			ck.lastLeader = i
+			ck.mu.Unlock()
+			DPrintf("Client %v %v(%v, %v, %v): %v %v", ck.id, op, key, expected, value, reply.Err, reply.Value)
+			return reply.Value, reply.Err == OK
+		}
+		// 出错或者不是leader，尝试下一个server
+		i = (i + 1) % len(ck.servers)
+		DPrintf("Client %v retry %v(%v, %v, %v)", ck.id, op, key, expected, value)
+	}
+}
+
+// Txn在一条日志中原子地执行事务：conditions都满足时执行ops中Else为false的操作，
+// 否则执行Else为true的操作。返回条件是否都满足，以及执行了的每个操作之后key的值。
+// ops或者conditions不合法时不发送请求，返回ErrInvalidTxn
+func (ck *Clerk) Txn(ops []TxnOp, conditions []Cond) (bool, []string, Err) {
+	args := TxnArgs{
+		Ops:        ops,
+		Conditions: conditions,
+	}
+	// 在分配序列号之前检查，不合法的事务不占用序列号
+	if !validTxn(&args) {
+		DPrintf("Client %v invalid Txn: ops %v conditions %v", ck.id, ops, conditions)
+		return false, nil, ErrInvalidTxn
+	}
+	ck.mu.Lock()
+	i := 0
+	if ck.lastLeader != -1 {
+		i = ck.lastLeader
+	}
+	ck.seqNumber += 1
+	args.Id = ck.id
+	args.SeqNum = ck.seqNumber
+	ck.mu.Unlock()
+	for {
+		reply := TxnReply{}
+		ok := ck.servers[i].Call("KVServer.Txn", &args, &reply)
+		if ok && reply.Err == OK {
+			ck.mu.Lock()
+			ck.lastLeader = i
+			ck.mu.Unlock()
+			DPrintf("Client %v Txn(%v ops, %v conditions): %v", ck.id, len(ops), len(conditions), reply.Succeeded)
+			return reply.Succeeded, reply.Values, OK
+		}
+		// server拒绝了事务，重试也不会成功
+		if ok && reply.Err == ErrInvalidTxn {
+			return false, nil, ErrInvalidTxn
+		}
+		// 出错或者不是leader，尝试下一个server
+		i = (i + 1) % len(ck.servers)
+		DPrintf("Client %v retry Txn on %v", ck.id, i)
+	}
+}
+
+// 把servers[server]加入集群，换leader重试直到成功或者得到确定的错误。
+// 返回ErrCatchUpTimeout时server已经是learner，可以再次调用AddServer
+func (ck *Clerk) AddServer(server int) Err {
+	return ck.changeMembership("KVServer.AddServer", server)
+}
+
+// 把servers[server]作为learner加入集群，之后可以用AddServer把它变成voter
+func (ck *Clerk) AddLearner(server int) Err {
+	return ck.changeMembership("KVServer.AddLearner", server)
+}
+
+// 把servers[server]移出集群，换leader重试直到成功或者得到确定的错误
+func (ck *Clerk) RemoveServer(server int) Err {
+	return ck.changeMembership("KVServer.RemoveServer", server)
+}
+
+func (ck *Clerk) changeMembership(method string, server int) Err {
+	ck.mu.Lock()
+	i := 0
+	if ck.lastLeader != -1 {
+		i = ck.lastLeader
+	}
+	ck.mu.Unlock()
+	args := MembershipArgs{Server: server}
+	for {
+		reply := MembershipReply{}
+		ok := ck.servers[i].Call(method, &args, &reply)
+		if ok {
+			switch reply.Err {
+			case OK, ErrCatchUpTimeout, ErrLastVoter, ErrUnknownServer:
+				ck.mu.Lock()
+				ck.lastLeader = i
+				ck.mu.Unlock()
+				DPrintf("Client %v %v(%v): %v", ck.id, method, server, reply.Err)
+				return reply.Err
+			case ErrChangePending:
+				// 等上一个成员变更提交之后在同一个leader上重试
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+		}
+		// 出错或者不是leader，尝试下一个server
+		i = (i + 1) % len(ck.servers)
+		if i == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
@@ -4,15 +4,22 @@ const (
 	OK             = "OK"
 	ErrNoKey       = "ErrNoKey"
 	ErrWrongLeader = "ErrWrongLeader"
+	// 成员变更失败的原因
+	ErrChangePending  = "ErrChangePending"  // 上一个成员变更还没有提交，稍后重试
+	ErrCatchUpTimeout = "ErrCatchUpTimeout" // 新节点没有及时追上日志，它仍然是learner
+	ErrLastVoter      = "ErrLastVoter"      // 不能移除最后一个voter
+	ErrUnknownServer  = "ErrUnknownServer"  // servers中没有这个节点
+	ErrMismatch       = "ErrMismatch"
+	ErrInvalidTxn     = "ErrInvalidTxn"
 )
 
 type Err string
 
-// Put or Append
+// Put, Append or Delete
 type PutAppendArgs struct {
 	Key   string
 	Value string
-	Op    string // "Put" or "Append"
+	Op    string // "Put", "Append" or "Delete"
 	// You'll have to add definitions here.
 	// Field names must start with capital letters,
 	// otherwise RPC will break.
@@ -24,6 +31,55 @@ type PutAppendReply struct {
 	Err Err
 }
 
+// CompareAndSwap, PutIfAbsent or DeleteIfEquals
+type CondPutArgs struct {
+	Key      string
+	Expected string // CompareAndSwap和DeleteIfEquals期望的当前值
+	Value    string
+	Op       string // "CAS", "PutIfAbsent" or "DeleteIfEquals"
+	Id       int64
+	SeqNum   int64
+}
+
+// 条件满足时Err为OK，否则为ErrMismatch或者ErrNoKey，没有写入。
+// Value是操作之后key的值
+type CondPutReply struct {
+	Err   Err
+	Value string
+}
+
+// 事务中的一个操作。Else为false的操作在所有条件满足时执行，
+// Else为true的操作在有条件不满足时执行
+type TxnOp struct {
+	Op    string // "Get", "Put", "Append" or "Delete"
+	Key   string
+	Value string
+	Else  bool
+}
+
+// 事务的条件，比较key的当前值和Value。
+// "=="、"<"和">"要求key存在，"!="对不存在的key成立，
+// "exists"和"missing"只检查key是否存在
+type Cond struct {
+	Key     string
+	Compare string // "==", "!=", "<", ">", "exists" or "missing"
+	Value   string
+}
+
+type TxnArgs struct {
+	Ops        []TxnOp
+	Conditions []Cond
+	Id         int64
+	SeqNum     int64
+}
+
+// Values按顺序对应执行了的每个操作，是操作之后key的值
+type TxnReply struct {
+	Err       Err
+	Succeeded bool // 所有条件都满足
+	Values    []string
+}
+
 type GetArgs struct {
 	Key string
 	// You'll have to add definitions here.
@@ -35,3 +91,29 @@ type GetReply struct {
 	Err   Err
 	Value string
 }
+
+// 扫描[StartKey, EndKey)中的key，EndKey为""表示没有上界，Limit<=0表示不限制数量
+type ScanArgs struct {
+	StartKey string
+	EndKey   string
+	Limit    int
+	Id       int64
+	SeqNum   int64
+}
+
+type ScanReply struct {
+	Err    Err
+	Keys   []string // 按顺序排列
+	Values []string
+	Next   string // 下一页的StartKey，""表示已经扫描完
+}
+
+// AddServer or RemoveServer
+// Server是要加入或移除的节点在servers中的下标
+type MembershipArgs struct {
+	Server int
+}
+
+type MembershipReply struct {
+	Err Err
+}
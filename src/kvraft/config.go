@@ -45,7 +45,7 @@ func random_handles(kvh []*labrpc.ClientEnd) []*labrpc.ClientEnd {
 
 type config struct {
 	mu           sync.Mutex
-	t            *testing.T
+	t            testing.TB
 	net          *labrpc.Network
 	n            int
 	kvservers    []*KVServer
@@ -54,6 +54,7 @@ type config struct {
 	clerks       map[*Clerk][]string
 	nextClientId int
 	maxraftstate int
+	witnesses    []int     // set by make_witness_config()
 	start        time.Time // time at which make_config() was called
 	// begin()/end() statistics
 	t0    time.Time // time at which test_test.go called cfg.begin()
@@ -287,6 +288,19 @@ func (cfg *config) ShutdownServer(i int) {
 
 // If restart servers, first call ShutdownServer
 func (cfg *config) StartServer(i int) {
+	cfg.startServer(i, false)
+}
+
+// start a replacement server i with an empty disk.
+// it waits to be added to the group with AddServer.
+func (cfg *config) StartJoiningServer(i int) {
+	cfg.mu.Lock()
+	cfg.saved[i] = nil
+	cfg.mu.Unlock()
+	cfg.startServer(i, true)
+}
+
+func (cfg *config) startServer(i int, joining bool) {
 	cfg.mu.Lock()
 
 	// a fresh set of outgoing ClientEnd names.
@@ -314,7 +328,13 @@ func (cfg *config) StartServer(i int) {
 	}
 	cfg.mu.Unlock()
 
-	cfg.kvservers[i] = StartKVServer(ends, i, cfg.saved[i], cfg.maxraftstate)
+	if joining {
+		cfg.kvservers[i] = StartJoiningKVServer(ends, i, cfg.saved[i], cfg.maxraftstate)
+	} else if cfg.witnesses != nil {
+		cfg.kvservers[i] = StartKVServerWithWitnesses(ends, i, cfg.saved[i], cfg.maxraftstate, cfg.witnesses)
+	} else {
+		cfg.kvservers[i] = StartKVServer(ends, i, cfg.saved[i], cfg.maxraftstate)
+	}
 
 	kvsvc := labrpc.MakeService(cfg.kvservers[i])
 	rfsvc := labrpc.MakeService(cfg.kvservers[i].rf)
@@ -359,7 +379,16 @@ func (cfg *config) make_partition() ([]int, []int) {
 
 var ncpu_once sync.Once
 
-func make_config(t *testing.T, n int, unreliable bool, maxraftstate int) *config {
+func make_config(t testing.TB, n int, unreliable bool, maxraftstate int) *config {
+	return makeConfig(t, n, unreliable, maxraftstate, nil)
+}
+
+// a group in which the servers listed in witnesses are witnesses.
+func make_witness_config(t testing.TB, n int, maxraftstate int, witnesses []int) *config {
+	return makeConfig(t, n, false, maxraftstate, witnesses)
+}
+
+func makeConfig(t testing.TB, n int, unreliable bool, maxraftstate int, witnesses []int) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
@@ -377,6 +406,7 @@ func make_config(t *testing.T, n int, unreliable bool, maxraftstate int) *config
 	cfg.clerks = make(map[*Clerk][]string)
 	cfg.nextClientId = cfg.n + 1000 // client ids start 1000 above the highest serverid
 	cfg.maxraftstate = maxraftstate
+	cfg.witnesses = witnesses
 	cfg.start = time.Now()
 
 	// create a full set of KV servers.
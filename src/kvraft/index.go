@@ -0,0 +1,105 @@
+package kvraft
+
+import "math/rand"
+
+const (
+	// 跳表的最大层数，每一层的节点数是下一层的1/4，足够索引4^16个key
+	maxIndexLevel = 16
+)
+
+// 跳表的节点，next[l]是第l层的下一个节点
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+// 按顺序保存db中所有的key，用于范围扫描。
+// 使用跳表，插入、删除和定位扫描起点都是O(log n)。
+// 它可以由db重建，所以不写入快照
+type keyIndex struct {
+	head  *indexNode // 不保存key的头节点，拥有所有层
+	level int        // 正在使用的层数
+	rand  *rand.Rand // 决定新节点的层数，不影响结果
+}
+
+func makeKeyIndex(db map[string]string) *keyIndex {
+	ki := &keyIndex{
+		head:  &indexNode{next: make([]*indexNode, maxIndexLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(1)),
+	}
+	for key := range db {
+		ki.insert(key)
+	}
+	return ki
+}
+
+// 返回第一个不小于key的节点，没有时返回nil。
+// prev不为nil时，prev[l]记录第l层中最后一个小于key的节点
+func (ki *keyIndex) seek(key string, prev []*indexNode) *indexNode {
+	x := ki.head
+	for l := ki.level - 1; l >= 0; l-- {
+		for x.next[l] != nil && x.next[l].key < key {
+			x = x.next[l]
+		}
+		if prev != nil {
+			prev[l] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (ki *keyIndex) randomLevel() int {
+	level := 1
+	for level < maxIndexLevel && ki.rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// 加入key，已经存在时不变
+func (ki *keyIndex) insert(key string) {
+	var prev [maxIndexLevel]*indexNode
+	if n := ki.seek(key, prev[:]); n != nil && n.key == key {
+		return
+	}
+	level := ki.randomLevel()
+	for ; ki.level < level; ki.level++ {
+		prev[ki.level] = ki.head
+	}
+	node := &indexNode{key: key, next: make([]*indexNode, level)}
+	for l := 0; l < level; l++ {
+		node.next[l] = prev[l].next[l]
+		prev[l].next[l] = node
+	}
+}
+
+// 删除key，不存在时不变
+func (ki *keyIndex) remove(key string) {
+	var prev [maxIndexLevel]*indexNode
+	n := ki.seek(key, prev[:])
+	if n == nil || n.key != key {
+		return
+	}
+	for l := range n.next {
+		prev[l].next[l] = n.next[l]
+	}
+	for ki.level > 1 && ki.head.next[ki.level-1] == nil {
+		ki.level--
+	}
+}
+
+// 返回[start, end)中最多limit个key，end为""表示没有上界，limit<=0表示不限制。
+// 还有剩下的key时，next是下一个key，否则为""
+func (ki *keyIndex) scan(start string, end string, limit int) (keys []string, next string) {
+	for n := ki.seek(start, nil); n != nil; n = n.next[0] {
+		if end != "" && n.key >= end {
+			break
+		}
+		if limit > 0 && len(keys) == limit {
+			return keys, n.key
+		}
+		keys = append(keys, n.key)
+	}
+	return keys, ""
+}
@@ -5,6 +5,8 @@ import (
 	"cs651/labgob"
 	"cs651/labrpc"
 	"cs651/raft"
+	"cs651/trace"
+	"fmt"
 	"log"
 	"sync"
 	"sync/atomic"
@@ -26,6 +28,13 @@ const (
 	KvOp_Get    KvOp = 0
 	KvOp_Put    KvOp = 1
 	KvOp_Append KvOp = 2
+	KvOp_Scan   KvOp = 3
+	// 条件写，条件不满足时不写入
+	KvOp_CAS            KvOp = 4
+	KvOp_PutIfAbsent    KvOp = 5
+	KvOp_DeleteIfEquals KvOp = 6
+	KvOp_Delete         KvOp = 7
+	KvOp_Txn            KvOp = 8
 )
 
 type Op struct {
@@ -38,6 +47,18 @@ type Op struct {
 	Id     int64
 	SeqNum int64
 	Err    Err
+	// 条件写期望的当前值
+	Expected string
+	// Scan的参数和结果，Key是起始的key
+	EndKey string
+	Limit  int
+	Keys   []string
+	Values []string
+	Next   string
+	// 事务的操作和条件，结果放在Succeeded和Values中
+	TxnOps    []TxnOp
+	Conds     []Cond
+	Succeeded bool
 }
 
 type KVServer struct {
@@ -53,17 +74,30 @@ type KVServer struct {
 
 	lastApplied int
 	db          map[string]string
+	index       *keyIndex // db中的key，按顺序排列
 	// Key: index Value: op
 	channels map[int]chan Op
 	// clients sequence number
 	clients map[int64]int64
+	// 每个client最后一次条件写的结果，重复的请求返回同样的结果
+	condResults map[int64]condResult
+
+	tracer *trace.Tracer
+}
+
+type condResult struct {
+	SeqNum    int64
+	Err       Err
+	Value     string
+	Succeeded bool     // 只用于事务
+	Values    []string // 只用于事务
 }
 
 func (kv *KVServer) Get(args *GetArgs, reply *GetReply) {
 	// Your code here.
+	_, isLeader := kv.rf.GetState()
 	kv.mu.Lock()
 	seq, ok := kv.clients[args.Id]
-	_, isLeader := kv.rf.GetState()
 	//当前server是leader并且seq大于args中的seq，说明log已经被process(processLog)
 	if isLeader && ok && seq >= args.SeqNum {
 		DPrintf("Server %v replies client Get(%v) seq : %v arg seq: %v",
@@ -80,6 +114,26 @@ func (kv *KVServer) Get(args *GetArgs, reply *GetReply) {
 	}
 	kv.mu.Unlock()
 
+	// 先尝试ReadIndex读，读请求不写入raft日志
+	if readIndex, ok := kv.rf.ReadIndex(); ok {
+		if !kv.waitApplied(readIndex) {
+			reply.Err = ErrWrongLeader
+			return
+		}
+		kv.mu.Lock()
+		value, exists := kv.db[args.Key]
+		if exists {
+			reply.Err = OK
+			reply.Value = value
+		} else {
+			reply.Err = ErrNoKey
+		}
+		kv.mu.Unlock()
+		DPrintf("Server %v replies client Get(%v) at read index %v: %v", kv.me, args.Key, readIndex, reply.Err)
+		return
+	}
+
+	// leader还没有在当前任期提交过日志，通过日志处理读请求
 	op := Op{
 		OpType: KvOp_Get,
 		Key:    args.Key,
@@ -87,52 +141,311 @@ func (kv *KVServer) Get(args *GetArgs, reply *GetReply) {
 		Id:     args.Id,
 		SeqNum: args.SeqNum,
 	}
-	//the index that the command will appear at（lastLogIndex + 1）
-	//if this server believes it is the leader
-	index, _, isLeader := kv.rf.Start(op)
+	applied := kv.submit(op)
+	reply.Err = applied.Err
+	reply.Value = applied.Value
+	DPrintf("Server %v replies client Get(%v): %v ", kv.me, args.Key, reply.Err)
+}
 
-	// otherwise, push the log
-	if isLeader {
-		DPrintf("Server %v send Start Request in Get, Index: %v", kv.me, index)
+// 提交op并等待它被应用，返回应用之后的op。
+// index处提交的是别的日志、失去leader身份或者超时时返回ErrWrongLeader，客户端会重试
+func (kv *KVServer) submit(op Op) Op {
+	// 提交时不持有kv.mu，否则所有请求都排在raft后面
+	index, term, isLeader := kv.rf.Start(op)
+	if !isLeader {
+		DPrintf("Server %v is not the leader now", kv.me)
+		return Op{Err: ErrWrongLeader}
+	}
+	DPrintf("Server %v send Start Request at index %v term %v", kv.me, index, term)
+	kv.mu.Lock()
+	// 注册之前processLog可能已经应用了这个位置
+	if kv.lastApplied >= index {
+		defer kv.mu.Unlock()
+		return kv.appliedResult(op)
+	}
+	resChan := make(chan Op, 1)
+	kv.channels[index] = resChan
+	kv.mu.Unlock()
 
+	defer func() {
 		kv.mu.Lock()
-		resChan := make(chan Op, 1)
-		//创建操作队列并存储
-		kv.channels[index] = resChan
+		// 新任期的请求可能已经在同一个index上注册
+		if kv.channels[index] == resChan {
+			delete(kv.channels, index)
+		}
 		kv.mu.Unlock()
-		select {
-		case op := <-resChan:
-			{
-				reply.Err = op.Err
-				reply.Value = op.Value
+	}()
 
-				DPrintf("Server %v replies client Get(%v): %v ", kv.me, args.Key, reply.Err)
+	timeout := time.After(800 * time.Millisecond)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case applied := <-resChan:
+			// 其他leader的日志覆盖了这个位置，op没有被提交
+			if applied.Id != op.Id || applied.SeqNum != op.SeqNum {
+				return Op{Err: ErrWrongLeader}
 			}
-		case <-time.After(time.Millisecond * 800):
-			{
-				reply.Err = ErrWrongLeader
-				DPrintf("Server %v timeout replies client Get(%v): %v ", kv.me, args.Key, reply.Err)
+			return applied
+		case <-ticker.C:
+			// 任期变化后op可能已经被截断，不再等待
+			if t, isLeader := kv.rf.GetState(); t != term || !isLeader {
+				return Op{Err: ErrWrongLeader}
 			}
+		case <-timeout:
+			DPrintf("Server %v timeout at index %v", kv.me, index)
+			return Op{Err: ErrWrongLeader}
+		}
+	}
+}
+
+// op所在的位置已经应用时，根据clients判断op是否被执行，返回它的结果。
+// Get读取当前的状态，它在请求开始之后、返回之前，仍然是线性一致的
+// use it with lock
+func (kv *KVServer) appliedResult(op Op) Op {
+	if seq, ok := kv.clients[op.Id]; !ok || seq < op.SeqNum {
+		return Op{Err: ErrWrongLeader}
+	}
+	if isCondOp(op.OpType) {
+		r := kv.condResults[op.Id]
+		if r.SeqNum != op.SeqNum {
+			// client已经发出了之后的请求，不再需要这个结果
+			return Op{Err: ErrWrongLeader}
+		}
+		op.Err = r.Err
+		op.Value = r.Value
+		op.Succeeded = r.Succeeded
+		op.Values = r.Values
+		return op
+	}
+	op.Err = OK
+	switch op.OpType {
+	case KvOp_Get:
+		if val, exists := kv.db[op.Key]; exists {
+			op.Value = val
+		} else {
+			op.Err = ErrNoKey
+		}
+	case KvOp_Scan:
+		kv.scan(&op)
+	}
+	return op
+}
+
+func isCondOp(opType KvOp) bool {
+	return opType == KvOp_CAS || opType == KvOp_PutIfAbsent || opType == KvOp_DeleteIfEquals ||
+		opType == KvOp_Txn
+}
+
+// key的当前值是否满足c
+// use it with lock
+func (kv *KVServer) holds(c Cond) bool {
+	val, exists := kv.db[c.Key]
+	switch c.Compare {
+	case "==":
+		return exists && val == c.Value
+	case "!=":
+		return !exists || val != c.Value
+	case "<":
+		return exists && val < c.Value
+	case ">":
+		return exists && val > c.Value
+	case "exists":
+		return exists
+	default:
+		return !exists
+	}
+}
+
+// 在一条日志中检查所有条件，执行对应分支的操作，结果记录在condResults中
+// use it with lock
+func (kv *KVServer) applyTxn(op *Op) {
+	op.Succeeded = true
+	for _, c := range op.Conds {
+		if !kv.holds(c) {
+			op.Succeeded = false
+			break
+		}
+	}
+	op.Values = []string{}
+	for _, t := range op.TxnOps {
+		// 成功时执行Then分支，失败时执行Else分支
+		if t.Else == op.Succeeded {
+			continue
 		}
+		switch t.Op {
+		case "Put":
+			kv.db[t.Key] = t.Value
+			kv.index.insert(t.Key)
+		case "Append":
+			kv.db[t.Key] += t.Value
+			kv.index.insert(t.Key)
+		case "Delete":
+			delete(kv.db, t.Key)
+			kv.index.remove(t.Key)
+		}
+		op.Values = append(op.Values, kv.db[t.Key])
+	}
+	op.Err = OK
+	kv.condResults[op.Id] = condResult{SeqNum: op.SeqNum, Err: op.Err, Succeeded: op.Succeeded, Values: op.Values}
+}
+
+// 检查事务中的操作和条件是否合法
+func validTxn(args *TxnArgs) bool {
+	for _, t := range args.Ops {
+		switch t.Op {
+		case "Get", "Put", "Append", "Delete":
+		default:
+			return false
+		}
+	}
+	for _, c := range args.Conditions {
+		switch c.Compare {
+		case "==", "!=", "<", ">", "exists", "missing":
+		default:
+			return false
+		}
+	}
+	return true
+}
 
+// 事务作为一条日志执行，读写多个key是原子的。
+// 和条件写一样，重复的请求返回第一次执行的结果
+func (kv *KVServer) Txn(args *TxnArgs, reply *TxnReply) {
+	if !validTxn(args) {
+		reply.Err = ErrInvalidTxn
+		return
+	}
+	op := Op{
+		OpType: KvOp_Txn,
+		TxnOps: args.Ops,
+		Conds:  args.Conditions,
+		Id:     args.Id,
+		SeqNum: args.SeqNum,
+	}
+	applied := kv.submit(op)
+	reply.Err = applied.Err
+	reply.Succeeded = applied.Succeeded
+	reply.Values = applied.Values
+	DPrintf("Server %v replies client Txn(%v ops, %v conditions): %v %v",
+		kv.me, len(args.Ops), len(args.Conditions), reply.Err, reply.Succeeded)
+}
+
+// 原子地执行条件写，op.Value改为操作之后key的值，结果记录在condResults中
+// use it with lock
+func (kv *KVServer) applyCond(op *Op) {
+	val, exists := kv.db[op.Key]
+	match := exists && val == op.Expected
+	if op.OpType == KvOp_PutIfAbsent {
+		match = !exists
+	}
+	switch {
+	case !match && !exists:
+		op.Err = ErrNoKey
+		op.Value = ""
+	case !match:
+		op.Err = ErrMismatch
+		op.Value = val
+	case op.OpType == KvOp_DeleteIfEquals:
+		delete(kv.db, op.Key)
+		kv.index.remove(op.Key)
+		op.Err = OK
+		op.Value = ""
+	default:
+		kv.db[op.Key] = op.Value
+		kv.index.insert(op.Key)
+		op.Err = OK
+	}
+	kv.condResults[op.Id] = condResult{SeqNum: op.SeqNum, Err: op.Err, Value: op.Value}
+}
+
+// 读取op指定的范围，结果放入op
+// use it with lock
+func (kv *KVServer) scan(op *Op) {
+	op.Keys, op.Next = kv.index.scan(op.Key, op.EndKey, op.Limit)
+	op.Values = make([]string, len(op.Keys))
+	for i, key := range op.Keys {
+		op.Values[i] = kv.db[key]
+	}
+	op.Err = OK
+}
+
+// 按key的顺序返回一页键值对，和Get一样是线性一致的
+func (kv *KVServer) Scan(args *ScanArgs, reply *ScanReply) {
+	op := Op{
+		OpType: KvOp_Scan,
+		Key:    args.StartKey,
+		EndKey: args.EndKey,
+		Limit:  args.Limit,
+		Id:     args.Id,
+		SeqNum: args.SeqNum,
+	}
+	// 先尝试ReadIndex读，失败时通过日志处理
+	if readIndex, ok := kv.rf.ReadIndex(); ok {
+		if !kv.waitApplied(readIndex) {
+			reply.Err = ErrWrongLeader
+			return
+		}
 		kv.mu.Lock()
-		delete(kv.channels, index)
+		kv.scan(&op)
 		kv.mu.Unlock()
-
 	} else {
-		DPrintf("Server %v is not the leader now", kv.me)
-		reply.Err = ErrWrongLeader
+		op = kv.submit(op)
 	}
+	reply.Err = op.Err
+	reply.Keys = op.Keys
+	reply.Values = op.Values
+	reply.Next = op.Next
+	DPrintf("Server %v replies client Scan(%v, %v): %v, %v keys", kv.me, args.StartKey, args.EndKey, reply.Err, len(reply.Keys))
+}
 
+// 等待状态机应用到index处的日志，超时返回false
+func (kv *KVServer) waitApplied(index int) bool {
+	deadline := time.Now().Add(800 * time.Millisecond)
+	for !kv.killed() && time.Now().Before(deadline) {
+		kv.mu.Lock()
+		lastApplied := kv.lastApplied
+		kv.mu.Unlock()
+		if lastApplied >= index {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+// 条件写总是通过日志执行，重复的请求返回第一次执行的结果
+func (kv *KVServer) CondPut(args *CondPutArgs, reply *CondPutReply) {
+	opType := KvOp_CAS
+	switch args.Op {
+	case "PutIfAbsent":
+		opType = KvOp_PutIfAbsent
+	case "DeleteIfEquals":
+		opType = KvOp_DeleteIfEquals
+	}
+	op := Op{
+		OpType:   opType,
+		Key:      args.Key,
+		Value:    args.Value,
+		Expected: args.Expected,
+		Id:       args.Id,
+		SeqNum:   args.SeqNum,
+	}
+	applied := kv.submit(op)
+	reply.Err = applied.Err
+	reply.Value = applied.Value
+	DPrintf("Server %v replies client %v(%v, %v, %v): %v %v",
+		kv.me, args.Op, args.Key, args.Expected, args.Value, reply.Err, reply.Value)
 }
 
 func (kv *KVServer) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
 	// Your code here.
 
 	DPrintf("Server %v get PutAppend Request", kv.me)
+	// GetState需要raft的锁，不要在持有kv.mu时等待它，否则所有请求都排在raft后面
+	_, isLeader := kv.rf.GetState()
 	kv.mu.Lock()
 	DPrintf("Server %v get lock in PutAppend Request", kv.me)
-	_, isLeader := kv.rf.GetState()
 
 	seq, ok := kv.clients[args.Id]
 	//是leader,client存在且是有效的操作
@@ -148,8 +461,11 @@ func (kv *KVServer) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
 
 	opType := KvOp_Put
 
-	if args.Op == "Append" {
+	switch args.Op {
+	case "Append":
 		opType = KvOp_Append
+	case "Delete":
+		opType = KvOp_Delete
 	}
 
 	op := Op{
@@ -160,39 +476,9 @@ func (kv *KVServer) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
 		SeqNum: args.SeqNum,
 	}
 
-	index, _, isLeader := kv.rf.Start(op)
-	DPrintf("Server %v send Start Request in PutAppend at index %v", kv.me, index)
-	if isLeader {
-		kv.mu.Lock()
-		resChan := make(chan Op, 1)
-		kv.channels[index] = resChan
-		kv.mu.Unlock()
-		DPrintf("Server %v waits for result in PutAppend at index %v", kv.me, index)
-		select {
-		case <-resChan:
-			{
-				DPrintf("Server %v replies client PutAppend(%v, %v): %v",
-					kv.me, args.Key, args.Value, reply.Err)
-				reply.Err = op.Err
-			}
-		case <-time.After(time.Millisecond * 800):
-			{
-				reply.Err = ErrWrongLeader
-				DPrintf("Server %v (timeout) replies client PutAppend(%v, %v): %v",
-					kv.me, args.Key, args.Value, reply.Err)
-			}
-		}
-
-		kv.mu.Lock()
-		delete(kv.channels, index)
-		kv.mu.Unlock()
-
-	} else {
-		// 不是leader
-		reply.Err = ErrWrongLeader
-		DPrintf("Server %v is not leader now", kv.me)
-	}
-
+	reply.Err = kv.submit(op).Err
+	DPrintf("Server %v replies client PutAppend(%v, %v): %v",
+		kv.me, args.Key, args.Value, reply.Err)
 }
 
 // the tester calls Kill() when a KVServer instance won't
@@ -214,6 +500,11 @@ func (kv *KVServer) killed() bool {
 	return z == 1
 }
 
+// 返回底层Raft的状态和计数器，用于诊断
+func (kv *KVServer) RaftStatus() raft.Status {
+	return kv.rf.Status()
+}
+
 // servers[] contains the ports of the set of
 // servers that will cooperate via Raft to
 // form the fault-tolerant key/value service.
@@ -226,7 +517,72 @@ func (kv *KVServer) killed() bool {
 // you don't need to snapshot.
 // StartKVServer() must return quickly, so it should start goroutines
 // for any long-running work.
-func StartKVServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister, maxraftstate int) *KVServer {
+// 把servers[args.Server]加入集群，由leader在raft中完成成员变更
+func (kv *KVServer) AddServer(args *MembershipArgs, reply *MembershipReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	DPrintf("Server %v adds server %v", kv.me, args.Server)
+	reply.Err = membershipErr(kv.rf.AddServer(args.Server))
+}
+
+// 把servers[args.Server]作为learner加入集群，它只复制数据，不参与投票
+func (kv *KVServer) AddLearner(args *MembershipArgs, reply *MembershipReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	DPrintf("Server %v adds learner %v", kv.me, args.Server)
+	reply.Err = membershipErr(kv.rf.AddLearner(args.Server))
+}
+
+// 把servers[args.Server]移出集群
+func (kv *KVServer) RemoveServer(args *MembershipArgs, reply *MembershipReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	DPrintf("Server %v removes server %v", kv.me, args.Server)
+	reply.Err = membershipErr(kv.rf.RemoveServer(args.Server))
+}
+
+// 把raft成员变更的错误转换为返回给clerk的Err
+func membershipErr(err error) Err {
+	switch err {
+	case nil:
+		return OK
+	case raft.ErrChangePending:
+		return ErrChangePending
+	case raft.ErrCatchUpTimeout:
+		return ErrCatchUpTimeout
+	case raft.ErrLastVoter:
+		return ErrLastVoter
+	case raft.ErrUnknownPeer:
+		return ErrUnknownServer
+	default:
+		return ErrWrongLeader
+	}
+}
+
+func StartKVServer(servers []*labrpc.ClientEnd, me int, persister raft.Storage, maxraftstate int) *KVServer {
+	return startKVServer(servers, me, persister, maxraftstate, false, nil)
+}
+
+// StartJoiningKVServer 启动一个替换节点，它不参与选举，
+// 直到集群通过AddServer把它加入，然后从leader获取日志和快照
+func StartJoiningKVServer(servers []*labrpc.ClientEnd, me int, persister raft.Storage, maxraftstate int) *KVServer {
+	return startKVServer(servers, me, persister, maxraftstate, true, nil)
+}
+
+// StartKVServerWithWitnesses 启动一个节点，servers中下标在witnesses中的节点是witness。
+// witness只参与投票和提交，不保存数据库，不处理客户端请求。
+// 所有节点都要使用相同的witnesses
+func StartKVServerWithWitnesses(servers []*labrpc.ClientEnd, me int, persister raft.Storage, maxraftstate int, witnesses []int) *KVServer {
+	return startKVServer(servers, me, persister, maxraftstate, false, witnesses)
+}
+
+func startKVServer(servers []*labrpc.ClientEnd, me int, persister raft.Storage, maxraftstate int, joining bool, witnesses []int) *KVServer {
 	// call labgob.Register on structures you want
 	// Go's RPC library to marshall/unmarshall.
 	labgob.Register(Op{})
@@ -240,15 +596,30 @@ func StartKVServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persiste
 	kv.dead = 0
 	kv.applyCh = make(chan raft.ApplyMsg, 1)
 	// 创建raft服务器
-	kv.rf = raft.Make(servers, me, persister, kv.applyCh)
+	if joining {
+		kv.rf = raft.MakeJoining(servers, me, persister, kv.applyCh)
+	} else if witnesses != nil {
+		kv.rf = raft.MakeWithWitnesses(servers, me, persister, kv.applyCh, witnesses)
+	} else {
+		kv.rf = raft.Make(servers, me, persister, kv.applyCh)
+	}
+	sink := trace.EnvSink(fmt.Sprintf("kvraft-%v", me))
+	kv.rf.SetTraceSink(sink, 0)
+	kv.tracer = trace.NewTracer(sink, "kvraft", 0, me)
 	kv.db = make(map[string]string)
 	kv.clients = make(map[int64]int64)
+	kv.condResults = make(map[int64]condResult)
 	kv.channels = make(map[int]chan Op)
 	kv.lastApplied = 0
+	kv.index = makeKeyIndex(kv.db)
 	kv.readSnapshotForInit()
-	// 存在最大快照长度
-	if kv.maxraftstate != -1 {
-		go kv.doSnapshot()
+	witness := false
+	for _, id := range witnesses {
+		witness = witness || id == me
+	}
+	// 存在最大快照长度。witness没有状态机，由raft自己压缩日志
+	if kv.maxraftstate != -1 && !witness {
+		kv.rf.SetCompaction(raft.SizePolicy(kv.maxraftstate), 0, kv.snapshot)
 	}
 	go kv.processLog()
 	return kv
@@ -257,36 +628,52 @@ func StartKVServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persiste
 func (kv *KVServer) readSnapshotForInit() {
 	snapshot, lastIncludedIndex := kv.rf.GetSnapshot()
 	if snapshot != nil && len(snapshot) >= 1 {
-		r := bytes.NewBuffer(snapshot)
-		d := labgob.NewDecoder(r)
-
-		if d.Decode(&kv.db) != nil ||
-			d.Decode(&kv.clients) != nil {
-			log.Fatalf("Unable to read persisted snapshot")
-		}
-
+		kv.restore(snapshot)
 		kv.lastApplied = lastIncludedIndex
 	}
 }
 
-func (kv *KVServer) doSnapshot() {
-	for !kv.killed() {
-		if kv.rf.GetRaftStateSize() > kv.maxraftstate {
-			kv.mu.Lock()
-			w := new(bytes.Buffer)
-			e := labgob.NewEncoder(w)
-			e.Encode(kv.db)
-			e.Encode(kv.clients)
-			data := w.Bytes()
-			lastApplied := kv.lastApplied
-			kv.mu.Unlock()
-			DPrintf("Server %v generates snapshot at log intex %v", kv.me, lastApplied)
-			// 根据传入的lastApplied，保存状态和快照
-			// 将最新快照更新为lastApplied位置
-			kv.rf.GenerateSnapshot(data, lastApplied)
-		}
-		time.Sleep(150 * time.Millisecond)
+// 用快照替换状态机。gob解码到已有的map时会合并，所以解码到新的map中，
+// 否则快照之后删除的key会留下来
+// use it with lock
+func (kv *KVServer) restore(snapshot []byte) {
+	r := bytes.NewBuffer(snapshot)
+	d := labgob.NewDecoder(r)
+	var db map[string]string
+	var clients map[int64]int64
+	var condResults map[int64]condResult
+	if d.Decode(&db) != nil ||
+		d.Decode(&clients) != nil ||
+		d.Decode(&condResults) != nil {
+		log.Fatalf("Unable to read persisted snapshot")
+	}
+	// gob把空的map解码为nil
+	if db == nil {
+		db = make(map[string]string)
 	}
+	if clients == nil {
+		clients = make(map[int64]int64)
+	}
+	if condResults == nil {
+		condResults = make(map[int64]condResult)
+	}
+	kv.db = db
+	kv.clients = clients
+	kv.condResults = condResults
+	kv.index = makeKeyIndex(kv.db)
+}
+
+// 返回状态机的快照和它包含的最后一条日志，由Raft按压缩策略调用
+func (kv *KVServer) snapshot() ([]byte, int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(kv.db)
+	e.Encode(kv.clients)
+	e.Encode(kv.condResults)
+	DPrintf("Server %v generates snapshot at log intex %v", kv.me, kv.lastApplied)
+	return w.Bytes(), kv.lastApplied
 }
 
 // 执行日志中的操作 go routine, 更新kv.db
@@ -294,9 +681,22 @@ func (kv *KVServer) processLog() {
 	for !kv.killed() {
 		msg := <-kv.applyCh
 		kv.mu.Lock()
-		// CommandValid为true， 由kv.rf.applyLog()产生
+		// CommandValid为true， 由kv.rf.applier()产生
 		if msg.CommandValid {
-			op := msg.Command.(Op)
+			// 已经包含在安装的快照中
+			if msg.CommandIndex <= kv.lastApplied {
+				kv.mu.Unlock()
+				continue
+			}
+			op, isOp := msg.Command.(Op)
+			// raft的成员配置日志，不需要执行
+			if !isOp {
+				if kv.lastApplied < msg.CommandIndex {
+					kv.lastApplied = msg.CommandIndex
+				}
+				kv.mu.Unlock()
+				continue
+			}
 			seq, seqExists := kv.clients[op.Id]
 			// 操作还没apply
 			if !seqExists || seq < op.SeqNum {
@@ -305,6 +705,7 @@ func (kv *KVServer) processLog() {
 				case KvOp_Put:
 					{
 						kv.db[op.Key] = op.Value
+						kv.index.insert(op.Key)
 						op.Err = OK
 						DPrintf("Op seq value:%v PUT(%v, %v)", op.SeqNum, op.Key, op.Value)
 					}
@@ -333,43 +734,47 @@ func (kv *KVServer) processLog() {
 							DPrintf("Op seq value:%v Append(%v, %v) Err (%v)", op.SeqNum, op.Key, kv.db[op.Key], op.Err)
 
 						}
+						kv.index.insert(op.Key)
+						op.Err = OK
+					}
+				case KvOp_Delete:
+					{
+						delete(kv.db, op.Key)
+						kv.index.remove(op.Key)
 						op.Err = OK
+						DPrintf("Op seq value:%v Delete(%v)", op.SeqNum, op.Key)
 					}
+				case KvOp_Scan:
+					kv.scan(&op)
+				case KvOp_CAS, KvOp_PutIfAbsent, KvOp_DeleteIfEquals:
+					kv.applyCond(&op)
+				case KvOp_Txn:
+					kv.applyTxn(&op)
 				}
+				kv.tracer.Emit(trace.Apply, 0, msg.CommandIndex, "op %v key %v client %v seq %v", op.OpType, op.Key, op.Id, op.SeqNum)
 				// 更新对应client的seq
 				kv.clients[op.Id] = op.SeqNum
-				// 获取操作
-				ch, ok := kv.channels[msg.CommandIndex]
-
-				delete(kv.channels, msg.CommandIndex)
-				// rf.log[lastApplied].Index
-				if kv.lastApplied < msg.CommandIndex {
-					kv.lastApplied = msg.CommandIndex
-				}
-
-				kv.mu.Unlock()
-
-				_, isLeader := kv.rf.GetState()
-				// 操作放入队列
-				if ok && isLeader {
-					ch <- op
-				}
-
 			} else {
-				kv.mu.Unlock()
+				// 重复的操作不再执行，但等待它的请求仍然需要结果
+				op = kv.appliedResult(op)
 			}
-			// 快照无效，说明由InstallSnapShot产生，来源于StartAppendEntries
-			// 更新lastApplied
-		} else if msg.LastIncludedIndex > kv.lastApplied {
-			DPrintf("Server %v applied snapshot from %v to %v", kv.me, kv.lastApplied, msg.LastIncludedIndex)
-			r := bytes.NewBuffer(msg.Command.([]byte))
-			d := labgob.NewDecoder(r)
-
-			if d.Decode(&kv.db) != nil ||
-				d.Decode(&kv.clients) != nil {
-				log.Fatalf("Unable to read persisted snapshot")
+			// rf.log[lastApplied].Index
+			if kv.lastApplied < msg.CommandIndex {
+				kv.lastApplied = msg.CommandIndex
+			}
+			// 把结果交给等待这个index的请求，channel有缓冲，不会阻塞
+			if ch, ok := kv.channels[msg.CommandIndex]; ok {
+				delete(kv.channels, msg.CommandIndex)
+				ch <- op
 			}
-			kv.lastApplied = msg.LastIncludedIndex
+			kv.mu.Unlock()
+			// leader发来的快照，raft同意之后才安装
+			// 更新lastApplied
+		} else if msg.SnapshotValid && kv.rf.CondInstallSnapshot(msg.SnapshotTerm, msg.SnapshotIndex, msg.Snapshot) {
+			DPrintf("Server %v applied snapshot from %v to %v", kv.me, kv.lastApplied, msg.SnapshotIndex)
+			kv.restore(msg.Snapshot)
+			kv.lastApplied = msg.SnapshotIndex
+			kv.tracer.Emit(trace.Snapshot, 0, msg.SnapshotIndex, "installed")
 			kv.mu.Unlock()
 		} else {
 			kv.mu.Unlock()
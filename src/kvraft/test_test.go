@@ -3,10 +3,12 @@ package kvraft
 import (
 	"cs651/models"
 	"cs651/porcupine"
+	"cs651/raft"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -612,6 +614,420 @@ func TestPersistPartitionUnreliableLinearizable3A(t *testing.T) {
 	GenericTestLinearizability(t, "3A", 15, 7, true, true, true, -1)
 }
 
+// Gets are served with ReadIndex and should not append
+// entries to the Raft log.
+func TestReadsDoNotGrowLog3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: reads do not grow the log (3A)")
+
+	Put(cfg, ck, "a", "A")
+	check(cfg, t, ck, "a", "A")
+
+	sz0 := cfg.LogSize()
+	for i := 0; i < 100; i++ {
+		check(cfg, t, ck, "a", "A")
+	}
+	sz1 := cfg.LogSize()
+	// allow for a Get that had to go through the log while
+	// a new leader committed its first entry.
+	if sz1 > sz0+200 {
+		t.Fatalf("log grew from %v to %v bytes during reads", sz0, sz1)
+	}
+
+	Put(cfg, ck, "a", "B")
+	check(cfg, t, ck, "a", "B")
+
+	cfg.end()
+}
+
+func checkScan(t *testing.T, ck *Clerk, start string, end string, want []string) {
+	keys, values, next := ck.Scan(start, end, 0)
+	if next != "" || len(keys) != len(want) {
+		t.Fatalf("Scan(%v, %v): expected %v, received %v next %v", start, end, want, keys, next)
+	}
+	for i, key := range keys {
+		if key != want[i] || values[i] != "v"+key {
+			t.Fatalf("Scan(%v, %v): expected %v, received %v=%v", start, end, want[i], key, values[i])
+		}
+	}
+}
+
+func TestScan3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: ordered range scans (3A)")
+
+	all := []string{}
+	for _, user := range []string{"bob", "alice", "carol"} {
+		for i := 0; i < 5; i++ {
+			key := user + "/" + strconv.Itoa(i)
+			Put(cfg, ck, key, "v"+key)
+		}
+	}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		for i := 0; i < 5; i++ {
+			all = append(all, user+"/"+strconv.Itoa(i))
+		}
+	}
+
+	checkScan(t, ck, "", "", all)
+	checkScan(t, ck, "bob/", "carol/", all[5:10])
+	checkScan(t, ck, "alice/3", "bob/1", all[3:6])
+	checkScan(t, ck, "dave/", "", []string{})
+
+	// pages of 4 cover every key exactly once.
+	got := []string{}
+	next := ""
+	for {
+		keys, _, n := ck.Scan(next, "", 4)
+		if len(keys) > 4 {
+			t.Fatalf("Scan(%v) returned %v keys with limit 4", next, len(keys))
+		}
+		got = append(got, keys...)
+		if n == "" {
+			break
+		}
+		next = n
+	}
+	if strings.Join(got, ",") != strings.Join(all, ",") {
+		t.Fatalf("paged scan: expected %v, received %v", all, got)
+	}
+
+	keys, values := ck.ScanPrefix("bob/")
+	if strings.Join(keys, ",") != strings.Join(all[5:10], ",") || values[0] != "vbob/0" {
+		t.Fatalf("ScanPrefix(bob/): received %v %v", keys, values)
+	}
+
+	// a scan sees writes that completed before it, on a new leader too.
+	Append(cfg, ck, "bob/0", "x")
+	Put(cfg, ck, "bob/00", "vbob/00")
+	_, l := cfg.Leader()
+	cfg.partition([]int{(l + 1) % nservers, (l + 2) % nservers}, []int{l})
+	keys, values, _ = ck.Scan("bob/0", "bob/1", 0)
+	if strings.Join(keys, ",") != "bob/0,bob/00" || values[0] != "vbob/0x" {
+		t.Fatalf("Scan after partition: received %v %v", keys, values)
+	}
+	cfg.ConnectAll()
+
+	cfg.end()
+}
+
+func TestConditional3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: conditional writes (3A)")
+
+	expect := func(op string, v string, ok bool, wantV string, wantOk bool) {
+		if v != wantV || ok != wantOk {
+			t.Fatalf("%v: expected %v '%v', received %v '%v'", op, wantOk, wantV, ok, v)
+		}
+	}
+	v, ok := ck.CompareAndSwap("a", "", "1")
+	expect("CompareAndSwap on a missing key", v, ok, "", false)
+	v, ok = ck.PutIfAbsent("a", "1")
+	expect("PutIfAbsent", v, ok, "1", true)
+	v, ok = ck.PutIfAbsent("a", "2")
+	expect("PutIfAbsent on an existing key", v, ok, "1", false)
+	v, ok = ck.CompareAndSwap("a", "2", "3")
+	expect("CompareAndSwap with a stale value", v, ok, "1", false)
+	v, ok = ck.CompareAndSwap("a", "1", "3")
+	expect("CompareAndSwap", v, ok, "3", true)
+	v, ok = ck.DeleteIfEquals("a", "1")
+	expect("DeleteIfEquals with a stale value", v, ok, "3", false)
+	check(cfg, t, ck, "a", "3")
+	v, ok = ck.DeleteIfEquals("a", "3")
+	expect("DeleteIfEquals", v, ok, "", true)
+	check(cfg, t, ck, "a", "")
+	if keys, _, _ := ck.Scan("", "", 0); len(keys) != 0 {
+		t.Fatalf("deleted key still scanned: %v", keys)
+	}
+	v, ok = ck.PutIfAbsent("a", "4")
+	expect("PutIfAbsent after delete", v, ok, "4", true)
+
+	// a lock: exactly one client holds it at a time.
+	const nclients = 5
+	var holders int32
+	spawn_clients_and_wait(t, cfg, nclients, func(cli int, myck *Clerk, t *testing.T) {
+		me := strconv.Itoa(cli)
+		for acquired := 0; acquired < 3; {
+			if _, ok := myck.PutIfAbsent("lock", me); !ok {
+				continue
+			}
+			if atomic.AddInt32(&holders, 1) != 1 {
+				t.Errorf("client %v holds the lock with another client", cli)
+			}
+			Append(cfg, myck, "log", me)
+			atomic.AddInt32(&holders, -1)
+			if _, ok := myck.DeleteIfEquals("lock", me); !ok {
+				t.Errorf("client %v lost the lock", cli)
+				return
+			}
+			acquired++
+		}
+	})
+	if v := Get(cfg, ck, "log"); len(v) != 3*nclients {
+		t.Fatalf("log %v has %v entries, expected %v", v, len(v), 3*nclients)
+	}
+
+	cfg.end()
+}
+
+// clients race conditional writes on a few keys over an unreliable,
+// partitioned network; the history must be linearizable.
+func TestConditionalLinearizable3A(t *testing.T) {
+	const nservers = 5
+	const nclients = 5
+	cfg := make_config(t, nservers, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: unreliable net, partitions, conditional writes, linearizability checks (3A)")
+
+	begin := time.Now()
+	var operations []porcupine.Operation
+	var opMu sync.Mutex
+	done_partitioner := int32(0)
+	done_clients := int32(0)
+	ch_partitioner := make(chan bool)
+	ca := make([]chan bool, nclients)
+	client := func(cli int, myck *Clerk, t *testing.T) {
+		j := 0
+		for atomic.LoadInt32(&done_clients) == 0 {
+			key := strconv.Itoa(rand.Int() % 3)
+			nv := "x " + strconv.Itoa(cli) + " " + strconv.Itoa(j) + " y"
+			var inp models.KvInput
+			var out models.KvOutput
+			start := int64(time.Since(begin))
+			// expect the value this client wrote last, or one of its
+			// earlier values, so that some of the writes match.
+			expected := "x " + strconv.Itoa(cli) + " " + strconv.Itoa(j-1-rand.Int()%2) + " y"
+			switch r := rand.Int() % 100; {
+			case r < 25:
+				v, ok := myck.CompareAndSwap(key, expected, nv)
+				inp = models.KvInput{Op: 3, Key: key, Value: nv, Expected: expected}
+				out = models.KvOutput{Value: v, Ok: ok}
+			case r < 50:
+				v, ok := myck.PutIfAbsent(key, nv)
+				inp = models.KvInput{Op: 4, Key: key, Value: nv}
+				out = models.KvOutput{Value: v, Ok: ok}
+			case r < 65:
+				v, ok := myck.DeleteIfEquals(key, expected)
+				inp = models.KvInput{Op: 5, Key: key, Expected: expected}
+				out = models.KvOutput{Value: v, Ok: ok}
+			case r < 70:
+				Put(cfg, myck, key, nv)
+				inp = models.KvInput{Op: 1, Key: key, Value: nv}
+			case r < 75:
+				myck.Delete(key)
+				cfg.op()
+				inp = models.KvInput{Op: 6, Key: key}
+			default:
+				v := Get(cfg, myck, key)
+				inp = models.KvInput{Op: 0, Key: key}
+				out = models.KvOutput{Value: v}
+			}
+			j++
+			end := int64(time.Since(begin))
+			op := porcupine.Operation{Input: inp, Call: start, Output: out, Return: end, ClientId: cli}
+			opMu.Lock()
+			operations = append(operations, op)
+			opMu.Unlock()
+		}
+	}
+	for cli := 0; cli < nclients; cli++ {
+		ca[cli] = make(chan bool)
+		go run_client(t, cfg, cli, ca[cli], client)
+	}
+
+	time.Sleep(1 * time.Second)
+	go partitioner(t, cfg, ch_partitioner, &done_partitioner)
+	time.Sleep(5 * time.Second)
+	atomic.StoreInt32(&done_clients, 1)
+	atomic.StoreInt32(&done_partitioner, 1)
+	<-ch_partitioner
+	cfg.ConnectAll()
+	for cli := 0; cli < nclients; cli++ {
+		if ok := <-ca[cli]; !ok {
+			t.Fatalf("client %v failed", cli)
+		}
+	}
+
+	cfg.end()
+
+	res, _ := porcupine.CheckOperationsVerbose(models.KvModel, operations, linearizabilityCheckTimeout)
+	if res == porcupine.Illegal {
+		t.Fatal("history is not linearizable")
+	} else if res == porcupine.Unknown {
+		fmt.Println("info: linearizability check timed out, assuming history is ok")
+	}
+}
+
+func TestTxn3A(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: transactions (3A)")
+
+	// create a record and its index entry together, only if absent.
+	create := []TxnOp{
+		{Op: "Put", Key: "user/1", Value: "ann"},
+		{Op: "Put", Key: "name/ann", Value: "1"},
+		{Op: "Get", Key: "user/1", Else: true},
+	}
+	absent := []Cond{{Key: "user/1", Compare: "missing"}}
+	ok, values, err := ck.Txn(create, absent)
+	if err != OK || !ok || strings.Join(values, ",") != "ann,1" {
+		t.Fatalf("create: received %v %v %v", err, ok, values)
+	}
+	check(cfg, t, ck, "name/ann", "1")
+	ok, values, _ = ck.Txn(create, absent)
+	if ok || strings.Join(values, ",") != "ann" {
+		t.Fatalf("create again: received %v %v", ok, values)
+	}
+
+	// rename: move the index entry and update the record together.
+	ok, _, _ = ck.Txn([]TxnOp{
+		{Op: "Put", Key: "user/1", Value: "bob"},
+		{Op: "Delete", Key: "name/ann"},
+		{Op: "Put", Key: "name/bob", Value: "1"},
+	}, []Cond{{Key: "user/1", Compare: "==", Value: "ann"}, {Key: "name/bob", Compare: "missing"}})
+	if !ok {
+		t.Fatalf("rename failed")
+	}
+	check(cfg, t, ck, "user/1", "bob")
+	check(cfg, t, ck, "name/ann", "")
+	check(cfg, t, ck, "name/bob", "1")
+
+	// no operation of a failed branch is applied.
+	ok, _, _ = ck.Txn([]TxnOp{
+		{Op: "Append", Key: "user/1", Value: "x"},
+		{Op: "Put", Key: "other", Value: "y"},
+	}, []Cond{{Key: "user/1", Compare: "!=", Value: "bob"}})
+	if ok {
+		t.Fatalf("Txn succeeded with a false condition")
+	}
+	check(cfg, t, ck, "user/1", "bob")
+	check(cfg, t, ck, "other", "")
+
+	// an empty transaction always succeeds.
+	if ok, values, _ := ck.Txn(nil, nil); !ok || len(values) != 0 {
+		t.Fatalf("empty Txn: received %v %v", ok, values)
+	}
+
+	// an invalid transaction is rejected by the clerk without using
+	// a sequence number, and by the server if a client sends it anyway.
+	seq := ck.seqNumber
+	if _, _, err := ck.Txn([]TxnOp{{Op: "Swap", Key: "user/1"}}, nil); err != ErrInvalidTxn {
+		t.Fatalf("invalid op: received %v", err)
+	}
+	if _, _, err := ck.Txn(nil, []Cond{{Key: "user/1", Compare: "<="}}); err != ErrInvalidTxn {
+		t.Fatalf("invalid condition: received %v", err)
+	}
+	if ck.seqNumber != seq {
+		t.Fatalf("invalid Txn used sequence numbers %v..%v", seq+1, ck.seqNumber)
+	}
+	args := TxnArgs{Ops: []TxnOp{{Op: "Swap", Key: "user/1"}}, Id: ck.id, SeqNum: seq + 1}
+	reply := TxnReply{}
+	if !ck.servers[0].Call("KVServer.Txn", &args, &reply) || reply.Err != ErrInvalidTxn {
+		t.Fatalf("server accepted an invalid Txn: %v", reply.Err)
+	}
+	check(cfg, t, ck, "user/1", "bob")
+
+	cfg.end()
+}
+
+// clients move units between accounts with read-then-conditional-write
+// transactions over an unreliable network; every atomic read of all the
+// accounts must see the same total.
+func TestTxnAtomic3A(t *testing.T) {
+	const nservers = 3
+	const nclients = 5
+	const naccounts = 4
+	const initial = 100
+	cfg := make_config(t, nservers, true, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: unreliable net, atomic transactions (3A)")
+
+	accounts := []string{}
+	readAll := []TxnOp{}
+	for i := 0; i < naccounts; i++ {
+		key := "acct" + strconv.Itoa(i)
+		accounts = append(accounts, key)
+		readAll = append(readAll, TxnOp{Op: "Get", Key: key})
+		Put(cfg, ck, key, strconv.Itoa(initial))
+	}
+	total := func(values []string) int {
+		sum := 0
+		for _, v := range values {
+			n, _ := strconv.Atoi(v)
+			sum += n
+		}
+		return sum
+	}
+
+	var done int32
+	var transfers int32
+	ca := make([]chan bool, nclients)
+	for cli := 0; cli < nclients; cli++ {
+		ca[cli] = make(chan bool)
+		go run_client(t, cfg, cli, ca[cli], func(me int, myck *Clerk, t *testing.T) {
+			for atomic.LoadInt32(&done) == 0 {
+				from, to := accounts[rand.Int()%naccounts], accounts[rand.Int()%naccounts]
+				if from == to {
+					continue
+				}
+				_, values, _ := myck.Txn([]TxnOp{{Op: "Get", Key: from}, {Op: "Get", Key: to}}, nil)
+				a, _ := strconv.Atoi(values[0])
+				b, _ := strconv.Atoi(values[1])
+				ok, _, _ := myck.Txn([]TxnOp{
+					{Op: "Put", Key: from, Value: strconv.Itoa(a - 1)},
+					{Op: "Put", Key: to, Value: strconv.Itoa(b + 1)},
+				}, []Cond{{Key: from, Compare: "==", Value: values[0]}, {Key: to, Compare: "==", Value: values[1]}})
+				if ok {
+					atomic.AddInt32(&transfers, 1)
+				}
+				cfg.op()
+			}
+		})
+	}
+
+	for start := time.Now(); time.Since(start) < 3*time.Second; {
+		if _, values, _ := ck.Txn(readAll, nil); total(values) != naccounts*initial {
+			t.Fatalf("accounts %v add up to %v, expected %v", values, total(values), naccounts*initial)
+		}
+	}
+	atomic.StoreInt32(&done, 1)
+	for cli := 0; cli < nclients; cli++ {
+		<-ca[cli]
+	}
+	if _, values, _ := ck.Txn(readAll, nil); total(values) != naccounts*initial {
+		t.Fatalf("accounts %v add up to %v, expected %v", values, total(values), naccounts*initial)
+	}
+	if transfers == 0 {
+		t.Fatalf("no transfer succeeded")
+	}
+
+	cfg.end()
+}
+
 // if one server falls behind, then rejoins, does it
 // recover by using the InstallSnapshot RPC?
 // also checks that majority discards committed log entries
@@ -706,6 +1122,95 @@ func TestSnapshotSize3B(t *testing.T) {
 	cfg.end()
 }
 
+// the key index is rebuilt from snapshots after a restart.
+func TestScanSnapshot3B(t *testing.T) {
+	const nservers = 3
+	maxraftstate := 1000
+	cfg := make_config(t, nservers, false, maxraftstate)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: scans after restoring snapshots (3B)")
+
+	want := []string{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		Put(cfg, ck, key, "v"+key)
+		want = append(want, key)
+	}
+	if cfg.SnapshotSize() == 0 {
+		t.Fatalf("no snapshot was taken")
+	}
+
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+	}
+	for i := 0; i < nservers; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+
+	checkScan(t, ck, "k", "l", want)
+
+	cfg.end()
+}
+
+// deleted keys stay deleted across snapshots and restarts,
+// and do not take up space in the snapshot.
+func TestDelete3B(t *testing.T) {
+	const nservers = 3
+	maxraftstate := 1000
+	cfg := make_config(t, nservers, false, maxraftstate)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: deletes survive snapshots (3B)")
+
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 50; i++ {
+		Put(cfg, ck, fmt.Sprintf("k%03d", i), value)
+	}
+	for i := 0; i < 50; i += 2 {
+		ck.Delete(fmt.Sprintf("k%03d", i))
+		cfg.op()
+	}
+	// enough writes for every server to snapshot after the deletes.
+	for i := 0; i < 20; i++ {
+		Put(cfg, ck, "pad", strconv.Itoa(i))
+	}
+
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+	}
+	for i := 0; i < nservers; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		if i%2 == 0 {
+			check(cfg, t, ck, key, "")
+		} else {
+			check(cfg, t, ck, key, value)
+		}
+	}
+	if keys, _ := ck.ScanPrefix("k"); len(keys) != 25 {
+		t.Fatalf("ScanPrefix(k) returned %v keys, expected 25", len(keys))
+	}
+	// 25 live values of 100 bytes, plus keys and client tables.
+	if sz := cfg.SnapshotSize(); sz > 4000 {
+		t.Fatalf("snapshot too large (%v bytes) after deletes", sz)
+	}
+
+	Put(cfg, ck, "k000", "back")
+	check(cfg, t, ck, "k000", "back")
+
+	cfg.end()
+}
+
 func TestSnapshotRecover3B(t *testing.T) {
 	// Test: restarts, snapshots, one client (3B) ...
 	GenericTest(t, "3B", 1, false, true, false, 1000)
@@ -735,3 +1240,407 @@ func TestSnapshotUnreliableRecoverConcurrentPartitionLinearizable3B(t *testing.T
 	// Test: unreliable net, restarts, partitions, snapshots, linearizability checks (3B) ...
 	GenericTestLinearizability(t, "3B", 15, 7, true, true, true, 1000)
 }
+
+// replace a dead server with a fresh one that has an empty disk.
+// the new server must catch up via InstallSnapshot before it
+// can vote, and the group must keep working without the old one.
+func TestReplaceServer3B(t *testing.T) {
+	const nservers = 3
+	maxraftstate := 1000
+	cfg := make_config(t, nservers, false, maxraftstate)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: replace a dead server (3B)")
+
+	for i := 0; i < 20; i++ {
+		Put(cfg, ck, strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// server 2 dies and is removed from the group.
+	cfg.ShutdownServer(2)
+	if err := ck.RemoveServer(2); err != OK {
+		t.Fatalf("RemoveServer(2): %v", err)
+	}
+	for i := 20; i < 40; i++ {
+		Put(cfg, ck, strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// a replacement with an empty disk joins.
+	cfg.StartJoiningServer(2)
+	cfg.ConnectAll()
+	if err := ck.AddServer(2); err != OK {
+		t.Fatalf("AddServer(2): %v", err)
+	}
+
+	m := cfg.kvservers[2].rf.GetMembership()
+	if len(m.Voters) != nservers {
+		t.Fatalf("expected %v voters after AddServer, got %v", nservers, m.Voters)
+	}
+
+	// 1 and 2 must now form a majority on their own.
+	cfg.ShutdownServer(0)
+	for i := 0; i < 40; i++ {
+		check(cfg, t, ck, strconv.Itoa(i), strconv.Itoa(i))
+	}
+	Put(cfg, ck, "x", "y")
+	check(cfg, t, ck, "x", "y")
+
+	cfg.end()
+}
+
+// membership changes that cannot succeed report why instead of
+// being retried forever.
+func TestMembershipErrors3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: membership change errors (3B)")
+
+	Put(cfg, ck, "a", "1")
+	if err := ck.AddServer(nservers); err != ErrUnknownServer {
+		t.Fatalf("AddServer(%v): expected %v, got %v", nservers, ErrUnknownServer, err)
+	}
+	if err := ck.RemoveServer(nservers); err != ErrUnknownServer {
+		t.Fatalf("RemoveServer(%v): expected %v, got %v", nservers, ErrUnknownServer, err)
+	}
+
+	// a dead server is added as a learner but never catches up.
+	cfg.ShutdownServer(2)
+	if err := ck.RemoveServer(2); err != OK {
+		t.Fatalf("RemoveServer(2): %v", err)
+	}
+	if err := ck.AddServer(2); err != ErrCatchUpTimeout {
+		t.Fatalf("AddServer of a dead server: expected %v, got %v", ErrCatchUpTimeout, err)
+	}
+	if m := cfg.kvservers[0].rf.GetMembership(); len(m.Voters) != 2 || len(m.Learners) != 1 {
+		t.Fatalf("expected 2 voters and learner 2, got %v", m)
+	}
+	// once it is back it can be promoted.
+	cfg.StartJoiningServer(2)
+	cfg.ConnectAll()
+	if err := ck.AddServer(2); err != OK {
+		t.Fatalf("AddServer(2) after restart: %v", err)
+	}
+	check(cfg, t, ck, "a", "1")
+
+	// the last voter cannot be removed.
+	if err := ck.RemoveServer(2); err != OK {
+		t.Fatalf("RemoveServer(2): %v", err)
+	}
+	if err := ck.RemoveServer(1); err != OK {
+		t.Fatalf("RemoveServer(1): %v", err)
+	}
+	if err := ck.RemoveServer(0); err != ErrLastVoter {
+		t.Fatalf("RemoveServer of the last voter: expected %v, got %v", ErrLastVoter, err)
+	}
+	check(cfg, t, ck, "a", "1")
+
+	cfg.end()
+}
+
+// a learner receives every write but does not vote: the voters can
+// commit without it, and it cannot be elected on its own.
+func TestLearner3B(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: non-voting learner (3B)")
+
+	// turn server 2 into a learner.
+	cfg.ShutdownServer(2)
+	if err := ck.RemoveServer(2); err != OK {
+		t.Fatalf("RemoveServer(2): %v", err)
+	}
+	cfg.StartJoiningServer(2)
+	cfg.ConnectAll()
+	if err := ck.AddLearner(2); err != OK {
+		t.Fatalf("AddLearner(2): %v", err)
+	}
+
+	m := cfg.kvservers[0].rf.GetMembership()
+	if len(m.Voters) != 2 || len(m.Learners) != 1 || m.Learners[0] != 2 {
+		t.Fatalf("expected voters [0 1] and learner [2], got %v", m)
+	}
+
+	for i := 0; i < 10; i++ {
+		Put(cfg, ck, strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// the learner catches up.
+	leaderCommit := 0
+	for iters := 0; iters < 50; iters++ {
+		leaderCommit = 0
+		for i := 0; i < 2; i++ {
+			if st := cfg.kvservers[i].RaftStatus(); st.CommitIndex > leaderCommit {
+				leaderCommit = st.CommitIndex
+			}
+		}
+		if cfg.kvservers[2].RaftStatus().LastApplied >= leaderCommit {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if applied := cfg.kvservers[2].RaftStatus().LastApplied; applied < leaderCommit {
+		t.Fatalf("learner applied %v, voters committed %v", applied, leaderCommit)
+	}
+
+	// the voters do not need the learner to commit.
+	cfg.ShutdownServer(2)
+	for i := 10; i < 20; i++ {
+		Put(cfg, ck, strconv.Itoa(i), strconv.Itoa(i))
+	}
+	cfg.StartServer(2)
+	cfg.ConnectAll()
+
+	// without a voter majority, the learner must not become leader.
+	cfg.ShutdownServer(0)
+	time.Sleep(2 * electionTimeout)
+	if _, isLeader := cfg.kvservers[2].rf.GetState(); isLeader {
+		t.Fatalf("learner became leader")
+	}
+	if st := cfg.kvservers[2].RaftStatus(); st.Counters[raft.MetricElectionsStarted] != 0 {
+		t.Fatalf("learner started %v elections", st.Counters[raft.MetricElectionsStarted])
+	}
+	cfg.StartServer(0)
+	cfg.ConnectAll()
+
+	// promote it, after which 1 and 2 form a majority.
+	if err := ck.AddServer(2); err != OK {
+		t.Fatalf("AddServer(2): %v", err)
+	}
+	cfg.ShutdownServer(0)
+	for i := 0; i < 20; i++ {
+		check(cfg, t, ck, strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	cfg.end()
+}
+
+// a lagging server catches up through a snapshot that is sent in
+// many small chunks, some of them lost on an unreliable network.
+// a server that catches up through InstallSnapshot takes the group's
+// membership from the snapshot, so it can still vote and lead.
+func TestSnapshotMembership3B(t *testing.T) {
+	const nservers = 3
+	maxraftstate := 1000
+	cfg := make_config(t, nservers, false, maxraftstate)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: InstallSnapshot carries the membership (3B)")
+
+	cfg.partition([]int{0, 1}, []int{2})
+	{
+		ck1 := cfg.makeClient([]int{0, 1})
+		for i := 0; i < 50; i++ {
+			Put(cfg, ck1, strconv.Itoa(i), strconv.Itoa(i))
+		}
+	}
+
+	// 2 needs the snapshot to take part in the majority.
+	cfg.partition([]int{0, 2}, []int{1})
+	{
+		ck1 := cfg.makeClient([]int{0, 2})
+		Put(cfg, ck1, "a", "A")
+	}
+	checkVoters := func() {
+		m := cfg.kvservers[2].rf.GetMembership()
+		if len(m.Voters) != nservers {
+			t.Fatalf("server 2 has voters %v after InstallSnapshot", m.Voters)
+		}
+	}
+	checkVoters()
+	cfg.ShutdownServer(2)
+	cfg.StartServer(2)
+	checkVoters()
+
+	// 2 and 1 form the majority without 0.
+	cfg.partition([]int{1, 2}, []int{0})
+	{
+		ck1 := cfg.makeClient([]int{1, 2})
+		Put(cfg, ck1, "b", "B")
+		check(cfg, t, ck1, "a", "A")
+		for i := 0; i < 50; i++ {
+			check(cfg, t, ck1, strconv.Itoa(i), strconv.Itoa(i))
+		}
+	}
+
+	cfg.end()
+}
+
+func TestSnapshotChunks3B(t *testing.T) {
+	const nservers = 3
+	maxraftstate := 1000
+	cfg := make_config(t, nservers, false, maxraftstate)
+	defer cfg.cleanup()
+
+	for i := 0; i < nservers; i++ {
+		cfg.kvservers[i].rf.SetSnapshotChunkSize(64)
+	}
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: InstallSnapshot in small chunks (3B)")
+
+	cfg.partition([]int{0, 1}, []int{2})
+	{
+		ck1 := cfg.makeClient([]int{0, 1})
+		for i := 0; i < 50; i++ {
+			Put(cfg, ck1, strconv.Itoa(i), strings.Repeat(strconv.Itoa(i), 10))
+		}
+	}
+
+	// 2 needs the snapshot to take part in the majority.
+	cfg.net.Reliable(false)
+	cfg.partition([]int{0, 2}, []int{1})
+	{
+		ck1 := cfg.makeClient([]int{0, 2})
+		Put(cfg, ck1, "c", "C")
+		for i := 0; i < 50; i++ {
+			check(cfg, t, ck1, strconv.Itoa(i), strings.Repeat(strconv.Itoa(i), 10))
+		}
+	}
+	cfg.net.Reliable(true)
+
+	cfg.partition([]int{0, 1, 2}, []int{})
+	check(cfg, t, ck, "c", "C")
+
+	cfg.end()
+}
+
+// two replicas and a witness: Put and Get keep working with either
+// replica down, and the witness never holds the database.
+func TestWitness3B(t *testing.T) {
+	const nservers = 3
+	const witness = 2
+	maxraftstate := 1000
+	cfg := make_witness_config(t, nservers, maxraftstate, []int{witness})
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: two replicas and a witness (3B)")
+
+	for i := 0; i < 20; i++ {
+		Put(cfg, ck, strconv.Itoa(i), "x")
+	}
+
+	// kill each full replica in turn. the one restarted just before
+	// may not have caught up yet when the other one dies.
+	value := "x"
+	for _, down := range []int{0, 1} {
+		cfg.ShutdownServer(down)
+		next := strconv.Itoa(down)
+		for i := 0; i < 20; i++ {
+			check(cfg, t, ck, strconv.Itoa(i), value)
+			Put(cfg, ck, strconv.Itoa(i), next)
+		}
+		value = next
+		cfg.StartServer(down)
+		cfg.ConnectAll()
+	}
+	for i := 0; i < 20; i++ {
+		check(cfg, t, ck, strconv.Itoa(i), value)
+	}
+
+	kv := cfg.kvservers[witness]
+	kv.mu.Lock()
+	if len(kv.db) != 0 {
+		t.Fatalf("witness holds %v keys", len(kv.db))
+	}
+	kv.mu.Unlock()
+
+	cfg.end()
+}
+
+// N个客户端并发Put的吞吐量，例如
+// go test -run XXX -bench PutClients
+func BenchmarkPutClients(b *testing.B) {
+	for _, nclients := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("clients=%v", nclients), func(b *testing.B) {
+			benchmarkPut(b, nclients)
+		})
+	}
+}
+
+func benchmarkPut(b *testing.B, nclients int) {
+	cfg := make_config(b, 3, false, -1)
+	defer cfg.cleanup()
+
+	clerks := make([]*Clerk, nclients)
+	for i := 0; i < nclients; i++ {
+		clerks[i] = cfg.makeClient(cfg.All())
+		// 选出leader，并让每个clerk找到它
+		clerks[i].Put(strconv.Itoa(i), "")
+	}
+
+	b.ResetTimer()
+	var next int64
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func(me int, ck *Clerk) {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) <= int64(b.N) {
+				ck.Put(strconv.Itoa(me), "x")
+			}
+		}(i, clerks[i])
+	}
+	wg.Wait()
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+}
+
+// the key index stays sorted and matches the set of keys under random
+// inserts and removes.
+func TestKeyIndex(t *testing.T) {
+	ki := makeKeyIndex(map[string]string{"b": "", "a": "", "c": ""})
+	present := map[string]bool{"a": true, "b": true, "c": true}
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(rand.Int() % 500)
+		if rand.Int()%3 == 0 {
+			ki.remove(key)
+			delete(present, key)
+		} else {
+			ki.insert(key)
+			present[key] = true
+		}
+	}
+	var expected []string
+	for key := range present {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+	if keys, next := ki.scan("", "", 0); strings.Join(keys, ",") != strings.Join(expected, ",") || next != "" {
+		t.Fatalf("scan returned %v %q, expected %v", keys, next, expected)
+	}
+	// a page that stops in the middle reports the next key.
+	keys, next := ki.scan(expected[1], "", 2)
+	if len(keys) != 2 || keys[0] != expected[1] || next != expected[3] {
+		t.Fatalf("page from %v returned %v %q", expected[1], keys, next)
+	}
+}
+
+// inserting keys in random order into an index that already holds
+// many keys; each insert should cost O(log n).
+func BenchmarkKeyIndexInsert(b *testing.B) {
+	db := map[string]string{}
+	for i := 0; i < 100000; i++ {
+		db[strconv.Itoa(rand.Int())] = ""
+	}
+	ki := makeKeyIndex(db)
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = strconv.Itoa(rand.Int())
+	}
+	b.ResetTimer()
+	for _, key := range keys {
+		ki.insert(key)
+	}
+}
@@ -16,6 +16,10 @@ package labrpc
 // don't include references to program objects.
 //
 // net := MakeNetwork() -- holds network, clients, servers.
+// net := MakeSimNetwork(s) -- the same, but driven by a sim.Sim:
+//   delays use its virtual clock, drops use its random source, and
+//   each request is handled to completion by one of its tasks.
+//   Call() must then be called from a task. see ../sim.
 // end := net.MakeEnd(endname) -- create a client end-point, to talk to one server.
 // net.AddServer(servername, server) -- adds a named server to network.
 // net.DeleteServer(servername) -- eliminate the named server.
@@ -52,6 +56,7 @@ package labrpc
 import (
 	"bytes"
 	"cs651/labgob"
+	"cs651/sim"
 	"log"
 	"math/rand"
 	"reflect"
@@ -78,6 +83,7 @@ type ClientEnd struct {
 	endname interface{}   // this end-point's name
 	ch      chan reqMsg   // copy of Network.endCh
 	done    chan struct{} // closed when Network is cleaned up
+	net     *Network
 }
 
 // send an RPC, wait for the reply.
@@ -95,6 +101,10 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 	qe.Encode(args)
 	req.args = qb.Bytes()
 
+	if e.net.sim != nil {
+		return e.callSim(req, reply)
+	}
+
 	//
 	// send the request.
 	//
@@ -110,6 +120,30 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 	// wait for the reply.
 	//
 	rep := <-req.replyCh
+	return decodeReply(rep, reply)
+}
+
+// 模拟模式：请求由一个新的task处理，等待回复时停下当前task
+func (e *ClientEnd) callSim(req reqMsg, reply interface{}) bool {
+	rn := e.net
+	req.replyCh = make(chan replyMsg, 1)
+	atomic.AddInt32(&rn.count, 1)
+	atomic.AddInt64(&rn.bytes, int64(len(req.args)))
+	rn.sim.Go(func() { rn.processReq(req) })
+
+	var rep replyMsg
+	rn.sim.Await(func() bool {
+		select {
+		case rep = <-req.replyCh:
+			return true
+		default:
+			return false
+		}
+	}, -1)
+	return decodeReply(rep, reply)
+}
+
+func decodeReply(rep replyMsg, reply interface{}) bool {
 	if rep.ok {
 		rb := bytes.NewBuffer(rep.reply)
 		rd := labgob.NewDecoder(rb)
@@ -135,17 +169,11 @@ type Network struct {
 	done           chan struct{} // closed when Network is cleaned up
 	count          int32         // total RPC count, for statistics
 	bytes          int64         // total bytes send, for statistics
+	sim            *sim.Sim      // nil unless made by MakeSimNetwork
 }
 
 func MakeNetwork() *Network {
-	rn := &Network{}
-	rn.reliable = true
-	rn.ends = map[interface{}]*ClientEnd{}
-	rn.enabled = map[interface{}]bool{}
-	rn.servers = map[interface{}]*Server{}
-	rn.connections = map[interface{}](interface{}){}
-	rn.endCh = make(chan reqMsg)
-	rn.done = make(chan struct{})
+	rn := makeNetwork()
 
 	// single goroutine to handle all ClientEnd.Call()s
 	go func() {
@@ -164,6 +192,25 @@ func MakeNetwork() *Network {
 	return rn
 }
 
+// 在s上模拟的网络，所有的延迟、丢包和请求处理的顺序都由s决定
+func MakeSimNetwork(s *sim.Sim) *Network {
+	rn := makeNetwork()
+	rn.sim = s
+	return rn
+}
+
+func makeNetwork() *Network {
+	rn := &Network{}
+	rn.reliable = true
+	rn.ends = map[interface{}]*ClientEnd{}
+	rn.enabled = map[interface{}]bool{}
+	rn.servers = map[interface{}]*Server{}
+	rn.connections = map[interface{}](interface{}){}
+	rn.endCh = make(chan reqMsg)
+	rn.done = make(chan struct{})
+	return rn
+}
+
 func (rn *Network) Cleanup() {
 	close(rn.done)
 }
@@ -221,32 +268,41 @@ func (rn *Network) processReq(req reqMsg) {
 	if enabled && servername != nil && server != nil {
 		if reliable == false {
 			// short delay
-			ms := (rand.Int() % 27)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			ms := (rn.randInt() % 27)
+			rn.sleep(time.Duration(ms) * time.Millisecond)
 		}
 
-		if reliable == false && (rand.Int()%1000) < 100 {
+		if reliable == false && (rn.randInt()%1000) < 100 {
 			// drop the request, return as if timeout
 			req.replyCh <- replyMsg{false, nil}
 			return
 		}
 
+		var reply replyMsg
+		replyOK := false
+		serverDead := false
+		if rn.sim != nil {
+			// a simulated handler runs to completion in this
+			// task; it must not wait for anything.
+			reply = server.dispatch(req)
+			replyOK = true
+		}
+
 		// execute the request (call the RPC handler).
 		// in a separate thread so that we can periodically check
 		// if the server has been killed and the RPC should get a
 		// failure reply.
 		ech := make(chan replyMsg)
-		go func() {
-			r := server.dispatch(req)
-			ech <- r
-		}()
+		if replyOK == false {
+			go func() {
+				r := server.dispatch(req)
+				ech <- r
+			}()
+		}
 
 		// wait for handler to return,
 		// but stop waiting if DeleteServer() has been called,
 		// and return an error.
-		var reply replyMsg
-		replyOK := false
-		serverDead := false
 		for replyOK == false && serverDead == false {
 			select {
 			case reply = <-ech:
@@ -272,16 +328,16 @@ func (rn *Network) processReq(req reqMsg) {
 		if replyOK == false || serverDead == true {
 			// server was killed while we were waiting; return error.
 			req.replyCh <- replyMsg{false, nil}
-		} else if reliable == false && (rand.Int()%1000) < 100 {
+		} else if reliable == false && (rn.randInt()%1000) < 100 {
 			// drop the reply, return as if timeout
 			req.replyCh <- replyMsg{false, nil}
-		} else if longreordering == true && rand.Intn(900) < 600 {
+		} else if longreordering == true && rn.randIntn(900) < 600 {
 			// delay the response for a while
-			ms := 200 + rand.Intn(1+rand.Intn(2000))
+			ms := 200 + rn.randIntn(1+rn.randIntn(2000))
 			// Russ points out that this timer arrangement will decrease
 			// the number of goroutines, so that the race
 			// detector is less likely to get upset.
-			time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			rn.afterFunc(time.Duration(ms)*time.Millisecond, func() {
 				atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
 				req.replyCh <- reply
 			})
@@ -295,19 +351,52 @@ func (rn *Network) processReq(req reqMsg) {
 		if rn.longDelays {
 			// let Raft tests check that leader doesn't send
 			// RPCs synchronously.
-			ms = (rand.Int() % 7000)
+			ms = (rn.randInt() % 7000)
 		} else {
 			// many kv tests require the client to try each
 			// server in fairly rapid succession.
-			ms = (rand.Int() % 100)
+			ms = (rn.randInt() % 100)
 		}
-		time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		rn.afterFunc(time.Duration(ms)*time.Millisecond, func() {
 			req.replyCh <- replyMsg{false, nil}
 		})
 	}
 
 }
 
+// the random source, the clock and the timers of the network:
+// the simulation's when there is one, the real ones otherwise.
+
+func (rn *Network) randInt() int {
+	if rn.sim != nil {
+		return int(rn.sim.Int63())
+	}
+	return rand.Int()
+}
+
+func (rn *Network) randIntn(n int) int {
+	if rn.sim != nil {
+		return rn.sim.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
+func (rn *Network) sleep(d time.Duration) {
+	if rn.sim != nil {
+		rn.sim.Sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+func (rn *Network) afterFunc(d time.Duration, f func()) {
+	if rn.sim != nil {
+		rn.sim.AfterFunc(d, f)
+		return
+	}
+	time.AfterFunc(d, f)
+}
+
 // create a client end-point.
 // start the thread that listens and delivers.
 func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
@@ -322,6 +411,7 @@ func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
 	e.endname = endname
 	e.ch = rn.endCh
 	e.done = rn.done
+	e.net = rn
 	rn.ends[endname] = e
 	rn.enabled[endname] = false
 	rn.connections[endname] = nil
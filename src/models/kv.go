@@ -7,13 +7,22 @@ import (
 )
 
 type KvInput struct {
-	Op    uint8 // 0 => get, 1 => put, 2 => append
-	Key   string
-	Value string
+	Op       uint8 // 0 => get, 1 => put, 2 => append, 3 => compare-and-swap, 4 => put-if-absent, 5 => delete-if-equals, 6 => delete
+	Key      string
+	Value    string
+	Expected string // for compare-and-swap and delete-if-equals
 }
 
 type KvOutput struct {
 	Value string
+	Ok    bool // whether a conditional write took effect
+}
+
+// the value of one key, and whether the key exists; a missing key
+// reads as "" but only put-if-absent can create it.
+type kvState struct {
+	Value  string
+	Exists bool
 }
 
 var KvModel = porcupine.Model{
@@ -37,22 +46,45 @@ var KvModel = porcupine.Model{
 	Init: func() interface{} {
 		// note: we are modeling a single key's value here;
 		// we're partitioning by key, so this is okay
-		return ""
+		return kvState{}
 	},
 	Step: func(state, input, output interface{}) (bool, interface{}) {
 		inp := input.(KvInput)
 		out := output.(KvOutput)
-		st := state.(string)
-		if inp.Op == 0 {
+		st := state.(kvState)
+		switch inp.Op {
+		case 0:
 			// get
-			return out.Value == st, state
-		} else if inp.Op == 1 {
+			return out.Value == st.Value, state
+		case 1:
 			// put
-			return true, inp.Value
-		} else {
+			return true, kvState{inp.Value, true}
+		case 2:
 			// append
-			return true, (st + inp.Value)
+			return true, kvState{st.Value + inp.Value, true}
+		case 6:
+			// delete
+			return true, kvState{}
+		}
+		// conditional writes: on a mismatch nothing changes and the
+		// current value is returned.
+		var match bool
+		var next kvState
+		switch inp.Op {
+		case 3:
+			match = st.Exists && st.Value == inp.Expected
+			next = kvState{inp.Value, true}
+		case 4:
+			match = !st.Exists
+			next = kvState{inp.Value, true}
+		default:
+			match = st.Exists && st.Value == inp.Expected
+			next = kvState{}
+		}
+		if !out.Ok {
+			return !match && out.Value == st.Value, state
 		}
+		return match, next
 	},
 	DescribeOperation: func(input, output interface{}) string {
 		inp := input.(KvInput)
@@ -64,6 +96,14 @@ var KvModel = porcupine.Model{
 			return fmt.Sprintf("put('%s', '%s')", inp.Key, inp.Value)
 		case 2:
 			return fmt.Sprintf("append('%s', '%s')", inp.Key, inp.Value)
+		case 3:
+			return fmt.Sprintf("cas('%s', '%s', '%s') -> %v '%s'", inp.Key, inp.Expected, inp.Value, out.Ok, out.Value)
+		case 4:
+			return fmt.Sprintf("putIfAbsent('%s', '%s') -> %v '%s'", inp.Key, inp.Value, out.Ok, out.Value)
+		case 5:
+			return fmt.Sprintf("deleteIfEquals('%s', '%s') -> %v '%s'", inp.Key, inp.Expected, out.Ok, out.Value)
+		case 6:
+			return fmt.Sprintf("delete('%s')", inp.Key)
 		default:
 			return "<invalid>"
 		}
@@ -0,0 +1,65 @@
+package raft
+
+//
+// checksums on persisted state and snapshots.
+//
+// every record Raft persists is framed as a 4-byte length, a 4-byte
+// CRC-32C of the payload and the payload itself: the records in
+// Persister's raftstate, FilePersister's WAL records, and its state
+// and snapshot files. snapshots carry a CRC of their data as well, in
+// storage and in InstallSnapshot, so a follower can tell a damaged
+// transfer from a good one.
+//
+// storage.Verify() checks everything on restart. Raft refuses to
+// start on state that fails the check instead of decoding garbage; a
+// snapshot that fails it on InstallSnapshot is dropped, and the
+// leader sends it again from the start.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// 持久化的数据校验失败
+var ErrCorrupt = errors.New("checksum mismatch")
+
+const frameHeaderBytes = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+// 向w追加一个带长度和校验和的记录
+func writeFrame(w *bytes.Buffer, payload []byte) int {
+	var header [frameHeaderBytes]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], checksum(payload))
+	w.Write(header[:])
+	w.Write(payload)
+	return frameHeaderBytes + len(payload)
+}
+
+// 读出data开头的记录，返回其中的数据和整个记录的大小。
+// data不足一个完整的记录时返回errTorn，校验失败时返回ErrCorrupt
+func readFrame(data []byte) ([]byte, int, error) {
+	if len(data) < frameHeaderBytes {
+		return nil, 0, errTorn
+	}
+	n := int(binary.LittleEndian.Uint32(data[0:]))
+	if n < 0 || len(data)-frameHeaderBytes < n {
+		return nil, 0, errTorn
+	}
+	payload := data[frameHeaderBytes : frameHeaderBytes+n]
+	if checksum(payload) != binary.LittleEndian.Uint32(data[4:]) {
+		return nil, 0, ErrCorrupt
+	}
+	return payload, frameHeaderBytes + n, nil
+}
+
+// 记录不完整，例如写到一半时崩溃
+var errTorn = errors.New("incomplete record")
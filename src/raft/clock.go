@@ -0,0 +1,129 @@
+package raft
+
+//
+// time, randomness and goroutines.
+//
+// everything in Raft that depends on the clock, on random numbers or
+// on starting a goroutine goes through the helpers here. a Raft made
+// by MakeSimulated runs on a sim.Sim instead: a virtual clock, a
+// seeded random source and a scheduler that runs one goroutine at a
+// time, so a test can replay a failing seed exactly (see ../sim).
+// rf.sim is nil otherwise, and the helpers use the real clock.
+//
+// in simulation a goroutine must not block on a channel or a
+// sync.Cond, so waits go through recv(), waitApply() and deliver().
+//
+
+import (
+	"cs651/sim"
+	"math/rand"
+	"time"
+)
+
+func (rf *Raft) now() time.Time {
+	if rf.sim != nil {
+		return rf.sim.Now()
+	}
+	return time.Now()
+}
+
+func (rf *Raft) since(t time.Time) time.Duration {
+	return rf.now().Sub(t)
+}
+
+func (rf *Raft) sleep(d time.Duration) {
+	if rf.sim != nil {
+		rf.sim.Sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// 启动一个goroutine
+func (rf *Raft) spawn(f func()) {
+	if rf.sim != nil {
+		rf.sim.Go(f)
+		return
+	}
+	go f()
+}
+
+func (rf *Raft) afterFunc(d time.Duration, f func()) sim.Timer {
+	if rf.sim != nil {
+		return rf.sim.AfterFunc(d, f)
+	}
+	return time.AfterFunc(d, f)
+}
+
+// 随机的选举超时(毫秒)
+func (rf *Raft) randTimeout() int {
+	if rf.sim != nil {
+		return electionTimeout + rf.sim.Intn(electionTimeout)
+	}
+	return getRandTimeout()
+}
+
+// 从ch接收一个值，最多等待d，d<0时一直等待。返回收到的值和是否收到
+func (rf *Raft) recv(ch chan bool, d time.Duration) (bool, bool) {
+	if rf.sim != nil {
+		v := false
+		ok := rf.sim.Await(func() bool {
+			select {
+			case v = <-ch:
+				return true
+			default:
+				return false
+			}
+		}, d)
+		return v, ok
+	}
+	if d < 0 {
+		return <-ch, true
+	}
+	select {
+	case v := <-ch:
+		return v, true
+	case <-time.After(d):
+		return false, false
+	}
+}
+
+// 把msg发送到applyCh，不持有锁时调用
+func (rf *Raft) deliver(msg ApplyMsg) {
+	if rf.sim != nil {
+		rf.sim.Await(func() bool {
+			select {
+			case rf.applyChan <- msg:
+				return true
+			default:
+				return false
+			}
+		}, -1)
+		return
+	}
+	rf.applyChan <- msg
+}
+
+// applier等待新的已提交日志或者快照
+// use it with lock
+func (rf *Raft) waitApply() {
+	if rf.sim == nil {
+		rf.applyCond.Wait()
+		return
+	}
+	rf.mu.Unlock()
+	rf.sim.Await(func() bool {
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		return rf.killed() || rf.commitIndex > rf.lastApplied ||
+			(rf.received != nil && !rf.received.delivered)
+	}, -1)
+	rf.mu.Lock()
+}
+
+// create a Raft peer
+// The me argument is the index of this peer in the peers array.
+func getRandTimeout() int {
+	rand.Seed(time.Now().UnixNano())
+	return electionTimeout + rand.Intn(electionTimeout)
+}
@@ -0,0 +1,191 @@
+package raft
+
+//
+// log compaction policy.
+//
+// instead of polling rf.GetRaftStateSize() and calling
+// GenerateSnapshot, a service hands Raft a policy and a function that
+// serializes its state:
+//
+// rf.SetCompaction(policy, retain, snapshot)
+//   after each batch of applied entries Raft asks policy whether the
+//   log should be compacted. if so it calls snapshot(), without
+//   holding its lock, to get the service's state and the index of the
+//   last entry that state includes.
+//
+// the new snapshot is kept pending until retain more entries have
+// been applied after it, so the log always keeps at least retain
+// entries behind lastApplied and a follower that is only a little
+// behind can still be sent entries instead of the whole snapshot.
+//
+// compaction also waits while a snapshot is being transferred: on a
+// leader sending InstallSnapshot chunks to some follower (a new
+// snapshot would restart the transfer from offset 0), and on a
+// follower receiving one or waiting for CondInstallSnapshot.
+//
+
+import "time"
+
+// 两次生成快照之间的最小间隔，这期间应用的日志合并到下一次快照
+const minCompactionInterval = 20 * time.Millisecond
+
+// 决定压缩日志时参考的状态
+type CompactionStats struct {
+	StateSize int           // 持久化的Raft状态大小(字节)
+	Entries   int           // 已经应用、还没有包含在快照中的日志条数
+	SinceLast time.Duration // 距离上一次快照的时间
+}
+
+// 日志压缩策略
+type CompactionPolicy interface {
+	ShouldCompact(s CompactionStats) bool
+}
+
+// Raft状态超过指定的字节数时压缩
+type SizePolicy int
+
+func (p SizePolicy) ShouldCompact(s CompactionStats) bool {
+	return s.StateSize > int(p)
+}
+
+// 快照之后应用的日志超过指定条数时压缩
+type EntryCountPolicy int
+
+func (p EntryCountPolicy) ShouldCompact(s CompactionStats) bool {
+	return s.Entries > int(p)
+}
+
+// 距离上一次快照超过指定时间、并且有新的日志时压缩
+type IntervalPolicy time.Duration
+
+func (p IntervalPolicy) ShouldCompact(s CompactionStats) bool {
+	return s.Entries > 0 && s.SinceLast > time.Duration(p)
+}
+
+// 任何一个策略满足时压缩
+type AnyPolicy []CompactionPolicy
+
+func (p AnyPolicy) ShouldCompact(s CompactionStats) bool {
+	for _, policy := range p {
+		if policy.ShouldCompact(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// 服务生成的、等待保留足够日志之后再安装的快照
+type pendingSnapshot struct {
+	index int
+	data  []byte
+}
+
+// 设置日志压缩策略。snapshot返回服务当前的状态和其中包含的最后一条日志的index，
+// 它在Raft不持有锁时调用，可以获取服务自己的锁。
+// retain是压缩之后至少保留的日志条数，只能调用一次
+func (rf *Raft) SetCompaction(policy CompactionPolicy, retain int, snapshot func() ([]byte, int)) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.compactCh != nil {
+		return
+	}
+	rf.compactionPolicy = policy
+	rf.compactionRetain = retain
+	rf.compactCh = make(chan bool, 1)
+	rf.lastCompaction = rf.now()
+	rf.spawn(func() { rf.compactor(snapshot) })
+}
+
+// 唤醒压缩goroutine，没有设置压缩策略时什么也不做
+// use it with lock
+func (rf *Raft) wakeCompactor() {
+	if rf.compactCh == nil {
+		return
+	}
+	select {
+	case rf.compactCh <- true:
+	default:
+	}
+}
+
+// 等待applier应用新的日志，按策略生成快照，保留足够的日志之后再安装
+func (rf *Raft) compactor(snapshot func() ([]byte, int)) {
+	recheck := false
+	for {
+		// 刚生成过快照时不等待，服务可能还没有应用完最后一批日志
+		if !recheck {
+			rf.recv(rf.compactCh, -1)
+		}
+		recheck = false
+		if rf.killed() {
+			return
+		}
+		rf.mu.Lock()
+		stats := rf.compactionStats()
+		if rf.pending == nil && stats.Entries > 0 && rf.compactionPolicy.ShouldCompact(stats) {
+			rf.mu.Unlock()
+			data, index := snapshot()
+			rf.mu.Lock()
+			if index > rf.lastIncludedIndex {
+				rf.pending = &pendingSnapshot{index: index, data: data}
+			}
+			rf.installPending()
+			rf.mu.Unlock()
+			rf.sleep(minCompactionInterval)
+			recheck = true
+			continue
+		}
+		rf.installPending()
+		rf.mu.Unlock()
+	}
+}
+
+// use it with lock
+func (rf *Raft) compactionStats() CompactionStats {
+	return CompactionStats{
+		StateSize: rf.persister.RaftStateSize(),
+		Entries:   rf.lastApplied - rf.lastIncludedIndex,
+		SinceLast: rf.since(rf.lastCompaction),
+	}
+}
+
+// 之后应用了至少retain条日志、并且没有快照在传输时，安装等待中的快照
+// use it with lock
+func (rf *Raft) installPending() {
+	p := rf.pending
+	if p == nil {
+		return
+	}
+	if p.index <= rf.lastIncludedIndex {
+		// 已经安装了leader发来的更新的快照
+		rf.pending = nil
+		return
+	}
+	if rf.lastApplied < p.index+rf.compactionRetain || rf.snapshotInFlight() {
+		return
+	}
+	rf.pending = nil
+	rf.compactLog(p.data, p.index)
+}
+
+// 是否有快照正在传输：leader正在向某个follower发送快照，
+// 或者本节点正在接收快照、等待服务安装
+// use it with lock
+func (rf *Raft) snapshotInFlight() bool {
+	// 比commitIndex旧的快照不会被安装，可能是上一个leader没有发完的
+	if rf.staging.index > rf.commitIndex || rf.received != nil {
+		return true
+	}
+	if rf.role != Role_Leader {
+		return false
+	}
+	// 只等待已经发出分块、并且最近还在回复的follower，宕机的follower不能一直阻止压缩
+	timeout := time.Duration(2*electionTimeout) * time.Millisecond
+	for _, id := range rf.otherMembers() {
+		p := rf.progress[id]
+		if rf.nextIndex[id] <= rf.lastIncludedIndex && p.snapshotOffset > 0 && rf.since(p.lastAck) < timeout {
+			return true
+		}
+	}
+	return false
+}
@@ -7,9 +7,15 @@ package raft
 // so, while you can modify this code to help you debug, please
 // test with the original before submitting.
 //
+// make_sim_config() builds the same cluster on a sim.Sim: a virtual
+// clock, one seeded random source and one task running at a time.
+// the test must then run inside cfg.run(), and use cfg.sleep() and
+// cfg.intn() instead of time.Sleep() and rand.
+//
 
 import (
 	"cs651/labrpc"
+	"cs651/sim"
 	"log"
 	"math/rand"
 	"runtime"
@@ -39,7 +45,7 @@ func makeSeed() int64 {
 
 type config struct {
 	mu        sync.Mutex
-	t         *testing.T
+	t         testing.TB
 	net       *labrpc.Network
 	n         int
 	rafts     []*Raft
@@ -56,11 +62,27 @@ type config struct {
 	bytes0    int64
 	maxIndex  int
 	maxIndex0 int
+	sim       *sim.Sim // nil unless made by make_sim_config()
+	witnesses []int    // set by make_witness_config()
 }
 
 var ncpu_once sync.Once
 
-func make_config(t *testing.T, n int, unreliable bool) *config {
+func make_config(t testing.TB, n int, unreliable bool) *config {
+	return makeConfig(t, n, unreliable, nil, nil)
+}
+
+// a cluster simulated with seed; the same seed replays the same run.
+func make_sim_config(t testing.TB, n int, unreliable bool, seed int64) *config {
+	return makeConfig(t, n, unreliable, sim.New(seed), nil)
+}
+
+// a cluster in which the servers listed in witnesses are witnesses.
+func make_witness_config(t testing.TB, n int, witnesses []int) *config {
+	return makeConfig(t, n, false, nil, witnesses)
+}
+
+func makeConfig(t testing.TB, n int, unreliable bool, s *sim.Sim, witnesses []int) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
@@ -70,7 +92,13 @@ func make_config(t *testing.T, n int, unreliable bool) *config {
 	runtime.GOMAXPROCS(4)
 	cfg := &config{}
 	cfg.t = t
-	cfg.net = labrpc.MakeNetwork()
+	cfg.sim = s
+	cfg.witnesses = witnesses
+	if s != nil {
+		cfg.net = labrpc.MakeSimNetwork(s)
+	} else {
+		cfg.net = labrpc.MakeNetwork()
+	}
 	cfg.n = n
 	cfg.applyErr = make([]string, cfg.n)
 	cfg.rafts = make([]*Raft, cfg.n)
@@ -166,44 +194,39 @@ func (cfg *config) start1(i int) {
 	cfg.mu.Unlock()
 
 	// listen to messages from Raft indicating newly committed messages.
-	applyCh := make(chan ApplyMsg)
-	go func() {
-		for m := range applyCh {
-			err_msg := ""
-			if m.CommandValid == false {
-				// ignore other types of ApplyMsg
-			} else {
-				v := m.Command
-				cfg.mu.Lock()
-				for j := 0; j < len(cfg.logs); j++ {
-					if old, oldok := cfg.logs[j][m.CommandIndex]; oldok && old != v {
-						// some server has already committed a different value for this entry!
-						err_msg = fmt.Sprintf("commit index=%v server=%v %v != server=%v %v",
-							m.CommandIndex, i, m.Command, j, old)
+	var rf *Raft
+	if cfg.sim != nil {
+		// a simulated Raft never blocks sending, so the channel
+		// needs room for one message.
+		applyCh := make(chan ApplyMsg, 1)
+		cfg.sim.Go(func() {
+			for {
+				var m ApplyMsg
+				cfg.sim.Await(func() bool {
+					select {
+					case m = <-applyCh:
+						return true
+					default:
+						return false
 					}
-				}
-				_, prevok := cfg.logs[i][m.CommandIndex-1]
-				cfg.logs[i][m.CommandIndex] = v
-				if m.CommandIndex > cfg.maxIndex {
-					cfg.maxIndex = m.CommandIndex
-				}
-				cfg.mu.Unlock()
-
-				if m.CommandIndex > 1 && prevok == false {
-					err_msg = fmt.Sprintf("server %v apply out of order %v", i, m.CommandIndex)
-				}
+				}, -1)
+				cfg.checkApply(i, m)
 			}
-
-			if err_msg != "" {
-				log.Fatalf("apply error: %v\n", err_msg)
-				cfg.applyErr[i] = err_msg
-				// keep reading after error so that Raft doesn't block
-				// holding locks...
+		})
+		rf = MakeSimulated(ends, i, cfg.saved[i], applyCh, cfg.sim)
+	} else {
+		applyCh := make(chan ApplyMsg)
+		go func() {
+			for m := range applyCh {
+				cfg.checkApply(i, m)
 			}
+		}()
+		if cfg.witnesses != nil {
+			rf = MakeWithWitnesses(ends, i, cfg.saved[i], applyCh, cfg.witnesses)
+		} else {
+			rf = Make(ends, i, cfg.saved[i], applyCh)
 		}
-	}()
-
-	rf := Make(ends, i, cfg.saved[i], applyCh)
+	}
 
 	cfg.mu.Lock()
 	cfg.rafts[i] = rf
@@ -215,6 +238,86 @@ func (cfg *config) start1(i int) {
 	cfg.net.AddServer(i, srv)
 }
 
+// check a message that server i sent on its applyCh.
+func (cfg *config) checkApply(i int, m ApplyMsg) {
+	err_msg := ""
+	if m.CommandValid == false {
+		// ignore other types of ApplyMsg
+	} else {
+		v := m.Command
+		cfg.mu.Lock()
+		for j := 0; j < len(cfg.logs); j++ {
+			if old, oldok := cfg.logs[j][m.CommandIndex]; oldok && old != v {
+				// some server has already committed a different value for this entry!
+				err_msg = fmt.Sprintf("commit index=%v server=%v %v != server=%v %v",
+					m.CommandIndex, i, m.Command, j, old)
+			}
+		}
+		_, prevok := cfg.logs[i][m.CommandIndex-1]
+		cfg.logs[i][m.CommandIndex] = v
+		if m.CommandIndex > cfg.maxIndex {
+			cfg.maxIndex = m.CommandIndex
+		}
+		cfg.mu.Unlock()
+
+		if m.CommandIndex > 1 && prevok == false {
+			err_msg = fmt.Sprintf("server %v apply out of order %v", i, m.CommandIndex)
+		}
+	}
+
+	if err_msg != "" {
+		if cfg.sim != nil {
+			err_msg += fmt.Sprintf(" (seed %v)", cfg.sim.Seed())
+		}
+		log.Fatalf("apply error: %v\n", err_msg)
+		cfg.applyErr[i] = err_msg
+		// keep reading after error so that Raft doesn't block
+		// holding locks...
+	}
+}
+
+// run the test body. a simulated test runs it as the first task of
+// the simulation, and everything stops when it returns.
+func (cfg *config) run(body func()) {
+	if cfg.sim == nil {
+		body()
+		return
+	}
+	cfg.sim.Run(body)
+}
+
+// the clock and the random source of the test: the simulation's, or
+// the real ones.
+
+func (cfg *config) now() time.Time {
+	if cfg.sim != nil {
+		return cfg.sim.Now()
+	}
+	return time.Now()
+}
+
+func (cfg *config) sleep(d time.Duration) {
+	if cfg.sim != nil {
+		cfg.sim.Sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+func (cfg *config) int63() int64 {
+	if cfg.sim != nil {
+		return cfg.sim.Int63()
+	}
+	return rand.Int63()
+}
+
+func (cfg *config) intn(n int) int {
+	if cfg.sim != nil {
+		return cfg.sim.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
 func (cfg *config) checkTimeout() {
 	// enforce a two minute real-time limit on each test
 	if !cfg.t.Failed() && time.Since(cfg.start) > 120*time.Second {
@@ -302,8 +405,8 @@ func (cfg *config) setlongreordering(longrel bool) {
 // try a few times in case re-elections are needed.
 func (cfg *config) checkOneLeader() int {
 	for iters := 0; iters < 10; iters++ {
-		ms := 450 + (rand.Int63() % 100)
-		time.Sleep(time.Duration(ms) * time.Millisecond)
+		ms := 450 + (cfg.int63() % 100)
+		cfg.sleep(time.Duration(ms) * time.Millisecond)
 
 		leaders := make(map[int][]int)
 		for i := 0; i < cfg.n; i++ {
@@ -394,7 +497,7 @@ func (cfg *config) wait(index int, n int, startTerm int) interface{} {
 		if nd >= n {
 			break
 		}
-		time.Sleep(to)
+		cfg.sleep(to)
 		if to < time.Second {
 			to *= 2
 		}
@@ -429,9 +532,9 @@ func (cfg *config) wait(index int, n int, startTerm int) interface{} {
 // if retry==false, calls Start() only once, in order
 // to simplify the early Lab 2B tests.
 func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
-	t0 := time.Now()
+	t0 := cfg.now()
 	starts := 0
-	for time.Since(t0).Seconds() < 10 {
+	for cfg.now().Sub(t0).Seconds() < 10 {
 		// try all the servers, maybe one is the leader.
 		index := -1
 		for si := 0; si < cfg.n; si++ {
@@ -454,8 +557,8 @@ func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
 		if index != -1 {
 			// somebody claimed to be the leader and to have
 			// submitted our command; wait a while for agreement.
-			t1 := time.Now()
-			for time.Since(t1).Seconds() < 2 {
+			t1 := cfg.now()
+			for cfg.now().Sub(t1).Seconds() < 2 {
 				nd, cmd1 := cfg.nCommitted(index)
 				if nd > 0 && nd >= expectedServers {
 					// committed
@@ -464,13 +567,13 @@ func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
 						return index
 					}
 				}
-				time.Sleep(20 * time.Millisecond)
+				cfg.sleep(20 * time.Millisecond)
 			}
 			if retry == false {
 				cfg.t.Fatalf("one(%v) failed to reach agreement", cmd)
 			}
 		} else {
-			time.Sleep(50 * time.Millisecond)
+			cfg.sleep(50 * time.Millisecond)
 		}
 	}
 	cfg.t.Fatalf("one(%v) failed to reach agreement", cmd)
@@ -482,7 +585,7 @@ func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
 // e.g. cfg.begin("Test (2B): RPC counts aren't too high")
 func (cfg *config) begin(description string) {
 	fmt.Printf("%s ...\n", description)
-	cfg.t0 = time.Now()
+	cfg.t0 = cfg.now()
 	cfg.rpcs0 = cfg.rpcTotal()
 	cfg.bytes0 = cfg.bytesTotal()
 	cfg.cmds0 = 0
@@ -497,7 +600,7 @@ func (cfg *config) end() {
 	cfg.checkTimeout()
 	if cfg.t.Failed() == false {
 		cfg.mu.Lock()
-		t := time.Since(cfg.t0).Seconds()       // real time
+		t := cfg.now().Sub(cfg.t0).Seconds()    // real (or simulated) time
 		npeers := cfg.n                         // number of Raft peers
 		nrpc := cfg.rpcTotal() - cfg.rpcs0      // number of RPC sends
 		nbytes := cfg.bytesTotal() - cfg.bytes0 // number of bytes
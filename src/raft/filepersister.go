@@ -0,0 +1,562 @@
+package raft
+
+//
+// a Storage that keeps Raft's state on disk, so a server can be
+// restarted as a real process.
+//
+// dir/state           term and votedFor, replaced atomically.
+// dir/snapshot        snapshot metadata and data, replaced atomically.
+// dir/wal-<index>.log log segments, named by the index of their first
+//                     entry. each record is a labgob-encoded Log.
+//
+// every file and every record carries a CRC (see checksum.go).
+// appends only write the new records and fsync the segment. on open,
+// an incomplete record at the end of the last segment (a crash in the
+// middle of a write) is cut off; everything before it is kept. a
+// record or file whose CRC does not match is corruption, not a crash,
+// and MakeFilePersister fails instead of dropping acknowledged state.
+//
+
+import (
+	"bytes"
+	"cs651/labgob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// 单个日志段的大小上限，超过之后新建一个段
+const segmentBytes = 4 << 20
+
+type FilePersister struct {
+	mu       sync.Mutex
+	dir      string
+	hs       HardState
+	hasState bool
+	meta     SnapshotMeta
+	snapSize int
+	segments []*segment
+	records  []record // 磁盘上每条日志的位置，按index排序
+}
+
+type segment struct {
+	first int // 段中第一条日志的index
+	path  string
+	size  int64
+	file  *os.File // 只有最后一个段是打开的
+}
+
+type record struct {
+	index  int
+	seg    *segment
+	offset int64
+	size   int64
+}
+
+// 快照文件的内容
+type snapshotFile struct {
+	Meta SnapshotMeta
+	Data []byte
+}
+
+// MakeFilePersister 打开dir中保存的状态，dir不存在时创建。
+// 最后一个日志段末尾不完整的记录会被截断；校验和不匹配时返回的错误是ErrCorrupt
+func MakeFilePersister(dir string) (*FilePersister, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fp := &FilePersister{dir: dir, hs: HardState{VotedFor: -1}}
+	if err := fp.recover(); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return fp, nil
+}
+
+// 关闭打开的日志段
+func (fp *FilePersister) Close() {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	for _, seg := range fp.segments {
+		if seg.file != nil {
+			seg.file.Close()
+			seg.file = nil
+		}
+	}
+}
+
+func (fp *FilePersister) recover() error {
+	data, err := fp.readFile("state")
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		d := labgob.NewDecoder(bytes.NewBuffer(data))
+		if err := d.Decode(&fp.hs); err != nil {
+			return fmt.Errorf("decode state: %v", err)
+		}
+		fp.hasState = true
+	}
+
+	sf, err := fp.readSnapshotFile()
+	if err != nil {
+		return err
+	}
+	if sf != nil {
+		fp.meta = sf.Meta
+		fp.snapSize = len(sf.Data)
+		fp.hasState = true
+	}
+
+	paths, err := filepath.Glob(filepath.Join(fp.dir, "wal-*.log"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		seg := &segment{path: path}
+		if _, err := fmt.Sscanf(filepath.Base(path), "wal-%d.log", &seg.first); err != nil {
+			return fmt.Errorf("bad segment name %v", path)
+		}
+		fp.segments = append(fp.segments, seg)
+	}
+	sort.Slice(fp.segments, func(i, j int) bool {
+		return fp.segments[i].first < fp.segments[j].first
+	})
+
+	for i := 0; i < len(fp.segments); {
+		seg := fp.segments[i]
+		// 段之间不连续说明删除旧段时崩溃了，之前的段已经被快照覆盖
+		if len(fp.records) > 0 && seg.first != fp.records[len(fp.records)-1].index+1 {
+			for _, old := range fp.segments[:i] {
+				os.Remove(old.path)
+			}
+			fp.segments = fp.segments[i:]
+			fp.records = nil
+			i = 0
+			continue
+		}
+		torn, err := fp.scanSegment(seg)
+		if err != nil {
+			return err
+		}
+		if torn {
+			// 崩溃时写了一半的记录，之后的段都不可信
+			for _, later := range fp.segments[i+1:] {
+				os.Remove(later.path)
+			}
+			fp.segments = fp.segments[:i+1]
+			break
+		}
+		i++
+	}
+	if len(fp.segments) > 0 {
+		fp.hasState = true
+		tail := fp.segments[len(fp.segments)-1]
+		tail.file, err = os.OpenFile(tail.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读出段中的所有完整记录，不完整的结尾被截断
+func (fp *FilePersister) scanSegment(seg *segment) (bool, error) {
+	data, err := os.ReadFile(seg.path)
+	if err != nil {
+		return false, err
+	}
+	offset := int64(0)
+	n := 0
+	for offset < int64(len(data)) {
+		entry, size, err := decodeRecord(data[offset:])
+		if err == ErrCorrupt {
+			return false, fmt.Errorf("%v at offset %v: %w", seg.path, offset, err)
+		}
+		if err != nil || entry.Index != seg.first+n {
+			DPrintf("FilePersister %v: torn record in %v at offset %v", fp.dir, seg.path, offset)
+			if err := os.Truncate(seg.path, offset); err != nil {
+				return false, err
+			}
+			seg.size = offset
+			return true, nil
+		}
+		fp.records = append(fp.records, record{index: entry.Index, seg: seg, offset: offset, size: size})
+		offset += size
+		n++
+	}
+	seg.size = offset
+	return false, nil
+}
+
+func encodeRecord(buf *bytes.Buffer, entry Log) int64 {
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(entry)
+	return int64(writeFrame(buf, w.Bytes()))
+}
+
+// 解码data开头的记录，返回记录的大小
+func decodeRecord(data []byte) (Log, int64, error) {
+	entry := Log{}
+	payload, size, err := readFrame(data)
+	if err != nil {
+		return entry, 0, err
+	}
+	d := labgob.NewDecoder(bytes.NewBuffer(payload))
+	if err := d.Decode(&entry); err != nil {
+		return entry, 0, err
+	}
+	return entry, int64(size), nil
+}
+
+// 读出name文件中带校验和的内容，文件不存在时返回nil
+func (fp *FilePersister) readFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(fp.dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	payload, _, err := readFrame(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return payload, nil
+}
+
+// 读出快照文件，文件不存在时返回nil
+func (fp *FilePersister) readSnapshotFile() (*snapshotFile, error) {
+	data, err := fp.readFile("snapshot")
+	if data == nil || err != nil {
+		return nil, err
+	}
+	sf := &snapshotFile{}
+	d := labgob.NewDecoder(bytes.NewBuffer(data))
+	if err := d.Decode(sf); err != nil {
+		return nil, fmt.Errorf("decode snapshot: %v", err)
+	}
+	return sf, nil
+}
+
+// 先写临时文件再rename，保证文件内容要么是旧的要么是新的。
+// data加上长度和校验和之后写入
+func (fp *FilePersister) writeAtomic(name string, data []byte) {
+	path := filepath.Join(fp.dir, name)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatalf("FilePersister: %v", err)
+	}
+	framed := new(bytes.Buffer)
+	writeFrame(framed, data)
+	if _, err := f.Write(framed.Bytes()); err != nil {
+		log.Fatalf("FilePersister: write %v: %v", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		log.Fatalf("FilePersister: sync %v: %v", tmp, err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		log.Fatalf("FilePersister: %v", err)
+	}
+	fp.syncDir()
+}
+
+// 文件的创建、rename和删除要sync目录才能持久化
+func (fp *FilePersister) syncDir() {
+	d, err := os.Open(fp.dir)
+	if err != nil {
+		log.Fatalf("FilePersister: %v", err)
+	}
+	d.Sync()
+	d.Close()
+}
+
+func (fp *FilePersister) SaveHardState(term int, votedFor int) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.hasState && fp.hs.Term == term && fp.hs.VotedFor == votedFor {
+		return
+	}
+	fp.hs = HardState{Term: term, VotedFor: votedFor}
+	fp.hasState = true
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(fp.hs)
+	fp.writeAtomic("state", w.Bytes())
+}
+
+func (fp *FilePersister) AppendLog(entries []Log) {
+	if len(entries) == 0 {
+		return
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.truncateFrom(entries[0].Index)
+	// 与已有日志不连续(例如快照之后)，从新的段开始
+	if len(fp.records) == 0 || fp.records[len(fp.records)-1].index+1 != entries[0].Index {
+		fp.removeSegments(0)
+		fp.records = nil
+	}
+
+	buf := new(bytes.Buffer)
+	var tail *segment
+	if len(fp.segments) > 0 {
+		tail = fp.segments[len(fp.segments)-1]
+	}
+	for _, entry := range entries {
+		if tail == nil || tail.size+int64(buf.Len()) >= segmentBytes {
+			fp.writeTail(tail, buf)
+			tail = fp.newSegment(entry.Index)
+		}
+		offset := tail.size + int64(buf.Len())
+		size := encodeRecord(buf, entry)
+		fp.records = append(fp.records, record{index: entry.Index, seg: tail, offset: offset, size: size})
+	}
+	fp.writeTail(tail, buf)
+	fp.hasState = true
+}
+
+// 把buf写到seg末尾并fsync
+func (fp *FilePersister) writeTail(seg *segment, buf *bytes.Buffer) {
+	if seg == nil || buf.Len() == 0 {
+		return
+	}
+	n, err := seg.file.Write(buf.Bytes())
+	if err != nil {
+		log.Fatalf("FilePersister: write %v: %v", seg.path, err)
+	}
+	if err := seg.file.Sync(); err != nil {
+		log.Fatalf("FilePersister: sync %v: %v", seg.path, err)
+	}
+	seg.size += int64(n)
+	buf.Reset()
+}
+
+func (fp *FilePersister) newSegment(first int) *segment {
+	if len(fp.segments) > 0 {
+		last := fp.segments[len(fp.segments)-1]
+		last.file.Close()
+		last.file = nil
+	}
+	seg := &segment{first: first, path: filepath.Join(fp.dir, fmt.Sprintf("wal-%016d.log", first))}
+	f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("FilePersister: %v", err)
+	}
+	seg.file = f
+	fp.segments = append(fp.segments, seg)
+	fp.syncDir()
+	return seg
+}
+
+// 删除index及之后的日志
+// use it with lock
+func (fp *FilePersister) truncateFrom(index int) {
+	i := sort.Search(len(fp.records), func(i int) bool { return fp.records[i].index >= index })
+	if i == len(fp.records) {
+		return
+	}
+	r := fp.records[i]
+	fp.records = fp.records[:i]
+	// 删除r所在段之后的段
+	for j, seg := range fp.segments {
+		if seg == r.seg {
+			fp.removeSegments(j + 1)
+			break
+		}
+	}
+	if r.offset == 0 {
+		// 整个段都被截断
+		fp.removeSegments(len(fp.segments) - 1)
+		return
+	}
+	if err := r.seg.file.Truncate(r.offset); err != nil {
+		log.Fatalf("FilePersister: truncate %v: %v", r.seg.path, err)
+	}
+	if err := r.seg.file.Sync(); err != nil {
+		log.Fatalf("FilePersister: sync %v: %v", r.seg.path, err)
+	}
+	r.seg.size = r.offset
+}
+
+// 删除segments[from:]，被删除段之前的段成为最后一个段并打开
+// use it with lock
+func (fp *FilePersister) removeSegments(from int) {
+	if from >= len(fp.segments) {
+		return
+	}
+	for i := len(fp.segments) - 1; i >= from; i-- {
+		seg := fp.segments[i]
+		if seg.file != nil {
+			seg.file.Close()
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("FilePersister: %v", err)
+		}
+	}
+	fp.segments = fp.segments[:from]
+	fp.syncDir()
+	if len(fp.segments) > 0 {
+		tail := fp.segments[len(fp.segments)-1]
+		if tail.file == nil {
+			f, err := os.OpenFile(tail.path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatalf("FilePersister: %v", err)
+			}
+			tail.file = f
+		}
+	}
+}
+
+func (fp *FilePersister) SaveSnapshot(meta SnapshotMeta, snapshot []byte) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(snapshotFile{Meta: meta, Data: snapshot})
+	fp.writeAtomic("snapshot", w.Bytes())
+	fp.meta = meta
+	fp.snapSize = len(snapshot)
+	fp.hasState = true
+
+	// 快照覆盖了所有日志
+	if len(fp.records) == 0 || fp.records[len(fp.records)-1].index <= meta.LastIncludedIndex {
+		fp.removeSegments(0)
+		fp.records = nil
+		return
+	}
+	// 删除所有日志都在快照中的段，从最旧的开始删，保证剩下的段是连续的
+	i := sort.Search(len(fp.records), func(i int) bool { return fp.records[i].index > meta.LastIncludedIndex })
+	live := fp.records[i].seg
+	for len(fp.segments) > 0 && fp.segments[0] != live {
+		if err := os.Remove(fp.segments[0].path); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("FilePersister: %v", err)
+		}
+		fp.segments = fp.segments[1:]
+	}
+	fp.syncDir()
+	j := 0
+	for j < len(fp.records) && fp.records[j].seg != live {
+		j++
+	}
+	fp.records = append([]record{}, fp.records[j:]...)
+}
+
+func (fp *FilePersister) ReadState() (HardState, SnapshotMeta, []Log, bool) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	entries := fp.readEntries(fp.meta.LastIncludedIndex+1, -1)
+	return fp.hs, fp.meta, entries, fp.hasState
+}
+
+func (fp *FilePersister) Entries(lo int, hi int) []Log {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if lo <= fp.meta.LastIncludedIndex {
+		lo = fp.meta.LastIncludedIndex + 1
+	}
+	return fp.readEntries(lo, hi)
+}
+
+// 从段文件中读出[lo, hi)之间的日志，hi为-1表示直到最后
+// use it with lock
+func (fp *FilePersister) readEntries(lo int, hi int) []Log {
+	entries := []Log{}
+	i := sort.Search(len(fp.records), func(i int) bool { return fp.records[i].index >= lo })
+	var f *os.File
+	var cur *segment
+	for ; i < len(fp.records) && (hi == -1 || fp.records[i].index < hi); i++ {
+		r := fp.records[i]
+		if r.seg != cur {
+			if f != nil {
+				f.Close()
+			}
+			var err error
+			f, err = os.Open(r.seg.path)
+			if err != nil {
+				log.Fatalf("FilePersister: %v", err)
+			}
+			cur = r.seg
+		}
+		data := make([]byte, r.size)
+		if _, err := f.ReadAt(data, r.offset); err != nil {
+			log.Fatalf("FilePersister: read %v: %v", r.seg.path, err)
+		}
+		entry, _, err := decodeRecord(data)
+		if err != nil {
+			log.Fatalf("FilePersister: bad record %v in %v: %v", r.index, r.seg.path, err)
+		}
+		entries = append(entries, entry)
+	}
+	if f != nil {
+		f.Close()
+	}
+	return entries
+}
+
+func (fp *FilePersister) ReadSnapshot() []byte {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	sf, err := fp.readSnapshotFile()
+	if err != nil {
+		log.Fatalf("FilePersister: %v", err)
+	}
+	if sf == nil {
+		return nil
+	}
+	return sf.Data
+}
+
+// 重新读出所有文件和日志记录，检查它们的校验和
+func (fp *FilePersister) Verify() error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if _, err := fp.readFile("state"); err != nil {
+		return err
+	}
+	if _, err := fp.readSnapshotFile(); err != nil {
+		return err
+	}
+	for _, seg := range fp.segments {
+		data, err := os.ReadFile(seg.path)
+		if err != nil {
+			return err
+		}
+		for _, r := range fp.records {
+			if r.seg != seg {
+				continue
+			}
+			if r.offset+r.size > int64(len(data)) {
+				return fmt.Errorf("%v: record %v: %w", seg.path, r.index, errTorn)
+			}
+			if _, _, err := decodeRecord(data[r.offset : r.offset+r.size]); err != nil {
+				return fmt.Errorf("%v: record %v: %w", seg.path, r.index, err)
+			}
+		}
+	}
+	return nil
+}
+
+// 快照之后的日志记录的大小
+func (fp *FilePersister) RaftStateSize() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	size := int64(0)
+	for _, r := range fp.records {
+		if r.index > fp.meta.LastIncludedIndex {
+			size += r.size
+		}
+	}
+	return int(size)
+}
+
+func (fp *FilePersister) SnapshotSize() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.snapSize
+}
@@ -0,0 +1,251 @@
+package raft
+
+//
+// the Raft log.
+//
+// LogStorage is what Raft needs from its log. raftLog implements it
+// on top of the persister: it keeps the term of every entry (as runs
+// of equal terms, so this is small) and a bounded cache of the most
+// recent entries. older entries are read back from the persister when
+// needed, e.g. to send them to a follower that is far behind.
+//
+// entries that have not been persisted yet are never evicted from
+// the cache, since the persister does not have them.
+//
+
+import "sort"
+
+// 内存中最多缓存的日志条数(不包括还没有持久化的日志)
+const maxCachedEntries = 1024
+
+type LogStorage interface {
+	// 第一条日志的index，即快照的lastIncludedIndex+1
+	FirstIndex() int
+	// 最后一条日志的index，没有日志时为快照的lastIncludedIndex
+	LastIndex() int
+	// index处日志的term，index为快照的lastIncludedIndex时返回快照的term，
+	// 不在日志中时返回-1
+	Term(index int) int
+	// 返回[lo, hi)之间的日志
+	Entries(lo int, hi int) []Log
+	// 在最后追加日志
+	Append(entries []Log)
+	// 删除index及之后的日志
+	TruncateSuffix(index int)
+	// 删除index及之前的日志，index成为快照的lastIncludedIndex
+	CompactPrefix(index int, term int)
+}
+
+// term相同的一段连续日志
+type termRun struct {
+	first int
+	term  int
+}
+
+type raftLog struct {
+	storage       Storage
+	snapshotIndex int
+	snapshotTerm  int
+	lastIndex     int
+	terms         []termRun // 每段term相同的日志的起点，按index排序
+	cache         []Log     // 最近的日志，cache[0]的index为cacheStart
+	cacheStart    int
+	persisted     int   // 已经持久化的最后一条日志
+	configs       []Log // 日志中的成员配置
+}
+
+// 从persister中读出的状态创建日志，entries都已经持久化
+func makeRaftLog(storage Storage, snapshotIndex int, snapshotTerm int, entries []Log) *raftLog {
+	rl := &raftLog{
+		storage:       storage,
+		snapshotIndex: snapshotIndex,
+		snapshotTerm:  snapshotTerm,
+		lastIndex:     snapshotIndex,
+		cacheStart:    snapshotIndex + 1,
+		persisted:     snapshotIndex,
+	}
+	rl.Append(entries)
+	rl.persistedTo(rl.lastIndex)
+	return rl
+}
+
+func (rl *raftLog) FirstIndex() int {
+	return rl.snapshotIndex + 1
+}
+
+func (rl *raftLog) LastIndex() int {
+	return rl.lastIndex
+}
+
+func (rl *raftLog) Term(index int) int {
+	if index == rl.snapshotIndex {
+		return rl.snapshotTerm
+	}
+	if index < rl.FirstIndex() || index > rl.lastIndex {
+		return -1
+	}
+	// 最后一个起点不大于index的段
+	i := sort.Search(len(rl.terms), func(i int) bool { return rl.terms[i].first > index })
+	return rl.terms[i-1].term
+}
+
+func (rl *raftLog) Entries(lo int, hi int) []Log {
+	if lo < rl.FirstIndex() {
+		lo = rl.FirstIndex()
+	}
+	if hi > rl.lastIndex+1 {
+		hi = rl.lastIndex + 1
+	}
+	if lo >= hi {
+		return []Log{}
+	}
+	entries := make([]Log, 0, hi-lo)
+	if lo < rl.cacheStart {
+		// 已经被移出缓存，从persister读取
+		end := hi
+		if end > rl.cacheStart {
+			end = rl.cacheStart
+		}
+		entries = append(entries, rl.storage.Entries(lo, end)...)
+		lo = end
+	}
+	if lo < hi {
+		entries = append(entries, rl.cache[lo-rl.cacheStart:hi-rl.cacheStart]...)
+	}
+	return entries
+}
+
+// 读出一条日志
+func (rl *raftLog) entry(index int) Log {
+	if index >= rl.cacheStart {
+		return rl.cache[index-rl.cacheStart]
+	}
+	return rl.Entries(index, index+1)[0]
+}
+
+func (rl *raftLog) Append(entries []Log) {
+	for _, e := range entries {
+		if len(rl.terms) == 0 || rl.terms[len(rl.terms)-1].term != e.Term {
+			rl.terms = append(rl.terms, termRun{first: e.Index, term: e.Term})
+		}
+		if _, ok := e.Command.(Membership); ok {
+			rl.configs = append(rl.configs, e)
+		}
+		rl.cache = append(rl.cache, e)
+		rl.lastIndex = e.Index
+	}
+}
+
+func (rl *raftLog) TruncateSuffix(index int) {
+	if index > rl.lastIndex {
+		return
+	}
+	if index <= rl.snapshotIndex {
+		index = rl.snapshotIndex + 1
+	}
+	rl.lastIndex = index - 1
+	i := sort.Search(len(rl.terms), func(i int) bool { return rl.terms[i].first >= index })
+	rl.terms = rl.terms[:i]
+	if index <= rl.cacheStart {
+		rl.cache = nil
+		rl.cacheStart = index
+	} else {
+		rl.cache = rl.cache[:index-rl.cacheStart]
+	}
+	for len(rl.configs) > 0 && rl.configs[len(rl.configs)-1].Index >= index {
+		rl.configs = rl.configs[:len(rl.configs)-1]
+	}
+	if rl.persisted > rl.lastIndex {
+		rl.persisted = rl.lastIndex
+	}
+}
+
+func (rl *raftLog) CompactPrefix(index int, term int) {
+	if index <= rl.snapshotIndex {
+		return
+	}
+	rl.snapshotIndex = index
+	rl.snapshotTerm = term
+	if index >= rl.lastIndex {
+		// 快照覆盖了所有日志
+		rl.lastIndex = index
+		rl.terms = nil
+		rl.cache = nil
+		rl.cacheStart = index + 1
+		rl.configs = nil
+		rl.persisted = index
+		return
+	}
+	i := sort.Search(len(rl.terms), func(i int) bool { return rl.terms[i].first > index })
+	terms := []termRun{{first: index + 1, term: rl.terms[i-1].term}}
+	rl.terms = append(terms, rl.terms[i:]...)
+	// 复制剩下的部分，被删除的日志不再被底层数组引用
+	if index >= rl.cacheStart {
+		rl.cache = append([]Log{}, rl.cache[index+1-rl.cacheStart:]...)
+		rl.cacheStart = index + 1
+	}
+	j := 0
+	for j < len(rl.configs) && rl.configs[j].Index <= index {
+		j++
+	}
+	rl.configs = append([]Log{}, rl.configs[j:]...)
+	if rl.persisted < index {
+		rl.persisted = index
+	}
+}
+
+// index及之前的日志已经持久化，缓存太大时移除已经持久化的旧日志
+func (rl *raftLog) persistedTo(index int) {
+	if index > rl.persisted {
+		rl.persisted = index
+	}
+	// 缓存超过上限的两倍时移除一半，均摊之后每条日志只复制常数次
+	if len(rl.cache) < 2*maxCachedEntries {
+		return
+	}
+	n := len(rl.cache) - maxCachedEntries
+	if n > rl.persisted-rl.cacheStart+1 {
+		n = rl.persisted - rl.cacheStart + 1
+	}
+	if n <= 0 {
+		return
+	}
+	rl.cache = append([]Log{}, rl.cache[n:]...)
+	rl.cacheStart += n
+}
+
+// index及之前日志中最新的成员配置
+func (rl *raftLog) lastConfig(index int) (Log, bool) {
+	for i := len(rl.configs) - 1; i >= 0; i-- {
+		if rl.configs[i].Index <= index {
+			return rl.configs[i], true
+		}
+	}
+	return Log{}, false
+}
+
+// term为term的第一条日志，没有时返回-1
+func (rl *raftLog) firstIndexOfTerm(term int) int {
+	for _, r := range rl.terms {
+		if r.term == term {
+			return r.first
+		}
+	}
+	return -1
+}
+
+// term为term的最后一条日志，没有时返回-1
+func (rl *raftLog) lastIndexOfTerm(term int) int {
+	for i := len(rl.terms) - 1; i >= 0; i-- {
+		if rl.terms[i].term == term {
+			if i+1 < len(rl.terms) {
+				return rl.terms[i+1].first - 1
+			}
+			return rl.lastIndex
+		}
+		if rl.terms[i].term < term {
+			break
+		}
+	}
+	return -1
+}
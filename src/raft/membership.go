@@ -0,0 +1,428 @@
+package raft
+
+//
+// cluster membership changes, one server at a time (thesis §4.1).
+//
+// the configuration is replicated as an ordinary log entry whose
+// Command is a Membership. every peer switches to a configuration as
+// soon as the entry is in its log, committed or not, and falls back to
+// the previous one if the entry is truncated away.
+//
+// rf.AddServer(id)
+//   add peers[id] to the group. it first joins as a learner that
+//   receives the log (or a snapshot) but does not vote; once it has
+//   caught up it is promoted to a voter.
+// rf.AddLearner(id)
+//   add peers[id] as a learner and leave it there. a learner gets
+//   every entry and snapshot but does not count toward the commit
+//   quorum and never starts an election, so it does not lower write
+//   availability. AddServer(id) later promotes it to a voter.
+// rf.RemoveServer(id)
+//   remove peers[id] from the group.
+//   all three return nil on success, or the reason they failed.
+// MakeJoining(...)
+//   start a fresh peer that waits to be added by the leader.
+//
+
+import (
+	"cs651/labrpc"
+	"cs651/trace"
+	"errors"
+	"sort"
+	"time"
+)
+
+// how long the leader waits for a new server to catch up
+// before giving up on AddServer.
+const catchUpTimeout = 5 * time.Second
+
+// AddServer, AddLearner和RemoveServer失败的原因
+var (
+	ErrNotLeader      = errors.New("not the leader")
+	ErrChangePending  = errors.New("another membership change is not committed yet")
+	ErrCatchUpTimeout = errors.New("new server did not catch up in time")
+	ErrLastVoter      = errors.New("cannot remove the last voter")
+	ErrUnknownPeer    = errors.New("no such peer")
+)
+
+// 集群成员配置，保存的是peers中的下标
+type Membership struct {
+	Voters    []int // 参与选举和提交计票的节点
+	Learners  []int // 只接收日志、不参与投票的节点
+	Witnesses []int // voter中只保存日志元数据的witness
+}
+
+// 初始配置：peers中的所有节点都是voter
+func bootstrapMembership(n int) Membership {
+	m := Membership{}
+	for i := 0; i < n; i++ {
+		m.Voters = append(m.Voters, i)
+	}
+	return m
+}
+
+func contains(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Membership) isVoter(id int) bool {
+	return contains(m.Voters, id)
+}
+
+func (m Membership) isLearner(id int) bool {
+	return contains(m.Learners, id)
+}
+
+func (m Membership) isWitness(id int) bool {
+	return contains(m.Witnesses, id)
+}
+
+func (m Membership) isMember(id int) bool {
+	return m.isVoter(id) || m.isLearner(id)
+}
+
+// 选举和提交需要的票数
+func (m Membership) quorum() int {
+	return len(m.Voters)/2 + 1
+}
+
+func (m Membership) clone() Membership {
+	c := Membership{}
+	c.Voters = append(c.Voters, m.Voters...)
+	c.Learners = append(c.Learners, m.Learners...)
+	c.Witnesses = append(c.Witnesses, m.Witnesses...)
+	return c
+}
+
+// 返回去掉id之后的配置
+func (m Membership) without(id int) Membership {
+	c := Membership{}
+	for _, v := range m.Voters {
+		if v != id {
+			c.Voters = append(c.Voters, v)
+		}
+	}
+	for _, v := range m.Learners {
+		if v != id {
+			c.Learners = append(c.Learners, v)
+		}
+	}
+	for _, v := range m.Witnesses {
+		if v != id {
+			c.Witnesses = append(c.Witnesses, v)
+		}
+	}
+	return c
+}
+
+// 返回把id作为learner加入之后的配置
+func (m Membership) withLearner(id int) Membership {
+	c := m.without(id)
+	c.Learners = append(c.Learners, id)
+	sort.Ints(c.Learners)
+	return c
+}
+
+// 返回把id作为voter加入之后的配置
+func (m Membership) withVoter(id int) Membership {
+	c := m.without(id)
+	c.Voters = append(c.Voters, id)
+	sort.Ints(c.Voters)
+	return c
+}
+
+// 除自己以外的所有成员，leader向它们复制日志
+func (rf *Raft) otherMembers() []int {
+	ids := []int{}
+	for _, id := range rf.membership.Voters {
+		if id != rf.me {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range rf.membership.Learners {
+		if id != rf.me {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// 除自己以外的所有voter，选举时向它们请求投票
+func (rf *Raft) otherVoters() []int {
+	ids := []int{}
+	for _, id := range rf.membership.Voters {
+		if id != rf.me {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// index及之前日志中最新的成员配置
+// use it with lock
+func (rf *Raft) membershipAt(index int) (Membership, int) {
+	if entry, ok := rf.log.lastConfig(index); ok {
+		return entry.Command.(Membership), entry.Index
+	}
+	return rf.snapshotMembership, rf.lastIncludedIndex
+}
+
+// 日志被追加、截断或者安装快照之后，重新计算当前使用的成员配置
+// use it with lock
+func (rf *Raft) refreshMembership() {
+	lastLogIndex, _ := rf.getLastLogInfo() // ok
+	rf.membership, rf.membershipIndex = rf.membershipAt(lastLogIndex)
+}
+
+// 日志中是否包含成员配置
+func containsMembership(entries []Log) bool {
+	for _, entry := range entries {
+		if _, ok := entry.Command.(Membership); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// leader追加一条成员配置日志，追加之后立即使用新配置
+// use it with lock
+func (rf *Raft) appendMembership(m Membership) int {
+	// 排在已经提议的命令之后
+	rf.drainProposals()
+	lastLogIndex, _ := rf.getLastLogInfo() // ok
+	index := lastLogIndex + 1
+	rf.log.Append([]Log{{
+		Term:    rf.currentTerm,
+		Index:   index,
+		Command: m,
+	}})
+	rf.membership = m
+	rf.membershipIndex = index
+	rf.skipProposals(index)
+	DPrintf("Leader %v appends membership %v at index %v", rf.me, m, index)
+	rf.tracer.Emit(trace.EntriesAppended, rf.currentTerm, index, "membership %v", m)
+	rf.flushLog()
+	return index
+}
+
+// 同一时间只允许一个未提交的成员变更
+// use it with lock
+func (rf *Raft) membershipChangePending() bool {
+	return rf.membershipIndex > rf.commitIndex
+}
+
+// 确保leader已经在当前任期提交过日志，然后才能开始成员变更，
+// 否则旧leader遗留的未提交配置可能和新配置没有交集。
+// 如果还没有提交过，追加一条与当前配置相同的日志并等待它提交
+func (rf *Raft) prepareMembershipChange() (int, error) {
+	rf.mu.Lock()
+	if rf.role != Role_Leader {
+		rf.mu.Unlock()
+		return -1, ErrNotLeader
+	}
+	term := rf.currentTerm
+	if rf.getLogTerm(rf.commitIndex) == term {
+		pending := rf.membershipChangePending()
+		rf.mu.Unlock()
+		if pending {
+			return term, ErrChangePending
+		}
+		return term, nil
+	}
+	// 新leader的commitIndex可能还落后于之前任期的配置日志，这时也要追加：
+	// 重复最新的配置不是新的变更，只有它提交之后之前的配置才算提交
+	index := rf.appendMembership(rf.membership.clone())
+	rf.mu.Unlock()
+	return term, rf.waitCommitted(index, term)
+}
+
+// 检查leader在term中没有变化，并且没有未提交的成员变更
+// use it with lock
+func (rf *Raft) checkMembershipChange(term int) error {
+	if rf.currentTerm != term || rf.role != Role_Leader {
+		return ErrNotLeader
+	}
+	if rf.membershipChangePending() {
+		return ErrChangePending
+	}
+	return nil
+}
+
+// 等待index处的日志在term中提交，leader变化时返回ErrNotLeader
+func (rf *Raft) waitCommitted(index int, term int) error {
+	for !rf.killed() {
+		rf.mu.Lock()
+		if rf.currentTerm != term {
+			rf.mu.Unlock()
+			return ErrNotLeader
+		}
+		if rf.commitIndex >= index {
+			rf.mu.Unlock()
+			return nil
+		}
+		if rf.role != Role_Leader {
+			rf.mu.Unlock()
+			return ErrNotLeader
+		}
+		rf.mu.Unlock()
+		rf.sleep(10 * time.Millisecond)
+	}
+	return ErrNotLeader
+}
+
+// 等待learner追上leader已提交的日志
+func (rf *Raft) waitCaughtUp(id int, term int) error {
+	deadline := rf.now().Add(catchUpTimeout)
+	for !rf.killed() && rf.now().Before(deadline) {
+		rf.mu.Lock()
+		if rf.currentTerm != term || rf.role != Role_Leader {
+			rf.mu.Unlock()
+			return ErrNotLeader
+		}
+		if rf.matchIndex[id] >= rf.commitIndex {
+			rf.mu.Unlock()
+			return nil
+		}
+		rf.mu.Unlock()
+		rf.sleep(10 * time.Millisecond)
+	}
+	if rf.killed() {
+		return ErrNotLeader
+	}
+	return ErrCatchUpTimeout
+}
+
+// AddServer 把peers[id]加入集群，只能由leader调用。
+// id先作为learner追赶日志，追上之后再成为voter。
+// 成功时返回nil。ErrNotLeader和ErrChangePending可以重试(例如换一个leader)，
+// ErrCatchUpTimeout时id仍然是learner，可以之后再调用AddServer
+func (rf *Raft) AddServer(id int) error {
+	if id < 0 || id >= len(rf.peers) {
+		return ErrUnknownPeer
+	}
+	term, err := rf.prepareMembershipChange()
+	if err != nil {
+		return err
+	}
+
+	rf.mu.Lock()
+	if err := rf.checkMembershipChange(term); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	if rf.membership.isVoter(id) {
+		rf.mu.Unlock()
+		return nil
+	}
+	if !rf.membership.isLearner(id) {
+		index := rf.appendLearner(id)
+		rf.mu.Unlock()
+		if err := rf.waitCommitted(index, term); err != nil {
+			return err
+		}
+	} else {
+		rf.mu.Unlock()
+	}
+
+	if err := rf.waitCaughtUp(id, term); err != nil {
+		DPrintf("Leader %v gives up adding %v: %v", rf.me, id, err)
+		return err
+	}
+
+	rf.mu.Lock()
+	if err := rf.checkMembershipChange(term); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	index := rf.appendMembership(rf.membership.withVoter(id))
+	rf.mu.Unlock()
+	return rf.waitCommitted(index, term)
+}
+
+// AddLearner 把peers[id]作为learner加入集群，只能由leader调用。
+// learner接收日志和快照，但不参与提交计票和选举，之后可以用AddServer把它变成voter。
+// id已经是成员时什么也不做
+func (rf *Raft) AddLearner(id int) error {
+	if id < 0 || id >= len(rf.peers) {
+		return ErrUnknownPeer
+	}
+	term, err := rf.prepareMembershipChange()
+	if err != nil {
+		return err
+	}
+
+	rf.mu.Lock()
+	if err := rf.checkMembershipChange(term); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	if rf.membership.isMember(id) {
+		rf.mu.Unlock()
+		return nil
+	}
+	index := rf.appendLearner(id)
+	rf.mu.Unlock()
+	return rf.waitCommitted(index, term)
+}
+
+// 追加把id作为learner加入的配置
+// use it with lock
+func (rf *Raft) appendLearner(id int) int {
+	// 新成员的日志可能为空，从最后开始回退
+	lastLogIndex, _ := rf.getLastLogInfo() // ok
+	rf.nextIndex[id] = lastLogIndex + 1
+	rf.matchIndex[id] = 0
+	rf.progress[id].probing = true
+	return rf.appendMembership(rf.membership.withLearner(id))
+}
+
+// RemoveServer 把peers[id]移出集群，只能由leader调用。
+// 如果移除的是leader自己，新配置提交之后leader退位。
+// 不能移除最后一个voter，这时返回ErrLastVoter
+func (rf *Raft) RemoveServer(id int) error {
+	if id < 0 || id >= len(rf.peers) {
+		return ErrUnknownPeer
+	}
+	term, err := rf.prepareMembershipChange()
+	if err != nil {
+		return err
+	}
+
+	rf.mu.Lock()
+	if err := rf.checkMembershipChange(term); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	if !rf.membership.isMember(id) {
+		rf.mu.Unlock()
+		return nil
+	}
+	m := rf.membership.without(id)
+	if len(m.Voters) == 0 {
+		rf.mu.Unlock()
+		return ErrLastVoter
+	}
+	index := rf.appendMembership(m)
+	rf.mu.Unlock()
+	return rf.waitCommitted(index, term)
+}
+
+// 返回当前使用的成员配置
+func (rf *Raft) GetMembership() Membership {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.membership.clone()
+}
+
+// MakeJoining 创建一个准备加入已有集群的新节点。
+// 它不知道任何成员配置，不会发起选举，
+// 直到leader通过AddServer把它加入并把日志或快照复制给它
+func MakeJoining(peers []*labrpc.ClientEnd, me int,
+	persister Storage, applyCh chan ApplyMsg) *Raft {
+	return makeRaft(peers, me, persister, applyCh, Membership{}, nil)
+}
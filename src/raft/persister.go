@@ -9,14 +9,68 @@ package raft
 // test with the original before submitting.
 //
 
-import "sync"
+import (
+	"bytes"
+	"cs651/labgob"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
 
+// raftstate是一串增量记录：term和投票的变化、追加(以及替换)的日志，
+// 以及快照时写入的完整状态(检查点)。读取时从头回放这些记录。
+// 这样追加日志的代价只与新日志的大小有关，而不是整个日志。
+//
+// 记录由同一个labgob encoder连续写入，只有第一条记录带类型信息。
+// 每条记录加上长度和校验和之后追加到raftstate，见checksum.go。
+// 从SaveRaftState或Copy得到的persister没有encoder，
+// 第一次写入时先写一个检查点。
+//
+// 回放得到的状态只在内存中保留最后的日志，和Raft的日志缓存一样有上限；
+// 更早的日志只在raftstate中，读取它们或者写检查点时重新回放raftstate
 type Persister struct {
-	mu        sync.Mutex
-	raftstate []byte
-	snapshot  []byte
+	mu          sync.Mutex
+	raftstate   []byte
+	snapshot    []byte
+	snapshotSum uint32             // snapshot的校验和
+	state       *persistentState   // 回放raftstate得到的状态，nil表示还没有回放
+	w           *bytes.Buffer      // raftstate所在的缓冲区
+	rec         *bytes.Buffer      // e写入的一条记录
+	e           *labgob.LabEncoder // 向rec写入记录，nil表示需要先写检查点
+	liveSize    int                // 上一个检查点的大小
+}
+
+// raftstate中保存的内容
+type persistentState struct {
+	hs      HardState
+	meta    SnapshotMeta
+	log     []Log // 最后的日志，trimmed时更早的日志只在raftstate中
+	trimmed bool  // log前面还有只在raftstate中的日志
+}
+
+const (
+	recordHardState  = iota // Term、VotedFor
+	recordAppend            // Entries，先删除Entries[0].Index及之后的旧日志
+	recordCheckpoint        // 完整状态
+)
+
+// raftstate中的一条记录
+type stateRecord struct {
+	Kind     int
+	Term     int
+	VotedFor int
+	Entries  []Log
+	Meta     SnapshotMeta
 }
 
+// 回放得到的状态在内存中最多保留的日志条数
+const persisterCachedEntries = maxCachedEntries
+
+// 增量记录超过上一个检查点的大小加上这个值之后，重新写检查点，
+// 使被替换的日志和旧的term记录占用的空间有上限
+const minCompactBytes = 64 * 1024
+
 func MakePersister() *Persister {
 	return &Persister{}
 }
@@ -27,6 +81,7 @@ func (ps *Persister) Copy() *Persister {
 	np := MakePersister()
 	np.raftstate = ps.raftstate
 	np.snapshot = ps.snapshot
+	np.snapshotSum = ps.snapshotSum
 	return np
 }
 
@@ -34,6 +89,8 @@ func (ps *Persister) SaveRaftState(state []byte) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	ps.raftstate = state
+	ps.state = nil
+	ps.e = nil
 }
 
 func (ps *Persister) ReadRaftState() []byte {
@@ -55,16 +112,243 @@ func (ps *Persister) SaveStateAndSnapshot(state []byte, snapshot []byte) {
 	defer ps.mu.Unlock()
 	ps.raftstate = state
 	ps.snapshot = snapshot
+	ps.snapshotSum = checksum(snapshot)
+	ps.state = nil
+	ps.e = nil
 }
 
 func (ps *Persister) ReadSnapshot() []byte {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
+	if checksum(ps.snapshot) != ps.snapshotSum {
+		log.Fatalf("Persister: snapshot: %v", ErrCorrupt)
+	}
 	return ps.snapshot
 }
 
+// 检查raftstate中的每条记录和快照的校验和
+func (ps *Persister) Verify() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if checksum(ps.snapshot) != ps.snapshotSum {
+		return fmt.Errorf("snapshot: %w", ErrCorrupt)
+	}
+	if len(ps.raftstate) == 0 {
+		return nil
+	}
+	st, err := replayRaftState(ps.raftstate)
+	if err != nil {
+		return err
+	}
+	st.trim()
+	ps.state = st
+	return nil
+}
+
 func (ps *Persister) SnapshotSize() int {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	return len(ps.snapshot)
 }
+
+// 检查每条记录的校验和，然后回放raftstate中的记录
+func replayRaftState(data []byte) (*persistentState, error) {
+	stream := new(bytes.Buffer)
+	for offset := 0; offset < len(data); {
+		payload, size, err := readFrame(data[offset:])
+		if err != nil {
+			return nil, fmt.Errorf("raft state at offset %v: %w", offset, err)
+		}
+		stream.Write(payload)
+		offset += size
+	}
+	st := &persistentState{hs: HardState{VotedFor: -1}}
+	d := labgob.NewDecoder(stream)
+	for {
+		rec := stateRecord{}
+		if err := d.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("decode raft state: %v", err)
+		}
+		switch rec.Kind {
+		case recordHardState:
+			st.hs = HardState{Term: rec.Term, VotedFor: rec.VotedFor}
+		case recordAppend:
+			st.appendLog(rec.Entries)
+		case recordCheckpoint:
+			st.hs = HardState{Term: rec.Term, VotedFor: rec.VotedFor}
+			st.meta = rec.Meta
+			st.log = rec.Entries
+		}
+	}
+	return st, nil
+}
+
+// 删除与entries重叠的旧日志，然后追加entries
+func (st *persistentState) appendLog(entries []Log) {
+	keep := len(st.log)
+	for keep > 0 && st.log[keep-1].Index >= entries[0].Index {
+		keep--
+	}
+	st.log = append(st.log[:keep], entries...)
+}
+
+// 日志超过persisterCachedEntries的两倍时只保留最后persisterCachedEntries条，
+// 均摊之后每条日志只复制常数次
+func (st *persistentState) trim() {
+	if len(st.log) < 2*persisterCachedEntries {
+		return
+	}
+	st.log = append([]Log{}, st.log[len(st.log)-persisterCachedEntries:]...)
+	st.trimmed = true
+}
+
+// use it with lock
+func (ps *Persister) load() *persistentState {
+	if ps.state == nil {
+		st, err := replayRaftState(ps.raftstate)
+		if err != nil {
+			log.Fatalf("Unable to read persisted state: %v", err)
+		}
+		st.trim()
+		ps.state = st
+	}
+	return ps.state
+}
+
+// 返回包含全部日志的状态，内存中的日志不完整时回放raftstate。
+// 返回的状态只在没有被截断时是ps.state本身
+// use it with lock
+func (ps *Persister) fullState() *persistentState {
+	st := ps.load()
+	if !st.trimmed {
+		return st
+	}
+	full, err := replayRaftState(ps.raftstate)
+	if err != nil {
+		log.Fatalf("Unable to read persisted state: %v", err)
+	}
+	return full
+}
+
+// 追加一条记录，没有encoder时先写检查点。
+// 调用者在写入之后才修改内存中的状态，再调用compact
+// use it with lock
+func (ps *Persister) writeRecord(rec stateRecord) {
+	if ps.e == nil {
+		ps.checkpoint()
+	}
+	ps.e.Encode(rec)
+	writeFrame(ps.w, ps.rec.Bytes())
+	ps.rec.Reset()
+	ps.raftstate = ps.w.Bytes()
+}
+
+// 过期记录太多时写检查点
+// use it with lock
+func (ps *Persister) compact() {
+	if ps.w.Len() > 2*ps.liveSize+minCompactBytes {
+		ps.checkpoint()
+	}
+}
+
+// 用一个检查点替换raftstate中的所有记录
+// use it with lock
+func (ps *Persister) checkpoint() {
+	ps.writeCheckpoint(ps.fullState())
+}
+
+// 把st写为检查点，替换raftstate中的所有记录，st必须包含全部日志
+// use it with lock
+func (ps *Persister) writeCheckpoint(st *persistentState) {
+	ps.w = new(bytes.Buffer)
+	ps.rec = new(bytes.Buffer)
+	ps.e = labgob.NewEncoder(ps.rec)
+	ps.e.Encode(stateRecord{
+		Kind:     recordCheckpoint,
+		Term:     st.hs.Term,
+		VotedFor: st.hs.VotedFor,
+		Entries:  st.log,
+		Meta:     st.meta,
+	})
+	writeFrame(ps.w, ps.rec.Bytes())
+	ps.rec.Reset()
+	ps.raftstate = ps.w.Bytes()
+	ps.liveSize = ps.w.Len()
+	st.trim()
+	ps.state = st
+}
+
+func (ps *Persister) SaveHardState(term int, votedFor int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.writeRecord(stateRecord{Kind: recordHardState, Term: term, VotedFor: votedFor})
+	ps.load().hs = HardState{Term: term, VotedFor: votedFor}
+	ps.compact()
+}
+
+func (ps *Persister) AppendLog(entries []Log) {
+	if len(entries) == 0 {
+		return
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	// 复制一份，避免与Raft共享底层数组
+	entries = append([]Log{}, entries...)
+	ps.writeRecord(stateRecord{Kind: recordAppend, Entries: entries})
+	st := ps.load()
+	st.appendLog(entries)
+	st.trim()
+	ps.compact()
+}
+
+// 快照删除了日志的前缀，写一个新的检查点
+func (ps *Persister) SaveSnapshot(meta SnapshotMeta, snapshot []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	st := ps.fullState()
+	i := 0
+	for i < len(st.log) && st.log[i].Index <= meta.LastIncludedIndex {
+		i++
+	}
+	st.log = append([]Log{}, st.log[i:]...)
+	st.meta = meta
+	ps.writeCheckpoint(st)
+	ps.snapshot = snapshot
+	ps.snapshotSum = checksum(snapshot)
+}
+
+func (ps *Persister) ReadState() (HardState, SnapshotMeta, []Log, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(ps.raftstate) < 1 {
+		return HardState{VotedFor: -1}, SnapshotMeta{}, nil, false
+	}
+	st := ps.fullState()
+	return st.hs, st.meta, append([]Log{}, st.log...), true
+}
+
+func (ps *Persister) Entries(lo int, hi int) []Log {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	st := ps.load()
+	// 早于内存中日志的部分只在raftstate中
+	if st.trimmed && (len(st.log) == 0 || lo < st.log[0].Index) {
+		st = ps.fullState()
+	}
+	if len(st.log) == 0 {
+		return []Log{}
+	}
+	first := st.log[0].Index
+	if lo < first {
+		lo = first
+	}
+	if hi > first+len(st.log) {
+		hi = first + len(st.log)
+	}
+	if lo >= hi {
+		return []Log{}
+	}
+	return append([]Log{}, st.log[lo-first:hi-first]...)
+}
@@ -0,0 +1,96 @@
+package raft
+
+//
+// the leader's proposal queue.
+//
+// Start() does not take rf.mu, which the replicators and the RPC
+// handlers hold most of the time. it only takes rf.propMu, assigns
+// the command the next index and queues it. the flusher then moves
+// everything queued into the log with a single append, persists it
+// once and wakes the replicators once, so hundreds of concurrent
+// Start() calls cost one append and one persist.
+//
+// the queue accepts proposals only while this peer is the leader of
+// propTerm and is not transferring leadership. whenever that stops
+// being true the queue is drained into the log and closed, with
+// rf.mu held, so an entry is never appended after the peer has
+// stepped down, and indexes handed out by Start() stay in order with
+// entries the leader appends itself (see appendMembership).
+//
+// lock order: rf.mu, then rf.propMu.
+//
+
+import "cs651/trace"
+
+// 成为leader之后调用：开始接受提议，并为这个term的flusher创建唤醒用的channel
+// use it with lock
+func (rf *Raft) openProposals() {
+	rf.propMu.Lock()
+	rf.appendCh = make(chan bool, 1)
+	rf.propMu.Unlock()
+	rf.resumeProposals()
+}
+
+// 重新开始接受提议，领导权转移被放弃之后调用
+// use it with lock
+func (rf *Raft) resumeProposals() {
+	rf.propMu.Lock()
+	defer rf.propMu.Unlock()
+	rf.propTerm = rf.currentTerm
+	rf.propNext = rf.log.LastIndex() + 1
+	rf.proposals = nil
+}
+
+// 不再接受提议，然后把已经排队的提议追加到日志中
+// use it with lock
+func (rf *Raft) closeProposals() {
+	rf.propMu.Lock()
+	rf.propTerm = -1
+	rf.propMu.Unlock()
+	rf.drainProposals()
+}
+
+// 把排队的提议一次性追加到日志中，持久化由调用者负责
+// use it with lock
+func (rf *Raft) drainProposals() {
+	// 只在propMu中取出队列，追加日志时Start()不用等待
+	rf.propMu.Lock()
+	entries := rf.proposals
+	rf.proposals = nil
+	rf.propMu.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+	rf.log.Append(entries)
+	rf.incCounter(MetricProposalBatches)
+	last := entries[len(entries)-1]
+	rf.tracer.Emit(trace.EntriesAppended, last.Term, last.Index, "%v entries", len(entries))
+	DPrintf("Instance %v add %v new logs up to %v %v", rf.me, len(entries), last.Index, last.Term)
+}
+
+// leader不经过队列追加了日志之后，后面的提议从index+1开始
+// use it with lock
+func (rf *Raft) skipProposals(index int) {
+	rf.propMu.Lock()
+	defer rf.propMu.Unlock()
+	rf.propNext = index + 1
+}
+
+// 把command放入提议队列，返回它的index和term；不接受提议时返回false
+func (rf *Raft) propose(command interface{}) (int, int, bool) {
+	rf.propMu.Lock()
+	defer rf.propMu.Unlock()
+	if rf.propTerm < 0 {
+		return -1, -1, false
+	}
+	index := rf.propNext
+	rf.propNext++
+	rf.proposals = append(rf.proposals, Log{
+		Term:    rf.propTerm,
+		Index:   index,
+		Command: command,
+	})
+	// 由flusher批量追加、持久化并发送给其他peer
+	rf.signalAppend()
+	return index, rf.propTerm, true
+}
@@ -10,18 +10,22 @@ package raft
 // rf.Start(command interface{}) (index, term, isleader)
 //   start agreement on a new log entry
 // rf.GetState() (term, isLeader)
-//   ask a Raft for its current term, and whether it thinks it is leader
+//   ask a Raft for its current term, and whether it thinks it is leader.
+//   a leader that is transferring leadership does not report isLeader.
 // ApplyMsg
 //   each time a new entry is committed to the log, each Raft peer
 //   should send an ApplyMsg to the service (or tester)
 //   in the same server.
+// rf.CondInstallSnapshot(term, index, snapshot) bool
+//   called by the service for a snapshot ApplyMsg, see snapshot.go.
 //
 import (
-	"bytes"
 	"cs651/labgob"
 	"cs651/labrpc"
+	"cs651/sim"
+	"cs651/trace"
+	"fmt"
 	"log"
-	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,16 +38,21 @@ const electionTimeout int = 200
 // via the applyCh passed to Make().
 // set CommandValid to true to indicate that the ApplyMsg contains a newly committed log entry.
 //
-// in Lab 3 you'll want to send other kinds of messages (e.g.,
-// snapshots) on the applyCh; at that point you can add fields to
-// ApplyMsg, but set CommandValid to false for these other uses.
+// a snapshot received from the leader is sent with SnapshotValid
+// set instead; the service must call CondInstallSnapshot before
+// switching to it.
 //
-// 将连续的日志生成快照，发送到applyCh
+// 日志和快照都由applier按顺序发送到applyCh
 type ApplyMsg struct {
-	CommandValid      bool
-	Command           interface{}
-	CommandIndex      int
-	LastIncludedIndex int
+	CommandValid bool
+	Command      interface{}
+	CommandIndex int
+	CommandTerm  int
+
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotTerm  int
+	SnapshotIndex int
 }
 
 type Role int32
@@ -64,16 +73,18 @@ type Log struct {
 type Raft struct {
 	mu        sync.Mutex          // Lock to protect shared access to this peer's state
 	peers     []*labrpc.ClientEnd // RPC end points of all peers
-	persister *Persister          // Object to hold this peer's persisted state
+	persister Storage             // Object to hold this peer's persisted state
 	me        int                 // this peer's index into peers[]
 	dead      int32               // set by Kill()
 
 	applyChan chan ApplyMsg
+	applyCond *sync.Cond // commitIndex增加或者收到快照时唤醒applier
 
 	role              Role
 	lastHeartBeatTime time.Time
-	lastElectionTime  time.Time
 	timeout           int
+	electionTimer     sim.Timer // 选举超时，见timer.go
+	electionDeadline  time.Time
 	// Your data here (2A, 2B, 2C).
 	// Look at the paper's Figure 2 for a description of what
 	// state a Raft server must maintain.
@@ -81,7 +92,7 @@ type Raft struct {
 	// Persistent state
 	currentTerm       int
 	votedFor          int
-	log               []Log
+	log               *raftLog // 快照之后的日志，见log.go
 	lastIncludedIndex int
 	lastIncludedTerm  int
 	// Volatile state on all servers
@@ -91,6 +102,51 @@ type Raft struct {
 	// Volatile state on leader
 	nextIndex  []int //对于每个服务器，要发送给该服务器的下一个日志条目的索引（初始化为领导者的最后一个日志索引+1）
 	matchIndex []int //对于每个服务器，已知在服务器上复制的最高日志条目的索引（初始化为0，单调增加）
+
+	// 选举前先进行PreVote(论文 §9.6)，只有大多数节点愿意投票时才增加term
+	preVote bool
+
+	// 集群成员配置，见membership.go
+	membership         Membership // 日志中最新的成员配置(不论是否已提交)
+	membershipIndex    int        // membership所在的日志索引
+	snapshotMembership Membership // lastIncludedIndex处的成员配置，随快照一起保存
+
+	// witness已知在所有完整副本上的日志索引，只压缩这之前的日志，见witness.go
+	witnessSafeIndex int
+
+	// 领导权转移的目标，见transfer.go
+	transferTarget int
+
+	// 日志复制流水线，见replication.go
+	appendCh chan bool       // Start()提议新的日志后唤醒leader追加和持久化，由propMu和mu保护
+	progress []*peerProgress // leader向每个peer复制日志的状态
+
+	// leader的提议队列，见propose.go
+	propMu    sync.Mutex
+	propTerm  int   // 接受提议的term，不接受时为-1
+	propNext  int   // 下一个提议的index
+	proposals []Log // 还没有追加到日志中的提议
+
+	// 分块发送快照，见snapshot.go
+	snapshotChunkSize int               // leader发送的每个分块的最大字节数
+	staging           stagedSnapshot    // follower正在接收的快照
+	received          *receivedSnapshot // 已经接收完整、等待服务安装的快照
+
+	// 日志压缩策略，见compaction.go
+	compactionPolicy CompactionPolicy
+	compactionRetain int              // 压缩之后至少保留的日志条数
+	compactCh        chan bool        // 应用了新的日志时唤醒compactor，没有设置策略时为nil
+	pending          *pendingSnapshot // 等待安装的快照
+	lastCompaction   time.Time
+
+	// 状态和计数器，见status.go
+	leaderId int            // 当前term已知的leader，不知道时为-1
+	counters map[string]int // 计数器的累计值
+	metrics  MetricsSink
+
+	tracer *trace.Tracer // 结构化事件，nil时不记录
+
+	sim *sim.Sim // 模拟模式下的时钟、随机数和调度器，见clock.go
 }
 
 // return currentTerm and whether this server
@@ -102,88 +158,71 @@ func (rf *Raft) GetState() (int, bool) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 	term = rf.currentTerm
-	isleader = rf.role == Role_Leader
+	// 转移领导权期间Start()不接受新的命令，不报告自己是leader
+	isleader = rf.role == Role_Leader && rf.transferTarget == noTransfer
 
 	// Your code here (2A).
 	return term, isleader
 }
 
+// enable or disable the PreVote phase before elections.
+// PreVote is on by default.
+func (rf *Raft) SetPreVote(enabled bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.preVote = enabled
+}
+
 // save Raft's persistent state to stable storage,
 // where it can later be retrieved after a crash and restart.
 // see paper's Figure 2 for a description of what should be persistent.
 func (rf *Raft) persist() {
 	// Your code here (2C).
-	// Example:
-	w := new(bytes.Buffer)
-	e := labgob.NewEncoder(w)
-	e.Encode(rf.currentTerm)
-	e.Encode(rf.votedFor)
-	e.Encode(rf.log)
-	e.Encode(rf.lastIncludedIndex)
-	e.Encode(rf.lastIncludedTerm)
-	data := w.Bytes()
-	rf.persister.SaveRaftState(data)
-	// w := new(bytes.Buffer)
-	// e := labgob.NewEncoder(w)
-	// e.Encode(rf.xxx)
-	// e.Encode(rf.yyy)
-	// data := w.Bytes()
-	// rf.persister.SaveRaftState(data)
+	// 日志和快照单独保存，见persistLog和SaveSnapshot
+	rf.persister.SaveHardState(rf.currentTerm, rf.votedFor)
 }
 
-// restore previously persisted state.
-func (rf *Raft) readPersist(data []byte) {
-	if data == nil || len(data) < 1 { // bootstrap without any state?
-		return
+// 持久化index >= from的日志，storage中from及之后的旧日志被替换
+// use it with lock
+func (rf *Raft) persistLog(from int) {
+	if from <= rf.lastIncludedIndex {
+		from = rf.lastIncludedIndex + 1
 	}
-	r := bytes.NewBuffer(data)
-	d := labgob.NewDecoder(r)
-	var logItems []Log
-	var currentTerm int
-	var votedFor int
-	var lastIncludedIndex int
-	var lastIncludedTerm int
-
-	if d.Decode(&currentTerm) != nil ||
-		d.Decode(&votedFor) != nil ||
-		d.Decode(&logItems) != nil ||
-		d.Decode(&lastIncludedIndex) != nil ||
-		d.Decode(&lastIncludedTerm) != nil {
-		log.Fatalf("Unable to read persisted state")
-	} else {
-		rf.currentTerm = currentTerm
-		rf.votedFor = votedFor
-		rf.log = logItems
-		rf.lastIncludedIndex = lastIncludedIndex
-		rf.lastIncludedTerm = lastIncludedTerm
-		// do not apply the log in the snapshot
-		rf.lastApplied = rf.lastIncludedIndex
+	lastLogIndex := rf.log.LastIndex()
+	if from > lastLogIndex {
+		return
 	}
-	// Your code here (2C).
-	// Example:
-	// r := bytes.NewBuffer(data)
-	// d := labgob.NewDecoder(r)
-	// var xxx
-	// var yyy
-	// if d.Decode(&xxx) != nil ||
-	//    d.Decode(&yyy) != nil {
-	//   error...
-	// } else {
-	//   rf.xxx = xxx
-	//   rf.yyy = yyy
-	// }
+	rf.persister.AppendLog(rf.log.Entries(from, lastLogIndex+1))
+	rf.log.persistedTo(lastLogIndex)
 }
 
-// 将快照信息放入消息队列
-func (rf *Raft) readSnapshot() {
-
-	msg := ApplyMsg{
-		CommandValid:      false,
-		Command:           rf.persister.ReadSnapshot(),
+// 持久化快照，storage删除快照包含的日志
+// use it with lock
+func (rf *Raft) persistSnapshot(snapshot []byte) {
+	rf.persister.SaveSnapshot(SnapshotMeta{
 		LastIncludedIndex: rf.lastIncludedIndex,
-	}
-	rf.applyChan <- msg
+		LastIncludedTerm:  rf.lastIncludedTerm,
+		Membership:        rf.snapshotMembership,
+	}, snapshot)
+}
 
+// restore previously persisted state.
+func (rf *Raft) readPersist() {
+	hs, meta, logItems, ok := rf.persister.ReadState()
+	if !ok { // bootstrap without any state?
+		return
+	}
+	rf.currentTerm = hs.Term
+	rf.votedFor = hs.VotedFor
+	rf.log = makeRaftLog(rf.persister, meta.LastIncludedIndex, meta.LastIncludedTerm, logItems)
+	rf.lastIncludedIndex = meta.LastIncludedIndex
+	rf.lastIncludedTerm = meta.LastIncludedTerm
+	if meta.LastIncludedIndex > 0 {
+		rf.snapshotMembership = meta.Membership
+	}
+	rf.refreshMembership()
+	// do not apply the log in the snapshot
+	rf.lastApplied = rf.lastIncludedIndex
 }
 
 // 返回快照和最后索引
@@ -211,18 +250,45 @@ type RequestVoteReply struct {
 	// Your data here (2A).
 	Term        int  //当前任期号，候选人会更新自己的任期号
 	VoteGranted bool //true 表示候选人获得了选票
+	// witness因为候选人的日志不够新而拒绝时，附带候选人缺少的日志，见witness.go
+	CatchUpPrevIndex int
+	CatchUpPrevTerm  int
+	CatchUpEntries   []Log
+}
+
+// PreVote RPC 参数，Term为候选人如果发起选举将使用的term(currentTerm+1)
+// 预投票不会改变接收者的currentTerm和votedFor
+type PreVoteArgs struct {
+	Term         int //候选人下一个任期号
+	CandidateId  int //请求预投票的候选人的 Id
+	LastLogIndex int //候选人的最后日志条目的索引值
+	LastLogTerm  int //候选人最后日志条目的任期号
+}
+
+type PreVoteReply struct {
+	Term        int  //当前任期号
+	VoteGranted bool //true 表示接收者愿意在下一个任期投票给候选人
+	// 同RequestVoteReply
+	CatchUpPrevIndex int
+	CatchUpPrevTerm  int
+	CatchUpEntries   []Log
 }
 
 type InstallSnapshotArgs struct {
-	Term              int    //领导人的任期号
-	LeaderId          int    //领导人的 Id,以便于跟随者重定向请求
-	LastIncludedIndex int    //快照会替换所有的条目，直到并包括这个索引
-	LastIncludedTerm  int    //快照中包含的最后日志条目的任期号
-	Data              []byte //快照分块的原始字节，从偏移量开始
+	Term              int        //领导人的任期号
+	LeaderId          int        //领导人的 Id,以便于跟随者重定向请求
+	LastIncludedIndex int        //快照会替换所有的条目，直到并包括这个索引
+	LastIncludedTerm  int        //快照中包含的最后日志条目的任期号
+	Offset            int        //分块在快照中的字节偏移量
+	Data              []byte     //快照分块的原始字节，从偏移量开始
+	Done              bool       //如果这是最后一个分块则为true
+	Membership        Membership //快照中包含的最后的成员配置
+	Checksum          uint32     //整个快照的校验和
 }
 
 type InstallSnapshotReply struct {
-	Term int
+	Term       int
+	NextOffset int //follower期望的下一个分块的偏移量，-1表示不再需要这个快照
 }
 
 // 由领导者调用，向跟随者发送快照的分块。领导者总是按顺序发送分块。
@@ -237,35 +303,47 @@ func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapsho
 	reply.Term = rf.currentTerm
 
 	if args.Term == rf.currentTerm {
-		rf.lastHeartBeatTime = time.Now()
+		rf.lastHeartBeatTime = rf.now()
+		rf.resetElectionTimer()
+		rf.leaderId = args.LeaderId
 		// Candidate收到leader发送的快照，变成Follower
 		if rf.role == Role_Candidate {
 			rf.BecomeFollower(args.Term)
 		}
-		// 如果leader的快照更新
-		if args.LastIncludedIndex > rf.lastIncludedIndex {
-			DPrintf("Follower %v get installSnapshot RPC at lastIncludedIndex %v lastApplied %v", rf.me, args.LastIncludedIndex, rf.lastApplied)
-			rf.lastIncludedIndex = args.LastIncludedIndex
-			rf.lastIncludedTerm = args.LastIncludedTerm
-			// important
-			// 应用于状态机的lastApplied更新为lastIncludedIndex
-			rf.lastApplied = rf.lastIncludedIndex
-			// lastIncludedIndex及之前的日志删除
-			rf.logTruncate(args.LastIncludedIndex)
-			w := new(bytes.Buffer)
-			e := labgob.NewEncoder(w)
-			e.Encode(rf.currentTerm)
-			e.Encode(rf.votedFor)
-			e.Encode(rf.log)
-			e.Encode(rf.lastIncludedIndex)
-			e.Encode(rf.lastIncludedTerm)
-			state := w.Bytes()
-			// 存储当前状态和日志
-			rf.persister.SaveStateAndSnapshot(state, args.Data)
-			// 将快照信息放入消息队列
-			rf.readSnapshot()
+		// 已经提交的日志会由applier发送，旧的或者重复的快照直接忽略，
+		// 并告诉leader不再需要这个快照
+		if args.LastIncludedIndex <= rf.lastIncludedIndex || args.LastIncludedIndex <= rf.commitIndex {
+			reply.NextOffset = -1
+			return
+		}
+		// witness只需要快照的位置和成员配置，不需要数据
+		if rf.membership.isWitness(rf.me) {
+			rf.installWitnessSnapshot(args)
+			reply.NextOffset = -1
+			return
 		}
-
+		reply.NextOffset = rf.stageSnapshotChunk(args)
+		// 收到最后一个分块并且快照完整之后才交给服务
+		if !args.Done || reply.NextOffset != args.Offset+len(args.Data) {
+			return
+		}
+		// 传输中损坏的快照不交给服务，让leader从头重新发送
+		if checksum(rf.staging.data) != args.Checksum {
+			DPrintf("Follower %v drops corrupted snapshot at lastIncludedIndex %v", rf.me, args.LastIncludedIndex)
+			rf.tracer.Emit(trace.Snapshot, rf.currentTerm, args.LastIncludedIndex, "checksum mismatch, size %v", len(rf.staging.data))
+			rf.staging = stagedSnapshot{}
+			reply.NextOffset = 0
+			return
+		}
+		DPrintf("Follower %v received snapshot at lastIncludedIndex %v lastApplied %v", rf.me, args.LastIncludedIndex, rf.lastApplied)
+		rf.received = &receivedSnapshot{
+			index:      args.LastIncludedIndex,
+			term:       args.LastIncludedTerm,
+			membership: args.Membership,
+			data:       rf.staging.data,
+		}
+		rf.staging = stagedSnapshot{}
+		rf.applyCond.Signal()
 	}
 
 }
@@ -277,146 +355,255 @@ func (rf *Raft) setNewTerm(term int) {
 	return
 }
 
-func (rf *Raft) getHeartBeatTime() time.Time {
+// 根据传入的lastApplied，保存状态和快照
+// 将最新快照更新为lastApplied位置
+func (rf *Raft) GenerateSnapshot(snapshot []byte, lastApplied int) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
-	return rf.lastHeartBeatTime
+	rf.compactLog(snapshot, lastApplied)
 }
 
-func (rf *Raft) getElectionTime() time.Time {
-	rf.mu.Lock()
-	defer rf.mu.Unlock()
-	return rf.lastElectionTime
+// use it with lock
+func (rf *Raft) compactLog(snapshot []byte, lastApplied int) {
+	// 如果lastApplied > lastIncludedIndex
+	// 更新lastIncludedIndex和lastIncludedTerm为lastApplied对应项
+	if lastApplied <= rf.lastIncludedIndex {
+		return
+	}
+	DPrintf("Server %v generate snapshot at index lastApplied %v", rf.me, lastApplied)
+	rf.snapshotMembership, _ = rf.membershipAt(lastApplied)
+	rf.lastIncludedIndex = lastApplied
+	rf.lastIncludedTerm = rf.log.Term(lastApplied)
+	//删除lastApplied及之前的日志
+	rf.log.CompactPrefix(lastApplied, rf.lastIncludedTerm)
+	// 保存快照
+	rf.persistSnapshot(snapshot)
+	rf.lastCompaction = rf.now()
+	rf.tracer.Emit(trace.Snapshot, rf.currentTerm, lastApplied, "generated size %v", len(snapshot))
 }
 
-// 获取i在log中离起始点index的距离
-func (rf *Raft) getRealLogIndex(i int) int {
-	if len(rf.log) > 0 {
-		startIndex := rf.log[0].Index
-		lastIndex, _ := rf.getLastLogInfo() // ok
-		//	fmt.Printf("Start index: %v\n", startIndex)
-		if startIndex <= i && i <= lastIndex {
-			return i - startIndex
-		}
-	}
-	return -1
+// 返回state的长度
+func (rf *Raft) GetRaftStateSize() int {
+	return rf.persister.RaftStateSize()
 }
 
-// discard log before index (including index)
-func (rf *Raft) logTruncate(index int) {
-	if len(rf.log) == 0 {
-		return
-	} else if len(rf.log) > 0 {
-		lastLogIndex, _ := rf.getLastLogInfo()
-		if index > lastLogIndex {
-			rf.log = []Log{}
-		} else {
-			realIndex := rf.getRealLogIndex(index)
-			rf.log = rf.log[realIndex+1:]
-			DPrintf("Server %v truncate the log at index %v, realIndex: %v lastIndex: %v log len: %v", rf.me, index, realIndex, lastLogIndex, len(rf.log))
+// 返回index处日志的term，index不在日志和快照中时返回-1
+func (rf *Raft) getLogTerm(index int) int {
+	return rf.log.Term(index)
+}
+
+// ReadIndex 用于线性一致读，读请求不需要写入日志(论文 §6.4)
+// leader记录当前的commitIndex作为readIndex，通过一轮心跳确认自己仍被大多数节点认可，
+// 然后等待lastApplied追上readIndex。
+// 返回readIndex，以及是否成功；失败时调用者应当走日志或者重试
+func (rf *Raft) ReadIndex() (int, bool) {
+	rf.mu.Lock()
+	if rf.role != Role_Leader {
+		rf.mu.Unlock()
+		return -1, false
+	}
+	// 新leader在当前任期提交日志之前，并不知道最新的commitIndex
+	if rf.getLogTerm(rf.commitIndex) != rf.currentTerm {
+		rf.mu.Unlock()
+		return -1, false
+	}
+	readIndex := rf.commitIndex
+	term := rf.currentTerm
+	rf.mu.Unlock()
 
+	if !rf.confirmLeadership(term) {
+		DPrintf("Leader %v failed to confirm leadership for read index %v", rf.me, readIndex)
+		return -1, false
+	}
+
+	for !rf.killed() {
+		rf.mu.Lock()
+		if rf.currentTerm != term || rf.role != Role_Leader {
+			rf.mu.Unlock()
+			return -1, false
 		}
+		if rf.lastApplied >= readIndex {
+			rf.mu.Unlock()
+			return readIndex, true
+		}
+		rf.mu.Unlock()
+		rf.sleep(5 * time.Millisecond)
 	}
+	return -1, false
 }
 
-// 根据传入的lastApplied，保存状态和快照
-// 将最新快照更新为lastApplied位置
-func (rf *Raft) GenerateSnapshot(snapshot []byte, lastApplied int) {
+// 向所有peer发送一轮心跳，确认自己在term中仍然是大多数节点认可的leader
+// 不论日志是否匹配，只要回复的term等于term，就说明该节点认可这个leader
+func (rf *Raft) confirmLeadership(term int) bool {
 	rf.mu.Lock()
-	// 如果lastApplied > lastIncludedIndex
-	// 更新lastIncludedIndex和lastIncludedTerm为lastApplied对应项
-	if lastApplied > rf.lastIncludedIndex {
-		DPrintf("Server %v generate snapshot at index lastApplied %v", rf.me, lastApplied)
-		rf.lastIncludedIndex = lastApplied
-		rf.lastIncludedTerm = rf.log[rf.getRealLogIndex(lastApplied)].Term
-		//删除lastApplied及之前的日志
-		rf.logTruncate(lastApplied)
-		w := new(bytes.Buffer)
-		e := labgob.NewEncoder(w)
-		e.Encode(rf.currentTerm)
-		e.Encode(rf.votedFor)
-		e.Encode(rf.log)
-		e.Encode(rf.lastIncludedIndex)
-		e.Encode(rf.lastIncludedTerm)
-		state := w.Bytes()
+	if rf.currentTerm != term || rf.role != Role_Leader {
 		rf.mu.Unlock()
-		// 保存状态和快照
-		rf.persister.SaveStateAndSnapshot(state, snapshot)
-		return
+		return false
+	}
+	lastLogIndex, _ := rf.getLastLogInfo() // ok
+	args := make([]AppendEntriesArgs, len(rf.peers))
+	for i := 0; i < len(rf.peers); i++ {
+		prevLogIndex := rf.nextIndex[i] - 1
+		if prevLogIndex > lastLogIndex {
+			prevLogIndex = lastLogIndex
+		}
+		prevLogTerm := 0
+		if prevLogIndex > rf.lastIncludedIndex {
+			prevLogTerm = rf.getLogTerm(prevLogIndex)
+		} else if prevLogIndex == rf.lastIncludedIndex {
+			prevLogTerm = rf.lastIncludedTerm
+		}
+		args[i] = AppendEntriesArgs{
+			Term:         term,
+			LeaderId:     rf.me,
+			PrevLogIndex: prevLogIndex,
+			PrevLogTerm:  prevLogTerm,
+			LeaderCommit: rf.commitIndex,
+			IsHeartBeat:  true,
+		}
+	}
+
+	voters := rf.otherVoters()
+	quorum := rf.membership.quorum()
+	count := 0
+	if rf.membership.isVoter(rf.me) {
+		count = 1
 	}
 	rf.mu.Unlock()
-}
+	if count >= quorum {
+		return true
+	}
 
-// 返回state的长度
-func (rf *Raft) GetRaftStateSize() int {
-	return rf.persister.RaftStateSize()
+	acks := make(chan bool, len(voters))
+	for _, i := range voters {
+		id := i
+		rf.spawn(func() {
+			reply := AppendEntriesReply{}
+			ok := rf.sendAppendEntries(id, &args[id], &reply)
+			if ok && reply.Term > term {
+				rf.mu.Lock()
+				if reply.Term > rf.currentTerm {
+					rf.BecomeFollower(reply.Term)
+				}
+				rf.mu.Unlock()
+			}
+			acks <- ok && reply.Term == term
+		})
+	}
+
+	deadline := rf.now().Add(time.Duration(electionTimeout) * time.Millisecond)
+	for i := 0; i < len(voters); i++ {
+		wait := deadline.Sub(rf.now())
+		if wait <= 0 {
+			return false
+		}
+		ok, received := rf.recv(acks, wait)
+		if !received {
+			return false
+		}
+		if ok {
+			count += 1
+		}
+		if count >= quorum {
+			return true
+		}
+	}
+	return false
 }
 
 // 将已提交的日志应用于状态机
-func (rf *Raft) applyLog() {
+// applier把已提交的日志和收到的快照按顺序发送到applyCh。
+// 没有可以发送的内容时在applyCond上等待，发送时不持有锁
+func (rf *Raft) applier() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
 	for !rf.killed() {
-		rf.mu.Lock()
-		//有些日志已经提交但是还未应用于状态机
-		//增大lastApplied,把lastApplied位置的log应用于状态机
-		if rf.commitIndex > rf.lastApplied {
-			DPrintf("Applying log Instance %v: len %v commit index %v lastApplied %v", rf.me, rf.lastIncludedIndex+len(rf.log), rf.commitIndex, rf.lastApplied)
-			rf.lastApplied += 1
-			realIndex := rf.getRealLogIndex(rf.lastApplied)
+		if rf.received != nil && !rf.received.delivered {
+			rf.received.delivered = true
 			msg := ApplyMsg{
-				CommandValid: true,
-				CommandIndex: rf.log[realIndex].Index,
-				Command:      rf.log[realIndex].Command,
+				SnapshotValid: true,
+				Snapshot:      rf.received.data,
+				SnapshotTerm:  rf.received.term,
+				SnapshotIndex: rf.received.index,
 			}
 			rf.mu.Unlock()
-			rf.applyChan <- msg
-		} else {
+			rf.deliver(msg)
+			rf.mu.Lock()
+			continue
+		}
+		// witness没有状态机，已提交的日志直接跳过
+		if rf.commitIndex > rf.lastApplied && rf.membership.isWitness(rf.me) {
+			rf.skipWitnessEntries()
+			continue
+		}
+		//有些日志已经提交但是还未应用于状态机，一次取出一批发送
+		if rf.commitIndex > rf.lastApplied {
+			hi := rf.commitIndex + 1
+			if hi > rf.lastApplied+1+maxApplyBatch {
+				hi = rf.lastApplied + 1 + maxApplyBatch
+			}
+			entries := rf.log.Entries(rf.lastApplied+1, hi)
+			DPrintf("Instance %v applies [%v, %v) commit index %v", rf.me, rf.lastApplied+1, hi, rf.commitIndex)
+			rf.tracer.Emit(trace.Apply, rf.currentTerm, hi-1, "batch of %v", len(entries))
 			rf.mu.Unlock()
+			for _, entry := range entries {
+				rf.deliver(ApplyMsg{
+					CommandValid: true,
+					Command:      entry.Command,
+					CommandIndex: entry.Index,
+					CommandTerm:  entry.Term,
+				})
+			}
+			rf.mu.Lock()
+			// 发送期间服务可能安装了更新的快照
+			if rf.lastApplied < hi-1 {
+				rf.lastApplied = hi - 1
+			}
+			rf.wakeCompactor()
+			continue
 		}
+		rf.waitApply()
 	}
 }
 
-func (rf *Raft) mainLoop() {
-	for !rf.killed() {
-
-		timeout := getRandTimeout()
-		time.Sleep(time.Millisecond * time.Duration(rf.timeout))
-
-		rf.mu.Lock()
-		role := rf.role
-		rf.mu.Unlock()
-
-		switch role {
-		// leader does not have something needed to be check routinely
-		// when the instance wins the election, the StartElection will open the heatbeat thread
-		// using for loop to create many heatbeat threads is strange
-		case Role_Candidate:
-			{
-				//DPrintf("Instance %v is the candidate now", rf.me)
-				sub := time.Now().Sub(rf.getElectionTime())
-				//选举超时，成为候选人开始选举
-				if sub > time.Duration(timeout)*time.Millisecond {
-					rf.mu.Lock()
-					rf.BecomeCandidate()
-					rf.mu.Unlock()
-					go rf.StartElection()
-					DPrintf("Instance %v starts new election (candidate->candidate)", rf.me)
-				}
-			}
-		case Role_Follower:
-			{
-				//	DPrintf("Instance %v is the follower now", rf.me)
-				sub := time.Now().Sub(rf.getHeartBeatTime())
-				//选举超时，成为候选人开始选举
-				if sub > time.Duration(timeout)*time.Millisecond {
-					DPrintf("Instance %v starts election (follower->candidate)", rf.me)
-					rf.mu.Lock()
-					rf.BecomeCandidate()
-					rf.mu.Unlock()
-					go rf.StartElection()
-				}
-			}
+// CheckQuorum：leader在一个选举超时内没有收到大多数voter的回复时退位。
+// 被分区到少数派的leader不再接受无法提交的命令，客户端可以尽快找到新的leader
+// use it with lock
+func (rf *Raft) checkQuorum() {
+	if rf.role != Role_Leader {
+		return
+	}
+	// 使用最长的选举超时，此时多数派那边已经可以选出新的leader
+	timeout := time.Duration(2*electionTimeout) * time.Millisecond
+	acks := 0
+	for _, id := range rf.membership.Voters {
+		if id == rf.me || rf.since(rf.progress[id].lastAck) < timeout {
+			acks++
 		}
 	}
+	if acks >= rf.membership.quorum() {
+		return
+	}
+	DPrintf("Leader %v lost contact with a quorum (%v/%v), stepping down", rf.me, acks, len(rf.membership.Voters))
+	rf.incCounter(MetricQuorumLost)
+	rf.BecomeFollower(rf.currentTerm)
+	rf.leaderId = -1
+}
+
+// 选举超时：开启PreVote时先发起预投票，预投票通过后才成为候选人；
+// 否则直接成为候选人开始选举
+// use it with lock
+func (rf *Raft) electionTimeoutElapsed() {
+	//learner、witness或者还未加入集群的节点不参与选举
+	if !rf.membership.isVoter(rf.me) || rf.membership.isWitness(rf.me) {
+		return
+	}
+	if rf.preVote {
+		rf.spawn(rf.StartPreVote)
+		return
+	}
+	rf.BecomeCandidate()
+	rf.spawn(rf.StartElection)
 }
 
 type AppendEntriesArgs struct {
@@ -427,6 +614,8 @@ type AppendEntriesArgs struct {
 	Entries      []Log
 	LeaderCommit int
 	IsHeartBeat  bool
+	// 已经复制到所有完整副本的日志索引，witness只压缩这之前的日志
+	ReplicatedIndex int
 }
 
 type AppendEntriesReply struct {
@@ -439,178 +628,46 @@ type AppendEntriesReply struct {
 }
 
 // leader发送心跳给各个peer
-func (rf *Raft) StartAppendEntries(is bool) {
-	for !rf.killed() {
-		rf.mu.Lock()
-		// nextIndex >= 1
-		// 如果不是leader直接返回
-		if rf.role != Role_Leader {
-			rf.mu.Unlock()
-			return
-		}
-		rf.mu.Unlock()
-		//开始发送心跳
-		DPrintf("Instance %v is the leader and sending entries\n", rf.me)
-		for i := 0; i < len(rf.peers); i++ {
-			if i != rf.me {
-				go func(id int) {
-					for !rf.killed() {
-						rf.mu.Lock()
-						// nextIndex >= 1
-						if rf.role != Role_Leader {
-							rf.mu.Unlock()
-							return
-						}
-						//获取最后一个日志的索引
-						lastLogIndex, _ := rf.getLastLogInfo()
-						if rf.nextIndex[id] >= rf.lastIncludedIndex+1 {
-							DPrintf("Server %v send log interval [%v, %v]", rf.me, rf.nextIndex[id], lastLogIndex)
-							DPrintf("Server %v Last included index: %v ", rf.me, rf.lastIncludedIndex)
-							prevLogIndex := rf.nextIndex[id] - 1
-							prevLogTerm := 0
-							//更新prevLogTerm
-							//如果已发送日志的前一条 > leader的lastIncludedIndex
-							//更新为前一条日志的Term
-							if prevLogIndex > rf.lastIncludedIndex { // && prevLogIndex <= lastLogIndex {
-								prevLogTerm = rf.log[rf.getRealLogIndex(prevLogIndex)].Term
-								//相等的话,更新为lastIncludedTerm
-							} else if prevLogIndex == rf.lastIncludedIndex {
-								prevLogTerm = rf.lastIncludedTerm
-							}
-
-							entries := []Log{}
-							//将未发送的日志加入entries
-							//R4: 添加日志中任何尚未出现的新条目
-							for j := rf.nextIndex[id]; j <= lastLogIndex; j++ {
-								entries = append(entries, rf.log[rf.getRealLogIndex(j)])
-							}
-
-							rf.mu.Unlock()
-							args := AppendEntriesArgs{
-								Term:         rf.currentTerm,
-								LeaderId:     rf.me,
-								PrevLogTerm:  prevLogTerm,
-								PrevLogIndex: prevLogIndex,
-								Entries:      entries,
-								LeaderCommit: rf.commitIndex,
-								IsHeartBeat:  is,
-							}
-
-							reply := AppendEntriesReply{}
-							//peer调用AppendEntries
-							ok := rf.sendAppendEntries(id, &args, &reply)
-							//添加日志条目或者心跳发送成功
-							if ok {
-								rf.mu.Lock()
-								//reply的term大于当前term,成为Follower
-								if reply.Term > rf.currentTerm {
-									rf.BecomeFollower(reply.Term)
-									rf.mu.Unlock()
-									return
-								}
-								// only update commitindex when success
-								// otherwise the commitIndex may fall back
-								// currentTerm没变并且还是Leader的话
-								if args.Term == rf.currentTerm && rf.role == Role_Leader {
-									//如果成功：为跟随者更新nextIndex和matchIndex
-									//以及自身的matchIndex
-									if reply.Success {
-										rf.matchIndex[id] = prevLogIndex + len(entries)
-										rf.nextIndex[id] = rf.matchIndex[id] + 1
-
-										rf.matchIndex[rf.me] = rf.lastIncludedIndex + len(rf.log)
-										nextCommitIdx := rf.commitIndex
-										for i := 0; i < len(rf.peers); i++ {
-											DPrintf("Leader %v Matchindex[%v]=%v", rf.me, i, rf.matchIndex[i])
-										}
-										//遍历未提交的日志
-										for i := rf.commitIndex + 1; i <= rf.matchIndex[rf.me]; i++ {
-											vote := 0
-											//遍历peer,如果有matchIndex(已提交Index)比i大，计票数+1
-											for j := 0; j < len(rf.peers); j++ {
-												if rf.matchIndex[j] >= i {
-													vote += 1
-												}
-											}
-											//如果存在一个N，使得N>commitIndex，大多数的matchIndex[i]≥N
-											//并且log[N].term == currentTerm：设置commitIndex = N
-											if vote >= len(rf.peers)/2+1 {
-												realIndex := rf.getRealLogIndex(i)
-												//realIndex存在并且对应term等于currentTerm
-												//或者realIndex和lastIncludedIndex相等并且currentTerm等于lastIncludedTerm
-												//更新nextCommitIdx为i
-												if realIndex != -1 && rf.log[realIndex].Term == rf.currentTerm || realIndex == rf.lastIncludedIndex && rf.currentTerm == rf.lastIncludedTerm {
-													nextCommitIdx = i
-												}
-											}
-										}
-
-										DPrintf("Leader %v commitIndex: %v", rf.me, nextCommitIdx)
-
-										rf.commitIndex = nextCommitIdx
-										rf.mu.Unlock()
-										break
-									} else {
-										DPrintf("Before fall back : nextIndex[%v]= %v", id, rf.nextIndex[id])
-										//如果reply的nextIndex不为空，更新为nextIndex
-										if reply.NextIndex != -1 {
-											rf.nextIndex[id] = reply.NextIndex
-											//否则若XLen不为空，更新为XLen+1
-										} else if reply.XLen != -1 {
-											rf.nextIndex[id] = reply.XLen + 1
-											//否则更新为XIndex
-										} else {
-											rf.nextIndex[id] = reply.XIndex
-											//从最后开始遍历, 找到第一个Term小于等于reply.Xterm的index
-											for i := len(rf.log) - 1; i >= 0; i-- {
-												//当XTerm > 当前日志条目的Term时， 退出
-												if rf.log[i].Term < reply.XTerm {
-													break
-												}
-												//相等时，更新为对应的index
-												if rf.log[i].Term == reply.XTerm {
-													rf.nextIndex[id] = rf.log[i].Index
-													break
-												}
-											}
-										}
-										DPrintf("After fall back : nextIndex[%v]= %v", id, rf.nextIndex[id])
-									}
-								}
-								rf.mu.Unlock()
-							}
-							//rf.nextIndex[id] < rf.lastIncludedIndex+1
-						} else { // send install snapshot RPC
-							args := InstallSnapshotArgs{
-								Term:              rf.currentTerm,
-								LeaderId:          rf.me,
-								Data:              rf.persister.ReadSnapshot(),
-								LastIncludedIndex: rf.lastIncludedIndex,
-								LastIncludedTerm:  rf.lastIncludedTerm}
-							reply := InstallSnapshotReply{}
-							rf.mu.Unlock()
-							ok := rf.sendInstallSnapshot(id, &args, &reply)
-							rf.mu.Lock()
-							if ok {
-								if reply.Term > rf.currentTerm {
-									rf.BecomeFollower(reply.Term)
-									rf.mu.Unlock()
-									return
-								}
-								if args.Term == rf.currentTerm && rf.role == Role_Leader {
-									rf.nextIndex[id] = args.LastIncludedIndex + 1
-									rf.matchIndex[id] = args.LastIncludedIndex
-								}
-							}
-							rf.mu.Unlock()
-						}
-					}
-				}(i)
+// leader根据voter的matchIndex推进commitIndex
+// use it with lock
+// leader自己的matchIndex是已经持久化的日志，见flushLog
+func (rf *Raft) advanceCommitIndex() {
+	lastLogIndex, _ := rf.getLastLogInfo() // ok
+	nextCommitIdx := rf.commitIndex
+	//遍历未提交的日志
+	for i := rf.commitIndex + 1; i <= lastLogIndex; i++ {
+		vote := 0
+		//遍历voter,如果有matchIndex(已提交Index)比i大，计票数+1
+		for _, j := range rf.membership.Voters {
+			if rf.matchIndex[j] >= i {
+				vote += 1
 			}
 		}
-		time.Sleep(100 * time.Millisecond)
+		//如果存在一个N，使得N>commitIndex，大多数的matchIndex[i]≥N
+		//并且log[N].term == currentTerm：设置commitIndex = N
+		if vote >= rf.membership.quorum() && rf.getLogTerm(i) == rf.currentTerm {
+			nextCommitIdx = i
+		}
 	}
 
+	DPrintf("Leader %v commitIndex: %v", rf.me, nextCommitIdx)
+	if nextCommitIdx > rf.commitIndex {
+		rf.tracer.Emit(trace.CommitAdvanced, rf.currentTerm, nextCommitIdx, "")
+		rf.applyCond.Signal()
+	}
+	rf.commitIndex = nextCommitIdx
+
+	// 新配置已经提交，而leader自己不在其中，退位
+	if !rf.membership.isVoter(rf.me) && rf.membershipIndex <= rf.commitIndex {
+		DPrintf("Leader %v is removed from the cluster, stepping down", rf.me)
+		// 退位之前持久化还没保存的日志，它们可能已经发给了其他节点
+		rf.closeProposals()
+		rf.persistLog(rf.matchIndex[rf.me] + 1)
+		rf.role = Role_Follower
+		rf.leaderId = -1
+		rf.lastHeartBeatTime = rf.now()
+		rf.resetElectionTimer()
+	}
 }
 
 // peer处理leader的日志条目或心跳信息,args中是leader的相关信息
@@ -618,6 +675,11 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 	rf.mu.Lock()
 
 	defer rf.mu.Unlock()
+	defer func() {
+		if !reply.Success {
+			rf.incCounter(MetricAppendRejections)
+		}
+	}()
 	// WRONG IMPLEMENTATION
 	// if rf.role == rf.currentTerm then covert to follower
 	// 如果args的term比当前term大，更新term
@@ -633,7 +695,9 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 	if args.Term == rf.currentTerm {
 		// only heartbeat with latest term is valid
 		// 收到心跳，重置时间
-		rf.lastHeartBeatTime = time.Now()
+		rf.lastHeartBeatTime = rf.now()
+		rf.resetElectionTimer()
+		rf.leaderId = args.LeaderId
 		// CORRECT IMPLEMENTATION (found by Test)
 		// When the leader's term is greater or equals to candidate's term
 		// candidate can go to follower
@@ -647,20 +711,13 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 		// leader日志最后的Index更小
 		// 如果一个跟随者的最后一个日志索引 ≥ nextIndex：发送AppendEntries RPC包含从nextIndex开始的日志条目???
 		if args.PrevLogIndex <= lastLogIndex {
-			//获取leader最后的logIndex在该server对应的index
-			realPrevLogIndex := rf.getRealLogIndex(args.PrevLogIndex)
-
 			logTerm := 0
 			//给logTerm赋值
-			//realPrevLogIndex不为空
-			//直接赋值为realPrevLogIndex对应的term
-			if realPrevLogIndex != -1 {
-				logTerm = rf.log[realPrevLogIndex].Term
-				//如果和lastIncludedIndex相等，赋值为lastIncludedTerm
-			} else if args.PrevLogIndex == rf.lastIncludedIndex {
-				logTerm = rf.lastIncludedTerm
+			//prevLogIndex在日志中或者等于lastIncludedIndex，直接取对应的term
+			if args.PrevLogIndex >= rf.lastIncludedIndex {
+				logTerm = rf.log.Term(args.PrevLogIndex)
 				//如果比lastIncludedIndex小
-			} else if args.PrevLogIndex < rf.lastIncludedIndex {
+			} else {
 				reply.Success = false
 				reply.NextIndex = rf.lastIncludedIndex + 1
 				return
@@ -668,57 +725,85 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 			//如果logTerm和leader的最后日志term相等，回复成功
 			if logTerm == args.PrevLogTerm {
 				reply.Success = true
-				//从头遍历日志，对leader每条待添加日志的index求出realIndex
-				for idx := 0; idx < len(args.Entries); idx++ {
-					realIndex := rf.getRealLogIndex(args.Entries[idx].Index)
-					// has conflict
-					if realIndex != -1 {
-						// 要是term不相等，发生冲突
-						// R3: 如果一个现有的条目与一个新的条目相冲突（相同的索引但不同的任期），删除现有的条目和后面所有的条目
-						if args.Entries[idx].Term != rf.log[realIndex].Term {
-							rf.log = append(rf.log[:realIndex], args.Entries[idx:]...)
-							break
-						}
-					} else { // no conflict or log does not exists
-						rf.log = append(rf.log, args.Entries[idx])
+				changedFrom, truncated := rf.mergeEntries(args.Entries)
+				if changedFrom != -1 {
+					rf.tracer.Emit(trace.EntriesAppended, rf.currentTerm, rf.log.LastIndex(),
+						"from %v leader %v truncated %v", changedFrom, args.LeaderId, truncated)
+				}
+				//匹配的日志中已经在所有完整副本上的部分，witness可以压缩
+				if rf.membership.isWitness(rf.me) {
+					safe := args.PrevLogIndex + len(args.Entries)
+					if args.ReplicatedIndex < safe {
+						safe = args.ReplicatedIndex
+					}
+					if safe > rf.witnessSafeIndex {
+						rf.witnessSafeIndex = safe
 					}
 				}
-
-				rf.persist()
 				//R5: 如果leaderCommit > commitIndex
 				//设置commitIndex = min(leaderCommit, 最后一个新条目的索引)
+				//心跳不带日志时，prevLogIndex之后的日志不一定与leader一致，不能提交
 				if args.LeaderCommit > rf.commitIndex {
-					lastEntryIndex, _ := rf.getLastLogInfo() // ok
+					lastEntryIndex := args.PrevLogIndex + len(args.Entries)
+					oldCommitIndex := rf.commitIndex
 					if args.LeaderCommit < lastEntryIndex {
 						rf.commitIndex = args.LeaderCommit
-					} else {
+					} else if lastEntryIndex > rf.commitIndex {
 						rf.commitIndex = lastEntryIndex
 					}
+					if rf.commitIndex > oldCommitIndex {
+						rf.tracer.Emit(trace.CommitAdvanced, rf.currentTerm, rf.commitIndex, "")
+						rf.applyCond.Signal()
+					}
 				}
 				//R2: 如果日志在prevLogIndex处不包含与prevLogTerm匹配的条目，则返回false
 			} else {
 				//logTerm赋值给reply的XTerm
 				reply.XTerm = logTerm
-				index := -1
-				//如果有跟logTerm相等的log，找到index
-				for i := 0; i < len(rf.log); i++ {
-					if rf.log[i].Term == reply.XTerm {
-						index = rf.log[i].Index
-						break
-					}
-				}
-				//设为XIndex
-				reply.XIndex = index
+				//第一条term为logTerm的日志，设为XIndex
+				reply.XIndex = rf.log.firstIndexOfTerm(reply.XTerm)
 			}
 			// args.PrevLogIndex > lastLogIndex
 		} else {
-			reply.XLen = len(rf.log) + rf.lastIncludedIndex
+			reply.XLen = rf.log.LastIndex()
 		}
 	}
 
 	DPrintf("HeartBeat: %v Instance %v receive rpc from %v. HeartBeat Term:%v My Term: %v Result: %v Entries size: %v Commit Index: %v Log Length: %v PreLogIndex: %v",
-		args.IsHeartBeat, rf.me, args.LeaderId, args.Term, rf.currentTerm, reply.Success, len(args.Entries), rf.commitIndex, rf.lastIncludedIndex+len(rf.log), args.PrevLogIndex)
+		args.IsHeartBeat, rf.me, args.LeaderId, args.Term, rf.currentTerm, reply.Success, len(args.Entries), rf.commitIndex, rf.log.LastIndex(), args.PrevLogIndex)
+
+}
 
+// 从头遍历entries，跳过已经存在且term相同的日志，截断冲突的日志并追加剩下的日志。
+// 返回第一条新追加或被替换的日志的index(没有时为-1)，以及是否截断了日志
+// use it with lock
+func (rf *Raft) mergeEntries(entries []Log) (int, bool) {
+	truncated := false
+	changedFrom := -1
+	for idx := 0; idx < len(entries); idx++ {
+		entryIndex := entries[idx].Index
+		term := rf.log.Term(entryIndex)
+		if term == entries[idx].Term {
+			continue
+		}
+		// has conflict
+		// R3: 如果一个现有的条目与一个新的条目相冲突（相同的索引但不同的任期），删除现有的条目和后面所有的条目
+		if term != -1 {
+			rf.log.TruncateSuffix(entryIndex)
+			truncated = true
+		}
+		rf.log.Append(entries[idx:])
+		changedFrom = entryIndex
+		break
+	}
+	if changedFrom != -1 {
+		rf.persistLog(changedFrom)
+	}
+	//日志中的成员配置可能被追加或截断
+	if truncated || containsMembership(entries) {
+		rf.refreshMembership()
+	}
+	return changedFrom, truncated
 }
 
 // example RequestVote RPC handler.
@@ -726,16 +811,8 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 // 如果log为空，返回lastIncludedIndex和lastIncludedTerm
 func (rf *Raft) getLastLogInfo() (int, int) {
 	// use it with lock
-	lastLogIndex := 0
-	lastLogTerm := 0
-	if len(rf.log) > 0 {
-		lastLogIndex = rf.log[len(rf.log)-1].Index
-		lastLogTerm = rf.log[len(rf.log)-1].Term
-	} else if len(rf.log) == 0 {
-		lastLogIndex = rf.lastIncludedIndex
-		lastLogTerm = rf.lastIncludedTerm
-	}
-	return lastLogIndex, lastLogTerm
+	lastLogIndex := rf.log.LastIndex()
+	return lastLogIndex, rf.log.Term(lastLogIndex)
 }
 
 func (rf *Raft) StartElection() {
@@ -754,20 +831,39 @@ func (rf *Raft) StartElection() {
 		LastLogIndex: lastLogIndex,
 		LastLogTerm:  lastLogTerm,
 	}
+	voters := rf.otherVoters()
+	quorum := rf.membership.quorum()
+	//只有自己一个voter，直接成为leader
+	if voteCount >= quorum {
+		rf.BecomeLeader()
+		rf.mu.Unlock()
+		rf.spawn(func() { rf.StartAppendEntries(true) })
+		return
+	}
 	rf.mu.Unlock()
 
 	for i := 0; i < len(rf.peers); i++ {
-		if i != rf.me {
-			go func(id int) {
-				//给每个peer发送请求投票信息
+		if contains(voters, i) {
+			id := i
+			rf.spawn(func() {
+				//给每个voter发送请求投票信息
 				reply := RequestVoteReply{}
 				ok := rf.sendRequestVote(id, &args, &reply)
 				if ok {
 					DPrintf("Instance %v  gets vote reply from %v, result %v", rf.me, id, reply.VoteGranted)
+					//witness拒绝时附带的日志，追加之后下一轮选举可以得到它的选票
+					if len(reply.CatchUpEntries) > 0 {
+						rf.mu.Lock()
+						rf.adoptCatchUp(reply.CatchUpPrevIndex, reply.CatchUpPrevTerm, reply.CatchUpEntries)
+						rf.mu.Unlock()
+					}
 					//有回复的term比自己的大，成为Follower
+					//回复可能在本节点进入更新的term之后才到达，不能让term倒退
 					if reply.Term > args.Term {
 						rf.mu.Lock()
-						rf.BecomeFollower(reply.Term)
+						if reply.Term > rf.currentTerm {
+							rf.BecomeFollower(reply.Term)
+						}
 						rf.mu.Unlock()
 						return
 					}
@@ -780,11 +876,11 @@ func (rf *Raft) StartElection() {
 						DPrintf("Instance %v  gets vote count: %v", rf.me, voteCount)
 						//计票数大于一半，成为leader
 						//发送心跳
-						if voteCount >= len(rf.peers)/2+1 {
+						if voteCount >= quorum {
 							DPrintf("Instance %d wins the election (candidate -> leader)", rf.me)
 							rf.BecomeLeader()
 							rf.mu.Unlock()
-							go rf.StartAppendEntries(true)
+							rf.spawn(func() { rf.StartAppendEntries(true) })
 							return
 						}
 
@@ -792,44 +888,121 @@ func (rf *Raft) StartElection() {
 					rf.mu.Unlock()
 
 				}
-			}(i)
+			})
 		}
 	}
 
 }
 
+// 预投票：向所有peer询问，如果以currentTerm+1发起选举是否会得到选票
+// 只有大多数节点同意时才真正增加term并开始选举，
+// 这样被分区隔离的节点重新加入时不会用更大的term迫使leader下台
+func (rf *Raft) StartPreVote() {
+	rf.mu.Lock()
+	if rf.role == Role_Leader {
+		rf.mu.Unlock()
+		return
+	}
+	// vote to itself
+	voteCount := 1
+	lastLogIndex, lastLogTerm := rf.getLastLogInfo() // ok
+	args := PreVoteArgs{
+		Term:         rf.currentTerm + 1,
+		CandidateId:  rf.me,
+		LastLogIndex: lastLogIndex,
+		LastLogTerm:  lastLogTerm,
+	}
+	voters := rf.otherVoters()
+	quorum := rf.membership.quorum()
+	if voteCount >= quorum {
+		rf.BecomeCandidate()
+		rf.mu.Unlock()
+		rf.spawn(rf.StartElection)
+		return
+	}
+	rf.mu.Unlock()
+
+	for i := 0; i < len(rf.peers); i++ {
+		if contains(voters, i) {
+			id := i
+			rf.spawn(func() {
+				reply := PreVoteReply{}
+				ok := rf.sendPreVote(id, &args, &reply)
+				if !ok {
+					return
+				}
+				DPrintf("Instance %v  gets pre-vote reply from %v, result %v", rf.me, id, reply.VoteGranted)
+				rf.mu.Lock()
+				defer rf.mu.Unlock()
+				rf.adoptCatchUp(reply.CatchUpPrevIndex, reply.CatchUpPrevTerm, reply.CatchUpEntries)
+				//有回复的term比自己的大，成为Follower
+				if reply.Term > rf.currentTerm {
+					rf.BecomeFollower(reply.Term)
+					return
+				}
+				//预投票期间term或角色发生了变化，本轮预投票作废
+				if rf.currentTerm+1 != args.Term || rf.role == Role_Leader {
+					return
+				}
+				if reply.VoteGranted {
+					voteCount += 1
+				}
+				//预投票得到大多数同意，成为候选人开始真正的选举
+				if voteCount == quorum {
+					DPrintf("Instance %v wins the pre-vote at term %v", rf.me, args.Term)
+					rf.BecomeCandidate()
+					rf.spawn(rf.StartElection)
+				}
+			})
+		}
+	}
+}
+
 func (rf *Raft) BecomeLeader() {
 	rf.role = Role_Leader
-	lastIndex := 0
-	if len(rf.log) > 0 {
-		lastIndex = rf.log[len(rf.log)-1].Index
-	} else if len(rf.log) == 0 {
-		lastIndex = rf.lastIncludedIndex
-	}
+	rf.leaderId = rf.me
+	rf.transferTarget = noTransfer
+	lastIndex := rf.log.LastIndex()
 	//所有nextIndex更新为lastIndex+1
-	//所有matchIndex更新为0
+	//所有matchIndex更新为0，自己的日志都已经持久化
 	for i := 0; i < len(rf.peers); i++ {
 		rf.nextIndex[i] = lastIndex + 1
 		rf.matchIndex[i] = 0
+		// 给每个节点一个选举超时的时间回复，之后才开始CheckQuorum
+		rf.progress[i].lastAck = rf.now()
 	}
+	rf.matchIndex[rf.me] = lastIndex
+	rf.openProposals()
 }
 
 // 成为候选人，给自己投一票，计数+1，选举时间重置，随机取过期时间，保存到磁盘上
 func (rf *Raft) BecomeCandidate() {
-	rf.timeout = getRandTimeout()
+	rf.resetElectionTimer()
 	rf.role = Role_Candidate
 	rf.currentTerm += 1
-	rf.lastElectionTime = time.Now()
 	rf.votedFor = rf.me
+	rf.leaderId = -1
+	rf.incCounter(MetricElectionsStarted)
+	rf.tracer.Emit(trace.ElectionStart, rf.currentTerm, rf.log.LastIndex(), "")
 	rf.persist()
 }
 
 // 成为候选人，投票取消，心跳时间重置，随机取过期时间，保存到磁盘上
 func (rf *Raft) BecomeFollower(term int) {
-	rf.timeout = getRandTimeout()
-	rf.lastHeartBeatTime = time.Now() // reset timeout!
+	// leader退位之前追加排队的提议，持久化还没保存的日志
+	if rf.role == Role_Leader {
+		rf.closeProposals()
+		rf.flushLog()
+	}
+	rf.lastHeartBeatTime = rf.now()
+	rf.resetElectionTimer() // reset timeout!
 	rf.role = Role_Follower
-	rf.votedFor = -1
+	rf.transferTarget = noTransfer
+	// 同一个term内已经投出的票不能收回，否则一个term可能选出两个leader
+	if term > rf.currentTerm {
+		rf.votedFor = -1
+		rf.leaderId = -1
+	}
 	rf.currentTerm = term
 	rf.persist()
 }
@@ -859,20 +1032,59 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 		DPrintf("LastLogIndex %v LastLogTerm %v, my Index %v, my Term %v",
 			args.LastLogIndex, args.LastLogTerm, lastLogIndex, lastLogTerm)
 		//R2: 并且候选人的日志至少与接收人的日志一样新，则投票
-		//如果候选人的term与其相同，index更大，或者term更大
 		//同意给candidate投票，重置心跳时间，保存到磁盘
-		if args.LastLogIndex >= lastLogIndex && args.LastLogTerm == lastLogTerm || args.LastLogTerm > lastLogTerm {
-			rf.lastHeartBeatTime = time.Now()
+		if rf.isLogUpToDate(args.LastLogIndex, args.LastLogTerm) {
+			rf.lastHeartBeatTime = rf.now()
+			rf.resetElectionTimer()
 			rf.votedFor = args.CandidateId
 			reply.VoteGranted = true
+			rf.incCounter(MetricVotesGranted)
+			rf.tracer.Emit(trace.VoteGranted, rf.currentTerm, args.LastLogIndex, "to %v", args.CandidateId)
 			rf.persist()
 			DPrintf("Instance %v grants vote to %v", rf.me, rf.votedFor)
+		} else if rf.membership.isWitness(rf.me) {
+			//witness把候选人缺少的日志附在回复中，见witness.go
+			reply.CatchUpPrevIndex, reply.CatchUpPrevTerm, reply.CatchUpEntries =
+				rf.witnessCatchUp(args.LastLogIndex, args.LastLogTerm)
 		}
 
 	}
 
 }
 
+// 候选人的日志是否至少与接收者的日志一样新
+// 如果候选人的term与其相同，index更大，或者term更大
+func (rf *Raft) isLogUpToDate(lastLogIndex int, lastLogTerm int) bool {
+	myLastLogIndex, myLastLogTerm := rf.getLastLogInfo() // ok
+	return lastLogIndex >= myLastLogIndex && lastLogTerm == myLastLogTerm || lastLogTerm > myLastLogTerm
+}
+
+// 收到预投票请求，只判断是否愿意投票，不改变自己的term和votedFor
+func (rf *Raft) PreVote(args *PreVoteArgs, reply *PreVoteReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	DPrintf("Instance %v receive pre-vote request from %v. Request Term:%v My Term: %v",
+		rf.me, args.CandidateId, args.Term, rf.currentTerm)
+	reply.Term = rf.currentTerm
+	reply.VoteGranted = false
+
+	if args.Term < rf.currentTerm {
+		return
+	}
+	// 自己是leader，或者最近一个选举超时内收到过leader的心跳，说明leader仍然存活，拒绝预投票
+	if rf.role == Role_Leader {
+		return
+	}
+	if rf.role == Role_Follower && rf.now().Sub(rf.lastHeartBeatTime) < time.Duration(electionTimeout)*time.Millisecond {
+		return
+	}
+	reply.VoteGranted = rf.isLogUpToDate(args.LastLogIndex, args.LastLogTerm)
+	if !reply.VoteGranted && rf.membership.isWitness(rf.me) {
+		reply.CatchUpPrevIndex, reply.CatchUpPrevTerm, reply.CatchUpEntries =
+			rf.witnessCatchUp(args.LastLogIndex, args.LastLogTerm)
+	}
+}
+
 // example code to send a RequestVote RPC to a server.
 // server is the index of the target server in rf.peers[].
 // expects RPC arguments in args.
@@ -905,6 +1117,11 @@ func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *Reques
 	return ok
 }
 
+func (rf *Raft) sendPreVote(server int, args *PreVoteArgs, reply *PreVoteReply) bool {
+	ok := rf.peers[server].Call("Raft.PreVote", args, reply)
+	return ok
+}
+
 // leader调用以复制日志条目或发送心跳
 func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
 	ok := rf.peers[server].Call("Raft.AppendEntries", args, reply)
@@ -930,34 +1147,17 @@ func (rf *Raft) sendInstallSnapshot(server int, args *InstallSnapshotArgs, reply
 // the leader.
 func (rf *Raft) Start(command interface{}) (int, int, bool) {
 	//command(op)会放入log中
-	index := -1
-	term := -1
-	isLeader := true
-
 	// Your code here (2B).
-	rf.mu.Lock()
-
-	term = rf.currentTerm
-	isLeader = rf.role == Role_Leader
-
-	rf.mu.Unlock()
-
-	if isLeader {
-		rf.mu.Lock()
-		lastLogIndex, _ := rf.getLastLogInfo() //ok
-		index = lastLogIndex + 1
-		entry := Log{
-			Term:    rf.currentTerm,
-			Index:   index,
-			Command: command,
-		}
-		rf.log = append(rf.log, entry)
-		rf.persist()
-		DPrintf("Instance %v add new log %v %v ", rf.me, index, rf.currentTerm)
-		rf.mu.Unlock()
+	// 检查角色和放入队列在propMu的同一个临界区内，退位的节点先关闭队列，
+	// 所以不会以follower身份追加一条新term的日志
+	if index, term, ok := rf.propose(command); ok {
+		return index, term, true
 	}
 
-	return index, term, isLeader
+	// 不是leader，或者领导权转移期间不再接受新的命令
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return -1, rf.currentTerm, false
 }
 
 // Start(command) asks Raft to start the processing to append the command to the replicated log.
@@ -976,6 +1176,13 @@ func (rf *Raft) Start(command interface{}) (int, int, bool) {
 func (rf *Raft) Kill() {
 	atomic.StoreInt32(&rf.dead, 1)
 	// Your code here, if desired.
+	rf.mu.Lock()
+	rf.applyCond.Broadcast()
+	if rf.electionTimer != nil {
+		rf.electionTimer.Stop()
+	}
+	rf.wakeCompactor()
+	rf.mu.Unlock()
 }
 
 func (rf *Raft) killed() bool {
@@ -993,24 +1200,55 @@ func (rf *Raft) killed() bool {
 // Make() must return quickly, so it should start goroutines
 // for any long-running work.
 func Make(peers []*labrpc.ClientEnd, me int,
-	persister *Persister, applyCh chan ApplyMsg) *Raft {
+	persister Storage, applyCh chan ApplyMsg) *Raft {
+	return makeRaft(peers, me, persister, applyCh, bootstrapMembership(len(peers)), nil)
+}
+
+// MakeSimulated 和Make相同，但是Raft在s上运行：虚拟时钟、s的随机数，
+// 所有goroutine都是s的task。peers应该来自同一个s上的labrpc.Network，
+// applyCh需要有缓冲，读取它的goroutine也应该是s的task
+func MakeSimulated(peers []*labrpc.ClientEnd, me int,
+	persister Storage, applyCh chan ApplyMsg, s *sim.Sim) *Raft {
+	return makeRaft(peers, me, persister, applyCh, bootstrapMembership(len(peers)), s)
+}
+
+// membership是没有持久化状态时使用的初始配置，s为nil时使用真实的时钟
+func makeRaft(peers []*labrpc.ClientEnd, me int,
+	persister Storage, applyCh chan ApplyMsg, membership Membership, s *sim.Sim) *Raft {
+	labgob.Register(Membership{})
 
 	rf := &Raft{}
+	rf.sim = s
 	rf.peers = peers
 	rf.persister = persister
 	rf.me = me
 	rf.applyChan = applyCh
+	rf.applyCond = sync.NewCond(&rf.mu)
+
+	// 保存的状态损坏时拒绝启动，而不是解码错误的数据
+	if err := persister.Verify(); err != nil {
+		log.Fatalf("Instance %v refuses to start: %v", me, err)
+	}
 
 	// Your initialization code here (2A, 2B, 2C).
 	rf.role = Role_Follower
-	rf.timeout = getRandTimeout()
+	rf.timeout = rf.randTimeout()
 	rf.currentTerm = 0
 	rf.votedFor = -1
-	rf.lastHeartBeatTime = time.Now()
-	rf.lastElectionTime = time.Now()
-	rf.log = []Log{}
+	rf.lastHeartBeatTime = rf.now()
+	rf.log = makeRaftLog(persister, 0, 0, nil)
 	rf.lastIncludedIndex = 0
 	rf.lastIncludedTerm = 0
+	rf.preVote = true
+	rf.membership = membership
+	rf.snapshotMembership = membership
+	rf.membershipIndex = 0
+	rf.transferTarget = noTransfer
+	rf.propTerm = -1
+	rf.snapshotChunkSize = defaultSnapshotChunkSize
+	rf.leaderId = -1
+	rf.counters = map[string]int{}
+	rf.tracer = trace.NewTracer(trace.EnvSink(fmt.Sprintf("raft-%v", me)), "raft", 0, me)
 
 	rf.commitIndex = 0
 	rf.lastApplied = 0
@@ -1021,6 +1259,10 @@ func Make(peers []*labrpc.ClientEnd, me int,
 		rf.nextIndex = append(rf.nextIndex, 1)
 		rf.matchIndex = append(rf.matchIndex, 0)
 	}
+	rf.progress = []*peerProgress{}
+	for i := 0; i < len(rf.peers); i++ {
+		rf.progress = append(rf.progress, &peerProgress{replicatorTerm: -1})
+	}
 	/*
 		f, err := os.Create(strconv.Itoa(rf.me))
 		if err != nil {
@@ -1028,18 +1270,13 @@ func Make(peers []*labrpc.ClientEnd, me int,
 		}
 		log.SetOutput(f)*/
 	// initialize from state persisted before a crash*/
-	DPrintf("Instance %v starts the main loop, timeout limit: %v", rf.me, rf.timeout)
-	rf.readPersist(persister.ReadRaftState())
-	//	rf.readSnapshot()
-	go rf.mainLoop()
-	go rf.applyLog()
+	DPrintf("Instance %v starts the election timer, timeout limit: %v", rf.me, rf.timeout)
+	rf.readPersist()
+	rf.mu.Lock()
+	rf.electionTimer = rf.afterFunc(time.Duration(rf.timeout)*time.Millisecond, rf.electionTimerFired)
+	rf.electionDeadline = rf.now().Add(time.Duration(rf.timeout) * time.Millisecond)
+	rf.mu.Unlock()
+	rf.spawn(rf.applier)
 
 	return rf
 }
-
-// create a Raft peer
-// The me argument is the index of this peer in the peers array.
-func getRandTimeout() int {
-	rand.Seed(time.Now().UnixNano())
-	return electionTimeout + rand.Intn(electionTimeout)
-}
@@ -0,0 +1,444 @@
+package raft
+
+//
+// log replication from the leader to the other members.
+//
+// each member has its own replicator goroutine. it keeps up to
+// maxInflightAppends AppendEntries in flight, each carrying at most
+// maxAppendEntriesBytes of log, and moves nextIndex forward as soon
+// as a batch is sent. after a rejection it falls back to probing:
+// one AppendEntries at a time until the follower's log matches again.
+//
+// Start() only queues the command (see propose.go); the leader's
+// flusher appends everything queued since the last flush, persists it
+// at once and then wakes the replicators, so concurrent Start() calls
+// share one append and one persist. once woken, the flusher keeps
+// waiting while new proposals keep arriving, for at most
+// maxFlushDelay, so a burst of Start() calls is not split into one
+// append per call.
+//
+
+import (
+	"bytes"
+	"cs651/labgob"
+	"time"
+)
+
+const (
+	// leader发送心跳的间隔
+	heartbeatInterval = 100 * time.Millisecond
+	// 每个peer同时在发送中的AppendEntries数量上限
+	maxInflightAppends = 4
+	// 一次AppendEntries携带的日志大小上限(字节)
+	maxAppendEntriesBytes = 64 * 1024
+	// flusher被唤醒之后等待更多提议的时间，这段时间内没有新的提议就开始追加
+	flushCoalesceWindow = time.Millisecond
+	// flusher被唤醒之后最多推迟追加的时间
+	maxFlushDelay = 5 * time.Millisecond
+)
+
+// leader向一个peer复制日志的状态
+type peerProgress struct {
+	wake           chan bool // 唤醒复制goroutine
+	replicatorTerm int       // 正在运行的复制goroutine所属的term，没有时为-1
+	inflight       int       // 正在发送中的请求数量
+	probing        bool      // 被拒绝之后逐个探测nextIndex，不使用流水线
+	epoch          int       // 窗口被重置时增加，之前发出的请求的回复不再计数
+	lastProgress   time.Time // 最近一次开始发送或者收到回复的时间
+	snapshotIndex  int       // 正在发送的快照的LastIncludedIndex
+	snapshotOffset int       // 下一个要发送的快照分块的偏移量
+	snapshotSum    uint32    // 正在发送的快照的校验和
+	snapshotData   []byte    // 正在发送的快照数据，发送期间只读取一次，发送完成后释放
+	snapshotCached bool      // snapshotData和snapshotSum对应snapshotIndex
+	lastAck        time.Time // 最近一次收到当前term回复的时间，用于CheckQuorum
+}
+
+// 成为leader之后调用：启动flusher，并为每个成员启动复制goroutine。
+// 之后定期检查成员配置，为新加入的成员启动复制goroutine
+func (rf *Raft) StartAppendEntries(is bool) {
+	rf.mu.Lock()
+	if rf.role != Role_Leader {
+		rf.mu.Unlock()
+		return
+	}
+	term := rf.currentTerm
+	for i := 0; i < len(rf.peers); i++ {
+		p := rf.progress[i]
+		p.wake = make(chan bool, 1)
+		p.inflight = 0
+		p.probing = true
+		p.epoch++
+		p.releaseSnapshot()
+	}
+	appendCh := rf.appendCh
+	rf.mu.Unlock()
+
+	DPrintf("Instance %v is the leader and sending entries\n", rf.me)
+	rf.spawn(func() { rf.flusher(term, appendCh) })
+
+	for !rf.killed() {
+		rf.mu.Lock()
+		if rf.role != Role_Leader || rf.currentTerm != term {
+			rf.mu.Unlock()
+			return
+		}
+		for _, id := range rf.otherMembers() {
+			if rf.progress[id].replicatorTerm != term {
+				rf.progress[id].replicatorTerm = term
+				id, wake := id, rf.progress[id].wake
+				rf.spawn(func() { rf.replicator(id, term, wake, is) })
+			}
+		}
+		rf.mu.Unlock()
+		rf.sleep(heartbeatInterval)
+	}
+}
+
+// 把Start()提议的日志一次性追加并持久化，然后唤醒所有复制goroutine
+func (rf *Raft) flusher(term int, appendCh chan bool) {
+	for !rf.killed() {
+		if woken, _ := rf.recv(appendCh, heartbeatInterval); woken {
+			rf.coalesceProposals(appendCh)
+		}
+		rf.mu.Lock()
+		if rf.role != Role_Leader || rf.currentTerm != term {
+			rf.mu.Unlock()
+			return
+		}
+		rf.flushLog()
+		rf.mu.Unlock()
+	}
+}
+
+// flusher被唤醒之后，只要flushCoalesceWindow内还有新的提议就继续等待，
+// 让同时到来的Start()合并到一次追加和持久化中，最多等待maxFlushDelay
+func (rf *Raft) coalesceProposals(appendCh chan bool) {
+	deadline := rf.now().Add(maxFlushDelay)
+	for rf.now().Before(deadline) {
+		if _, ok := rf.recv(appendCh, flushCoalesceWindow); !ok {
+			return
+		}
+	}
+}
+
+// 追加排队的提议，持久化还没有保存的日志，更新leader自己的matchIndex并尝试提交，
+// 然后唤醒所有复制goroutine
+// use it with lock
+func (rf *Raft) flushLog() {
+	rf.drainProposals()
+	lastLogIndex, _ := rf.getLastLogInfo() // ok
+	if rf.matchIndex[rf.me] < lastLogIndex {
+		rf.persistLog(rf.matchIndex[rf.me] + 1)
+		rf.matchIndex[rf.me] = lastLogIndex
+		rf.advanceCommitIndex()
+		for i := 0; i < len(rf.peers); i++ {
+			rf.wakeReplicator(i)
+		}
+	}
+}
+
+// 通知leader有新的提议需要追加和复制
+// use it with rf.propMu
+func (rf *Raft) signalAppend() {
+	if rf.appendCh == nil {
+		return
+	}
+	select {
+	case rf.appendCh <- true:
+	default:
+	}
+}
+
+// use it with lock
+func (rf *Raft) wakeReplicator(id int) {
+	if id == rf.me || rf.progress[id].wake == nil {
+		return
+	}
+	select {
+	case rf.progress[id].wake <- true:
+	default:
+	}
+}
+
+// 向peers[id]复制日志，直到不再是term中的leader或者id被移出集群
+func (rf *Raft) replicator(id int, term int, wake chan bool, is bool) {
+	defer func() {
+		rf.mu.Lock()
+		if rf.progress[id].replicatorTerm == term {
+			rf.progress[id].replicatorTerm = -1
+		}
+		rf.mu.Unlock()
+	}()
+
+	heartbeat := true
+	for !rf.killed() {
+		rf.mu.Lock()
+		if rf.role != Role_Leader || rf.currentTerm != term || !rf.membership.isMember(id) {
+			rf.mu.Unlock()
+			return
+		}
+		p := rf.progress[id]
+		// 一个心跳间隔内没有任何回复，认为还在路上的请求已经丢失，
+		// 不再等待它们，从matchIndex之后重新探测
+		if heartbeat && p.inflight > 0 && rf.since(p.lastProgress) > heartbeatInterval {
+			DPrintf("Leader %v resets the pipeline to %v", rf.me, id)
+			p.epoch++
+			p.inflight = 0
+			p.probing = true
+			rf.nextIndex[id] = rf.matchIndex[id] + 1
+		}
+		sent := rf.sendEntries(id, term)
+		// 窗口已满或者没有新的日志时，仍然要按时发送心跳
+		if heartbeat && !sent {
+			rf.sendHeartbeat(id, term, is)
+		}
+		rf.mu.Unlock()
+
+		_, woken := rf.recv(wake, heartbeatInterval)
+		heartbeat = !woken
+	}
+}
+
+// 在窗口允许的范围内向id发送日志，返回是否发送了RPC
+// use it with lock
+func (rf *Raft) sendEntries(id int, term int) bool {
+	p := rf.progress[id]
+	sent := false
+	for p.inflight < maxInflightAppends {
+		// 探测阶段同一时间只发送一个请求
+		if p.probing && p.inflight > 0 {
+			break
+		}
+		lastLogIndex, _ := rf.getLastLogInfo() // ok
+		//follower的日志比leader长时，回退得到的nextIndex可能超出leader的日志
+		if rf.nextIndex[id] > lastLogIndex+1 {
+			rf.nextIndex[id] = lastLogIndex + 1
+		}
+		// 需要的日志已经被快照删除，发送快照
+		if rf.nextIndex[id] <= rf.lastIncludedIndex {
+			// 同一时间只发送一个分块
+			if p.inflight == 0 {
+				args := rf.nextSnapshotChunk(id, term)
+				rf.startRequest(p)
+				epoch := p.epoch
+				rf.spawn(func() { rf.installSnapshotTo(id, args, epoch) })
+				sent = true
+			}
+			break
+		}
+		// 流水线阶段没有新日志时不用发送
+		if !p.probing && rf.nextIndex[id] > lastLogIndex {
+			break
+		}
+
+		prevLogIndex := rf.nextIndex[id] - 1
+		entries := rf.entriesFrom(rf.nextIndex[id])
+		replicated := rf.replicatedIndex()
+		// witness保留还不在所有完整副本上的日志的命令，见witness.go
+		if rf.membership.isWitness(id) {
+			entries = stripPayloads(entries, replicated)
+		}
+		args := AppendEntriesArgs{
+			Term:            term,
+			LeaderId:        rf.me,
+			PrevLogIndex:    prevLogIndex,
+			PrevLogTerm:     rf.getLogTerm(prevLogIndex),
+			Entries:         entries,
+			LeaderCommit:    rf.commitIndex,
+			IsHeartBeat:     false,
+			ReplicatedIndex: replicated,
+		}
+		DPrintf("Server %v send log interval [%v, %v] to %v", rf.me, rf.nextIndex[id], prevLogIndex+len(entries), id)
+		rf.startRequest(p)
+		epoch := p.epoch
+		rf.spawn(func() { rf.appendEntriesTo(id, args, epoch) })
+		sent = true
+		if p.probing {
+			break
+		}
+		// 流水线：不等回复就发送下一批
+		rf.nextIndex[id] = prevLogIndex + len(entries) + 1
+	}
+	return sent
+}
+
+// use it with lock
+func (rf *Raft) startRequest(p *peerProgress) {
+	if p.inflight == 0 {
+		p.lastProgress = rf.now()
+	}
+	p.inflight++
+}
+
+// 心跳不占用窗口，prevLogIndex使用已经确认匹配的matchIndex，
+// 因此不会因为还在路上的日志而被拒绝
+// use it with lock
+func (rf *Raft) sendHeartbeat(id int, term int, is bool) {
+	prevLogIndex := rf.matchIndex[id]
+	if prevLogIndex < rf.lastIncludedIndex {
+		prevLogIndex = rf.lastIncludedIndex
+	}
+	args := AppendEntriesArgs{
+		Term:            term,
+		LeaderId:        rf.me,
+		PrevLogIndex:    prevLogIndex,
+		PrevLogTerm:     rf.getLogTerm(prevLogIndex),
+		Entries:         []Log{},
+		LeaderCommit:    rf.commitIndex,
+		IsHeartBeat:     is,
+		ReplicatedIndex: rf.replicatedIndex(),
+	}
+	rf.spawn(func() { rf.appendEntriesTo(id, args, -1) })
+}
+
+// 从index开始取出日志，总大小不超过maxAppendEntriesBytes(至少一条)
+// use it with lock
+func (rf *Raft) entriesFrom(index int) []Log {
+	lastLogIndex, _ := rf.getLastLogInfo() // ok
+	entries := []Log{}
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	// 分批读取，旧日志可能需要从persister读取
+	for j := index; j <= lastLogIndex; j += 64 {
+		for _, entry := range rf.log.Entries(j, j+64) {
+			e.Encode(entry)
+			if len(entries) > 0 && w.Len() > maxAppendEntriesBytes {
+				return entries
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// 请求的回复是否属于当前窗口，是的话释放它占用的位置
+// use it with lock
+func (rf *Raft) finishRequest(id int, term int, epoch int) bool {
+	p := rf.progress[id]
+	if epoch == -1 || rf.currentTerm != term || p.epoch != epoch {
+		return false
+	}
+	p.inflight--
+	p.lastProgress = rf.now()
+	return true
+}
+
+// 发送AppendEntries并处理回复。
+// epoch为-1表示心跳，心跳不占用窗口
+func (rf *Raft) appendEntriesTo(id int, args AppendEntriesArgs, epoch int) {
+	reply := AppendEntriesReply{}
+	ok := rf.sendAppendEntries(id, &args, &reply)
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	counted := rf.finishRequest(id, args.Term, epoch)
+	if !ok {
+		// 请求丢失，之后的日志也不会被接受，从matchIndex之后重新探测
+		// 等到下一次心跳再重试
+		if counted && rf.role == Role_Leader {
+			rf.progress[id].probing = true
+			rf.nextIndex[id] = rf.matchIndex[id] + 1
+		}
+		return
+	}
+	if counted {
+		// 窗口有了空位，继续发送
+		defer rf.wakeReplicator(id)
+	}
+	//reply的term大于当前term,成为Follower
+	if reply.Term > rf.currentTerm {
+		rf.BecomeFollower(reply.Term)
+		return
+	}
+	// only update commitindex when success
+	// otherwise the commitIndex may fall back
+	if args.Term != rf.currentTerm || rf.role != Role_Leader {
+		return
+	}
+	// 被拒绝也说明对方还认可这个leader
+	rf.progress[id].lastAck = rf.now()
+	if reply.Success {
+		// 回复可能乱序到达，matchIndex只增不减
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > rf.matchIndex[id] {
+			rf.matchIndex[id] = match
+		}
+		if counted && rf.progress[id].probing {
+			// 日志已经匹配，恢复流水线
+			rf.progress[id].probing = false
+			rf.nextIndex[id] = match + 1
+		}
+		if rf.nextIndex[id] <= rf.matchIndex[id] {
+			rf.nextIndex[id] = rf.matchIndex[id] + 1
+		}
+		rf.advanceCommitIndex()
+		return
+	}
+	if !counted {
+		// 心跳或者过期的请求被拒绝，不影响nextIndex
+		return
+	}
+
+	DPrintf("Before fall back : nextIndex[%v]= %v", id, rf.nextIndex[id])
+	rf.progress[id].probing = true
+	//如果reply的nextIndex不为空，更新为nextIndex
+	if reply.NextIndex != -1 {
+		rf.nextIndex[id] = reply.NextIndex
+		//否则若XLen不为空，更新为XLen+1
+	} else if reply.XLen != -1 {
+		rf.nextIndex[id] = reply.XLen + 1
+		//否则更新为XIndex
+	} else {
+		rf.nextIndex[id] = reply.XIndex
+		//从最后开始遍历, 找到第一个Term小于等于reply.Xterm的index
+		//leader有term为XTerm的日志时，更新为其中最后一条的index
+		if index := rf.log.lastIndexOfTerm(reply.XTerm); index != -1 {
+			rf.nextIndex[id] = index
+		}
+	}
+	// 已经确认匹配的日志不需要重发
+	if rf.nextIndex[id] <= rf.matchIndex[id] {
+		rf.nextIndex[id] = rf.matchIndex[id] + 1
+	}
+	DPrintf("After fall back : nextIndex[%v]= %v", id, rf.nextIndex[id])
+}
+
+// 发送快照并处理回复
+func (rf *Raft) installSnapshotTo(id int, args InstallSnapshotArgs, epoch int) {
+	reply := InstallSnapshotReply{}
+	ok := rf.sendInstallSnapshot(id, &args, &reply)
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	counted := rf.finishRequest(id, args.Term, epoch)
+	if !ok {
+		return
+	}
+	if counted {
+		defer rf.wakeReplicator(id)
+	}
+	if reply.Term > rf.currentTerm {
+		rf.BecomeFollower(reply.Term)
+		return
+	}
+	if args.Term != rf.currentTerm || rf.role != Role_Leader {
+		return
+	}
+	p := rf.progress[id]
+	p.lastAck = rf.now()
+	if reply.NextOffset == -1 || args.Done && reply.NextOffset == args.Offset+len(args.Data) {
+		// 快照已经安装，或者follower已经有这些日志
+		if args.LastIncludedIndex > rf.matchIndex[id] {
+			rf.matchIndex[id] = args.LastIncludedIndex
+		}
+		rf.nextIndex[id] = rf.matchIndex[id] + 1
+		p.probing = false
+		p.snapshotOffset = 0
+		p.releaseSnapshot()
+		rf.advanceCommitIndex()
+		rf.wakeCompactor()
+	} else if counted && args.LastIncludedIndex == p.snapshotIndex {
+		// 从follower确认的位置继续发送
+		p.snapshotOffset = reply.NextOffset
+	}
+}
@@ -0,0 +1,166 @@
+package raft
+
+//
+// chunked InstallSnapshot (paper §7, Figure 13).
+//
+// the leader sends its snapshot in chunks of at most snapshotChunkSize
+// bytes, one chunk in flight per follower. each reply tells the leader
+// the offset the follower expects next, so after a lost RPC or a
+// duplicate the leader resumes from there instead of starting over.
+// the follower stages the chunks until the chunk with Done arrives
+// and the snapshot is complete. every chunk carries the CRC of the
+// whole snapshot; if the staged data does not match it, the follower
+// drops it and asks for offset 0 again.
+//
+// a complete snapshot is not installed by Raft directly. the applier
+// delivers it to the service in order with the log entries, as an
+// ApplyMsg with SnapshotValid set, and the service then calls
+// rf.CondInstallSnapshot(term, index, snapshot). Raft refuses if it
+// has committed past index in the meantime, since those entries are
+// already on their way to the service; otherwise it trims its log and
+// the service switches to the snapshot. either way the service never
+// sees an entry that is older than the state it has installed.
+//
+// rf.SetSnapshotChunkSize(n)
+//   limit the size of each chunk the leader sends.
+// rf.CondInstallSnapshot(term, index, snapshot) bool
+//   switch to a snapshot delivered on applyCh.
+//
+
+import "cs651/trace"
+
+// 默认的快照分块大小(字节)
+const defaultSnapshotChunkSize = 64 * 1024
+
+// applier每次最多发送的日志条数
+const maxApplyBatch = 128
+
+// follower正在接收的快照
+type stagedSnapshot struct {
+	index int // 快照的LastIncludedIndex，没有时为0
+	term  int
+	sum   uint32 // leader发来的整个快照的校验和
+	data  []byte
+}
+
+// 接收完整、等待服务调用CondInstallSnapshot的快照
+type receivedSnapshot struct {
+	index      int
+	term       int
+	membership Membership
+	data       []byte
+	delivered  bool // 已经由applier发送给服务
+}
+
+// 服务收到SnapshotValid的ApplyMsg之后调用。
+// 返回true时Raft已经切换到这个快照，服务也应该切换；
+// 返回false时忽略这个快照，之后的日志会继续发送
+func (rf *Raft) CondInstallSnapshot(lastIncludedTerm int, lastIncludedIndex int, snapshot []byte) bool {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	r := rf.received
+	if r == nil || r.index != lastIncludedIndex || r.term != lastIncludedTerm {
+		// 已经被更新的快照代替
+		return false
+	}
+	rf.received = nil
+	// 快照传输结束，之前推迟的压缩可以继续
+	defer rf.wakeCompactor()
+	if lastIncludedIndex <= rf.commitIndex {
+		// 等待期间已经提交了这些日志，它们会由applier发送
+		DPrintf("Follower %v refuses snapshot at %v, commitIndex %v", rf.me, lastIncludedIndex, rf.commitIndex)
+		return false
+	}
+	DPrintf("Follower %v installs snapshot at lastIncludedIndex %v lastApplied %v", rf.me, lastIncludedIndex, rf.lastApplied)
+	rf.lastIncludedIndex = lastIncludedIndex
+	rf.lastIncludedTerm = lastIncludedTerm
+	// 应用于状态机的lastApplied更新为lastIncludedIndex
+	rf.lastApplied = lastIncludedIndex
+	rf.commitIndex = lastIncludedIndex
+	// lastIncludedIndex及之前的日志删除
+	rf.log.CompactPrefix(lastIncludedIndex, lastIncludedTerm)
+	rf.snapshotMembership = r.membership
+	rf.refreshMembership()
+	// 存储快照，删除快照包含的日志
+	rf.persistSnapshot(snapshot)
+	rf.lastCompaction = rf.now()
+	rf.incCounter(MetricSnapshotsInstalled)
+	rf.tracer.Emit(trace.Snapshot, rf.currentTerm, lastIncludedIndex, "installed size %v", len(snapshot))
+	return true
+}
+
+// 设置leader发送快照时每个分块的最大字节数
+func (rf *Raft) SetSnapshotChunkSize(n int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if n <= 0 {
+		n = defaultSnapshotChunkSize
+	}
+	rf.snapshotChunkSize = n
+}
+
+// 从follower确认的位置开始，取出要发给id的下一个分块。
+// 快照数据和校验和在开始发送时读取一次，之后的分块都从缓存中取
+// use it with lock
+func (rf *Raft) nextSnapshotChunk(id int, term int) InstallSnapshotArgs {
+	p := rf.progress[id]
+	// leader生成了新的快照，从头开始发送
+	if !p.snapshotCached || p.snapshotIndex != rf.lastIncludedIndex {
+		data := rf.persister.ReadSnapshot()
+		// witness不保存快照数据，只发送元数据
+		if rf.membership.isWitness(id) {
+			data = nil
+		}
+		p.snapshotIndex = rf.lastIncludedIndex
+		p.snapshotOffset = 0
+		p.snapshotData = data
+		p.snapshotSum = checksum(data)
+		p.snapshotCached = true
+	}
+	data := p.snapshotData
+	if p.snapshotOffset > len(data) {
+		p.snapshotOffset = 0
+	}
+	end := p.snapshotOffset + rf.snapshotChunkSize
+	if end > len(data) {
+		end = len(data)
+	}
+	return InstallSnapshotArgs{
+		Term:              term,
+		LeaderId:          rf.me,
+		LastIncludedIndex: rf.lastIncludedIndex,
+		LastIncludedTerm:  rf.lastIncludedTerm,
+		Offset:            p.snapshotOffset,
+		Data:              data[p.snapshotOffset:end],
+		Done:              end == len(data),
+		Membership:        rf.snapshotMembership.clone(),
+		Checksum:          p.snapshotSum,
+	}
+}
+
+// 快照发送完成或者不再需要时释放缓存的数据
+// use it with lock
+func (p *peerProgress) releaseSnapshot() {
+	p.snapshotData = nil
+	p.snapshotCached = false
+}
+
+// 把分块放入暂存区，返回下一个期望的偏移量。
+// 不连续的分块被丢弃，leader会从返回的偏移量重新发送
+// use it with lock
+func (rf *Raft) stageSnapshotChunk(args *InstallSnapshotArgs) int {
+	s := &rf.staging
+	if s.index != args.LastIncludedIndex || s.term != args.LastIncludedTerm || s.sum != args.Checksum || args.Offset == 0 {
+		if args.Offset != 0 {
+			// 不是同一个快照，需要从头开始
+			*s = stagedSnapshot{}
+			return 0
+		}
+		*s = stagedSnapshot{index: args.LastIncludedIndex, term: args.LastIncludedTerm, sum: args.Checksum}
+	}
+	if args.Offset != len(s.data) {
+		return len(s.data)
+	}
+	s.data = append(s.data, args.Data...)
+	return len(s.data)
+}
@@ -0,0 +1,115 @@
+package raft
+
+//
+// introspection and metrics.
+//
+// rf.Status() Status
+//   a consistent snapshot of this peer's view of the group.
+// rf.SetMetricsSink(sink)
+//   forward counters (elections started, votes granted, ...) to sink.
+//   the sink is called while Raft holds its lock, so it must not block.
+// rf.SetTraceSink(sink, group)
+//   send structured events to sink, see package trace.
+//
+
+import (
+	"cs651/trace"
+	"time"
+)
+
+// 计数器的名字
+const (
+	MetricElectionsStarted   = "raft_elections_started"
+	MetricVotesGranted       = "raft_votes_granted"
+	MetricAppendRejections   = "raft_append_entries_rejected"
+	MetricSnapshotsInstalled = "raft_snapshots_installed"
+	MetricQuorumLost         = "raft_check_quorum_step_downs"
+	MetricProposalBatches    = "raft_proposal_batches" // 提议被分成几批追加到日志中
+)
+
+// 接收Raft的计数器，例如导出到监控系统
+type MetricsSink interface {
+	IncCounter(name string, peer int)
+}
+
+type Status struct {
+	Id                int
+	Role              string
+	Term              int
+	LeaderId          int // 已知的leader，不知道时为-1
+	VotedFor          int
+	CommitIndex       int
+	LastApplied       int
+	LastIncludedIndex int
+	LastLogIndex      int
+	LogLength         int   // 快照之后的日志条数
+	NextIndex         []int // 只有leader有
+	MatchIndex        []int // 只有leader有
+	SinceHeartbeat    time.Duration
+	Membership        Membership
+	Counters          map[string]int
+}
+
+func (r Role) String() string {
+	switch r {
+	case Role_Leader:
+		return "leader"
+	case Role_Candidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// 返回当前状态的快照
+func (rf *Raft) Status() Status {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	lastLogIndex := rf.log.LastIndex()
+	st := Status{
+		Id:                rf.me,
+		Role:              rf.role.String(),
+		Term:              rf.currentTerm,
+		LeaderId:          rf.leaderId,
+		VotedFor:          rf.votedFor,
+		CommitIndex:       rf.commitIndex,
+		LastApplied:       rf.lastApplied,
+		LastIncludedIndex: rf.lastIncludedIndex,
+		LastLogIndex:      lastLogIndex,
+		LogLength:         lastLogIndex - rf.lastIncludedIndex,
+		SinceHeartbeat:    rf.since(rf.lastHeartBeatTime),
+		Membership:        rf.membership.clone(),
+		Counters:          map[string]int{},
+	}
+	if rf.role == Role_Leader {
+		st.NextIndex = append([]int{}, rf.nextIndex...)
+		st.MatchIndex = append([]int{}, rf.matchIndex...)
+	}
+	for name, v := range rf.counters {
+		st.Counters[name] = v
+	}
+	return st
+}
+
+// 设置接收计数器的sink，nil表示不导出
+func (rf *Raft) SetMetricsSink(sink MetricsSink) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.metrics = sink
+}
+
+// use it with lock
+func (rf *Raft) incCounter(name string) {
+	rf.counters[name]++
+	if rf.metrics != nil {
+		rf.metrics.IncCounter(name, rf.me)
+	}
+}
+
+// 设置接收结构化事件的sink，group是服务中Raft组的编号(shardkv的gid)。
+// nil表示不记录
+func (rf *Raft) SetTraceSink(sink trace.Sink, group int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.tracer = trace.NewTracer(sink, "raft", group, rf.me)
+}
@@ -0,0 +1,45 @@
+package raft
+
+//
+// stable storage for Raft's persistent state.
+//
+// Raft only ever changes its persistent state in three ways: a new
+// term or vote, new log entries (possibly replacing a conflicting
+// suffix), and a snapshot that replaces a prefix of the log. Storage
+// exposes exactly those operations, so an implementation can write
+// just what changed instead of the whole state.
+//
+// Persister keeps everything in memory (used by the tests);
+// FilePersister keeps it on disk and survives process restarts.
+//
+
+// term和投票信息
+type HardState struct {
+	Term     int
+	VotedFor int
+}
+
+// 快照对应的日志位置和成员配置
+type SnapshotMeta struct {
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Membership        Membership
+}
+
+type Storage interface {
+	// 保存term和votedFor
+	SaveHardState(term int, votedFor int)
+	// 追加日志，已保存的entries[0].Index及之后的日志先被删除
+	AppendLog(entries []Log)
+	// 保存快照，并删除LastIncludedIndex及之前的日志
+	SaveSnapshot(meta SnapshotMeta, snapshot []byte)
+	// 读出保存的状态，没有任何状态时ok为false
+	ReadState() (hs HardState, meta SnapshotMeta, entries []Log, ok bool)
+	// 读出[lo, hi)之间已经保存的日志
+	Entries(lo int, hi int) []Log
+	ReadSnapshot() []byte
+	RaftStateSize() int
+	SnapshotSize() int
+	// 检查保存的状态和快照的校验和，数据损坏时返回的错误是ErrCorrupt
+	Verify() error
+}
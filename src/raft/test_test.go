@@ -14,11 +14,19 @@ import "time"
 import "math/rand"
 import "sync/atomic"
 import "sync"
+import "os"
+import "path/filepath"
+import "syscall"
+import "flag"
+import "errors"
 
 // The tester generously allows solutions to complete elections in one second
 // (much more than the paper's range of timeouts).
 const RaftElectionTimeout = 1000 * time.Millisecond
 
+// 重放模拟测试中失败的种子：go test -run TestSim -seed N
+var simSeed = flag.Int64("seed", 0, "seed for the simulated tests, 0 picks new ones")
+
 func TestInitialElection2A(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
@@ -86,6 +94,80 @@ func TestReElection2A(t *testing.T) {
 	cfg.end()
 }
 
+// a leader cut off from the majority steps down by itself,
+// without seeing a higher term.
+func TestCheckQuorum2A(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2A): leader steps down without a quorum")
+
+	leader := cfg.checkOneLeader()
+
+	// isolate the leader together with one follower.
+	minority := []int{leader, (leader + 1) % servers}
+	for i := 0; i < servers; i++ {
+		if i != minority[0] && i != minority[1] {
+			for _, j := range minority {
+				cfg.net.Enable(cfg.endnames[i][j], false)
+				cfg.net.Enable(cfg.endnames[j][i], false)
+			}
+		}
+	}
+
+	time.Sleep(2 * RaftElectionTimeout)
+	if _, isLeader := cfg.rafts[leader].GetState(); isLeader {
+		t.Fatalf("leader %v kept leading without a quorum", leader)
+	}
+	if _, _, ok := cfg.rafts[leader].Start(1); ok {
+		t.Fatalf("old leader %v still accepts commands", leader)
+	}
+	if n := cfg.rafts[leader].Status().Counters[MetricQuorumLost]; n == 0 {
+		t.Fatalf("expected %v to count the step-down", MetricQuorumLost)
+	}
+
+	for i := 0; i < servers; i++ {
+		cfg.connect(i)
+	}
+	cfg.one(2, servers, true)
+
+	cfg.end()
+}
+
+func TestPreVoteRejoin2A(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2A): rejoining follower does not disrupt leader")
+
+	leader := cfg.checkOneLeader()
+	cfg.one(10, servers, false)
+	term1 := cfg.checkTerms()
+
+	for iters := 0; iters < 5; iters++ {
+		// partition a follower long enough for its election
+		// timer to fire several times, then heal it.
+		follower := (leader + 1 + iters%(servers-1)) % servers
+		cfg.disconnect(follower)
+		cfg.one(100+iters, servers-1, false)
+		time.Sleep(2 * RaftElectionTimeout)
+		cfg.connect(follower)
+
+		// the follower should catch up without forcing an election.
+		cfg.one(200+iters, servers, false)
+		if leader2 := cfg.checkOneLeader(); leader2 != leader {
+			t.Fatalf("leader changed from %v to %v after %v rejoined", leader, leader2, follower)
+		}
+		if term2 := cfg.checkTerms(); term2 != term1 {
+			t.Fatalf("term changed from %v to %v after %v rejoined", term1, term2, follower)
+		}
+	}
+
+	cfg.end()
+}
+
 func TestBasicAgree2B(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
@@ -368,6 +450,125 @@ func TestRejoin2B(t *testing.T) {
 	cfg.end()
 }
 
+func TestTransferLeadership2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): leadership transfer")
+
+	cfg.one(101, servers, true)
+
+	leader1 := cfg.checkOneLeader()
+	target := (leader1 + 1) % servers
+
+	t0 := time.Now()
+	if ok := cfg.rafts[leader1].TransferLeadership(target); !ok {
+		t.Fatalf("transfer from %v to %v failed", leader1, target)
+	}
+	if time.Since(t0) > RaftElectionTimeout {
+		t.Fatalf("transfer took %v", time.Since(t0))
+	}
+	if _, inProgress := cfg.rafts[leader1].GetTransferState(); inProgress {
+		t.Fatalf("transfer still in progress after it finished")
+	}
+
+	leader2 := cfg.checkOneLeader()
+	if leader2 != target {
+		t.Fatalf("expected %v to be the leader, got %v", target, leader2)
+	}
+
+	cfg.one(102, servers, true)
+
+	// the leader cannot hand leadership to itself.
+	if ok := cfg.rafts[leader2].TransferLeadership(leader2); ok {
+		t.Fatalf("transfer to the leader itself should fail")
+	}
+
+	// while a transfer is in progress GetState() does not report the
+	// leader; once it is given up, it does again.
+	target = (leader2 + 1) % servers
+	cfg.disconnect(target)
+	cfg.rafts[leader2].Start(103)
+	done := make(chan bool)
+	go func() { done <- cfg.rafts[leader2].TransferLeadership(target) }()
+	time.Sleep(50 * time.Millisecond)
+	if to, inProgress := cfg.rafts[leader2].GetTransferState(); !inProgress || to != target {
+		t.Fatalf("expected a transfer to %v in progress, got %v %v", target, to, inProgress)
+	}
+	if _, isLeader := cfg.rafts[leader2].GetState(); isLeader {
+		t.Fatalf("GetState() reports the leader during a transfer")
+	}
+	if ok := <-done; ok {
+		t.Fatalf("transfer to a disconnected peer succeeded")
+	}
+	if _, isLeader := cfg.rafts[leader2].GetState(); !isLeader {
+		t.Fatalf("leader %v does not report isLeader after the transfer was given up", leader2)
+	}
+	cfg.connect(target)
+	cfg.one(104, servers, true)
+
+	cfg.end()
+}
+
+type countingSink struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (cs *countingSink) IncCounter(name string, peer int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.counts[name]++
+}
+
+func (cs *countingSink) get(name string) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.counts[name]
+}
+
+func TestStatus2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	sink := &countingSink{counts: map[string]int{}}
+	for i := 0; i < servers; i++ {
+		cfg.rafts[i].SetMetricsSink(sink)
+	}
+
+	cfg.begin("Test (2B): status and metrics")
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+	st := cfg.rafts[leader].Status()
+	if st.Role != "leader" || st.LeaderId != leader {
+		t.Fatalf("leader reports %v", st)
+	}
+	if len(st.MatchIndex) != servers || st.MatchIndex[leader] < 1 || st.CommitIndex < 1 {
+		t.Fatalf("leader's replication state is wrong: %v", st)
+	}
+	for i := 0; i < servers; i++ {
+		fst := cfg.rafts[i].Status()
+		if fst.Term != st.Term || fst.LeaderId != leader {
+			t.Fatalf("server %v reports term %v leader %v, expected %v %v",
+				i, fst.Term, fst.LeaderId, st.Term, leader)
+		}
+	}
+
+	// a new election is reported to the sink.
+	cfg.disconnect(leader)
+	cfg.checkOneLeader()
+	if sink.get(MetricElectionsStarted) < 1 || sink.get(MetricVotesGranted) < 1 {
+		t.Fatalf("metrics were not reported: %v", sink.counts)
+	}
+	cfg.connect(leader)
+	cfg.one(102, servers, true)
+
+	cfg.end()
+}
+
 func TestBackup2B(t *testing.T) {
 	servers := 5
 	cfg := make_config(t, servers, false)
@@ -550,6 +751,227 @@ loop:
 	cfg.end()
 }
 
+func TestBatchedStarts2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): a burst of Start()s is batched")
+
+	cfg.one(1, servers, false)
+	leader := cfg.checkOneLeader()
+	term, _ := cfg.rafts[leader].GetState()
+
+	total1 := cfg.rpcTotal()
+	n := 200
+	last := -1
+	for i := 0; i < n; i++ {
+		index, term1, ok := cfg.rafts[leader].Start(100 + i)
+		if !ok || term1 != term {
+			t.Fatalf("leader %v lost leadership during the burst", leader)
+		}
+		last = index
+	}
+	if cmd := cfg.wait(last, servers, term); cmd != 100+n-1 {
+		t.Fatalf("wrong value %v committed at index %v", cmd, last)
+	}
+	total2 := cfg.rpcTotal()
+
+	// without batching every entry would cost at least
+	// one AppendEntries per follower.
+	if total2-total1 > n/2 {
+		t.Fatalf("too many RPCs (%v) for a burst of %v entries", total2-total1, n)
+	}
+
+	cfg.end()
+}
+
+// concurrent Start()s get distinct, consecutive indexes, and
+// the leader appends them to its log in a few batches.
+// a leader that steps down while Start() is being called refuses
+// new commands and appends nothing more once it is a follower.
+func TestStartStepDown2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): Start() racing with a step-down")
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+	cfg.disconnect(leader)
+	rf := cfg.rafts[leader]
+
+	var stop int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				rf.Start(rand.Int())
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	rf.mu.Lock()
+	rf.BecomeFollower(rf.currentTerm + 1)
+	last := rf.log.LastIndex()
+	rf.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if _, _, ok := rf.Start(102); ok {
+		t.Fatalf("server %v accepted a command after stepping down", leader)
+	}
+	rf.mu.Lock()
+	if rf.log.LastIndex() != last {
+		t.Fatalf("server %v appended up to index %v after stepping down at %v", leader, rf.log.LastIndex(), last)
+	}
+	rf.mu.Unlock()
+
+	cfg.connect(leader)
+	cfg.one(103, servers, true)
+
+	cfg.end()
+}
+
+func TestConcurrentProposals2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): concurrent Start()s share log appends")
+
+	cfg.one(1, servers, false)
+	leader := cfg.checkOneLeader()
+	rf := cfg.rafts[leader]
+	term, _ := rf.GetState()
+	batches0 := rf.Status().Counters[MetricProposalBatches]
+
+	n := 200
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	indexes := map[int]int{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(cmd int) {
+			defer wg.Done()
+			index, term1, ok := rf.Start(cmd)
+			if !ok || term1 != term {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := indexes[index]; ok {
+				t.Errorf("index %v returned twice", index)
+			}
+			indexes[index] = cmd
+		}(100 + i)
+	}
+	wg.Wait()
+	if len(indexes) != n {
+		t.Fatalf("leader %v lost leadership during the burst", leader)
+	}
+
+	first, last := -1, -1
+	for index := range indexes {
+		if first == -1 || index < first {
+			first = index
+		}
+		if index > last {
+			last = index
+		}
+	}
+	if last-first != n-1 {
+		t.Fatalf("indexes %v..%v for %v commands", first, last, n)
+	}
+	cfg.wait(last, servers, term)
+	for index, cmd := range indexes {
+		if _, cmd1 := cfg.nCommitted(index); cmd1 != cmd {
+			t.Fatalf("index %v committed %v, Start() returned it for %v", index, cmd1, cmd)
+		}
+	}
+
+	if batches := rf.Status().Counters[MetricProposalBatches] - batches0; batches > n/2 {
+		t.Fatalf("%v commands appended in %v batches", n, batches)
+	}
+
+	cfg.end()
+}
+
+func TestWitness2B(t *testing.T) {
+	servers := 3
+	witness := 2
+	cfg := make_witness_config(t, servers, []int{witness})
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2B): two replicas and a witness")
+
+	// the witness votes and acknowledges but applies nothing.
+	cfg.one(101, servers-1, true)
+	leader := cfg.checkOneLeader()
+	if leader == witness {
+		t.Fatalf("witness %v became leader", witness)
+	}
+
+	// commits continue with the other full replica down.
+	other := 1 - leader
+	cfg.disconnect(other)
+	index := cfg.one(102, 1, true)
+
+	// the leader fails while only it and the witness hold the entry.
+	// the witness catches the other replica up, so it is elected
+	// and keeps the entry.
+	cfg.disconnect(leader)
+	cfg.connect(other)
+	leader2 := cfg.checkOneLeader()
+	if leader2 != other {
+		t.Fatalf("expected %v to take over, got %v", other, leader2)
+	}
+	cfg.one(103, 1, true)
+	if _, cmd := cfg.nCommitted(index); cmd != 102 {
+		t.Fatalf("index %v holds %v instead of 102", index, cmd)
+	}
+
+	// the witness keeps the commands the failed replica lacks.
+	for i := 0; i < 2*witnessLogEntries; i++ {
+		cfg.one(200+i, 1, true)
+	}
+	old := cfg.rafts[leader]
+	old.mu.Lock()
+	oldLast := old.log.LastIndex()
+	old.mu.Unlock()
+	rf := cfg.rafts[witness]
+	rf.mu.Lock()
+	last := rf.log.LastIndex()
+	if rf.lastIncludedIndex > oldLast {
+		t.Fatalf("witness compacted to %v, beyond %v held by replica %v", rf.lastIncludedIndex, oldLast, leader)
+	}
+	for _, entry := range rf.log.Entries(oldLast+1, last+1) {
+		if entry.Command == nil {
+			t.Fatalf("witness dropped the command at index %v", entry.Index)
+		}
+	}
+	rf.mu.Unlock()
+
+	// once the replica is back, the witness compacts again.
+	cfg.connect(leader)
+	for i := 0; i < 2*witnessLogEntries; i++ {
+		cfg.one(300+i, servers-1, true)
+	}
+	rf.mu.Lock()
+	last = rf.log.LastIndex()
+	if last-rf.lastIncludedIndex > 2*witnessLogEntries {
+		t.Fatalf("witness keeps %v entries", last-rf.lastIncludedIndex)
+	}
+	rf.mu.Unlock()
+
+	cfg.end()
+}
+
 func TestPersist12C(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
@@ -974,3 +1396,566 @@ func TestReliableChurn2C(t *testing.T) {
 func TestUnreliableChurn2C(t *testing.T) {
 	internalChurn(t, true)
 }
+
+func TestFilePersister2C(t *testing.T) {
+	dir := t.TempDir()
+	fp, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, _, _, ok := fp.ReadState(); ok {
+		t.Fatalf("fresh FilePersister has state")
+	}
+
+	fmt.Printf("Test (2C): file persister recovery ...\n")
+
+	entries := []Log{}
+	for i := 1; i <= 10; i++ {
+		entries = append(entries, Log{Term: 1, Index: i, Command: i * 100})
+	}
+	fp.SaveHardState(1, 2)
+	fp.AppendLog(entries[:6])
+	fp.AppendLog(entries[6:])
+	// 替换冲突的后缀
+	fp.AppendLog([]Log{{Term: 2, Index: 8, Command: 800}, {Term: 2, Index: 9, Command: 900}})
+	fp.SaveSnapshot(SnapshotMeta{LastIncludedIndex: 3, LastIncludedTerm: 1,
+		Membership: bootstrapMembership(3)}, []byte("snap"))
+	fp.SaveHardState(2, -1)
+	fp.Close()
+
+	fp, err = MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer fp.Close()
+	hs, meta, log, ok := fp.ReadState()
+	if !ok || hs.Term != 2 || hs.VotedFor != -1 {
+		t.Fatalf("wrong hard state %v", hs)
+	}
+	if meta.LastIncludedIndex != 3 || meta.LastIncludedTerm != 1 || len(meta.Membership.Voters) != 3 {
+		t.Fatalf("wrong snapshot meta %v", meta)
+	}
+	if string(fp.ReadSnapshot()) != "snap" {
+		t.Fatalf("wrong snapshot %q", fp.ReadSnapshot())
+	}
+	if len(log) != 6 || log[0].Index != 4 || log[5].Index != 9 {
+		t.Fatalf("wrong log %v", log)
+	}
+	if log[4].Term != 2 || log[4].Command != 800 {
+		t.Fatalf("conflicting suffix not replaced: %v", log[4])
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestFilePersisterTornWrite2C(t *testing.T) {
+	dir := t.TempDir()
+	fp, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	fmt.Printf("Test (2C): file persister torn write ...\n")
+
+	for i := 1; i <= 5; i++ {
+		fp.AppendLog([]Log{{Term: 1, Index: i, Command: i}})
+	}
+	fp.Close()
+
+	// 模拟写最后一条记录时崩溃：只留下一部分
+	paths, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(paths) != 1 {
+		t.Fatalf("expected one segment, got %v", paths)
+	}
+	info, _ := os.Stat(paths[0])
+	if err := os.Truncate(paths[0], info.Size()-3); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	fp, err = MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	_, _, log, _ := fp.ReadState()
+	if len(log) != 4 || log[3].Index != 4 {
+		t.Fatalf("torn record not discarded: %v", log)
+	}
+	// 截断之后可以继续追加
+	fp.AppendLog([]Log{{Term: 2, Index: 5, Command: 55}})
+	fp.Close()
+
+	fp, err = MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer fp.Close()
+	_, _, log, _ = fp.ReadState()
+	if len(log) != 5 || log[4].Term != 2 || log[4].Command != 55 {
+		t.Fatalf("append after recovery lost: %v", log)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPersisterReplay2C(t *testing.T) {
+	fmt.Printf("Test (2C): persister replays incremental records ...\n")
+
+	ps := MakePersister()
+	for i := 1; i <= 10; i++ {
+		ps.AppendLog([]Log{{Term: 1, Index: i, Command: i}})
+		ps.SaveHardState(1, i%3)
+	}
+	// 替换冲突的后缀
+	ps.AppendLog([]Log{{Term: 2, Index: 7, Command: 70}})
+	ps.SaveHardState(2, -1)
+
+	// 崩溃重启：只留下raftstate的字节
+	np := &Persister{}
+	np.SaveRaftState(ps.ReadRaftState())
+	hs, _, log, ok := np.ReadState()
+	if !ok || hs.Term != 2 || hs.VotedFor != -1 {
+		t.Fatalf("wrong hard state %v", hs)
+	}
+	if len(log) != 7 || log[6].Term != 2 || log[6].Command != 70 {
+		t.Fatalf("wrong log after replay %v", log)
+	}
+
+	// 重启之后继续追加，再打快照
+	np.AppendLog([]Log{{Term: 2, Index: 8, Command: 80}})
+	np.SaveSnapshot(SnapshotMeta{LastIncludedIndex: 5, LastIncludedTerm: 1}, []byte("snap"))
+	cp := np.Copy()
+	_, meta, log, _ := cp.ReadState()
+	if meta.LastIncludedIndex != 5 || len(log) != 3 || log[0].Index != 6 || log[2].Command != 80 {
+		t.Fatalf("wrong state after snapshot %v %v", meta, log)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// the in-memory persister keeps only the tail of a long log on the
+// heap and reads older entries back from raftstate.
+func TestPersisterBoundedLog2C(t *testing.T) {
+	fmt.Printf("Test (2C): persister keeps a bounded log in memory ...\n")
+
+	ps := MakePersister()
+	n := 5 * persisterCachedEntries
+	for i := 1; i <= n; i++ {
+		ps.AppendLog([]Log{{Term: 1, Index: i, Command: i}})
+		if i%100 == 0 {
+			ps.SaveHardState(1, i%3)
+		}
+	}
+	if len(ps.state.log) > 2*persisterCachedEntries {
+		t.Fatalf("persister keeps %v of %v entries in memory", len(ps.state.log), n)
+	}
+	check := func(ps *Persister, lo int, hi int, term int) {
+		entries := ps.Entries(lo, hi)
+		if len(entries) != hi-lo {
+			t.Fatalf("Entries(%v, %v) returned %v entries", lo, hi, len(entries))
+		}
+		for i, e := range entries {
+			if e.Index != lo+i || e.Term != term || term == 1 && e.Command != e.Index {
+				t.Fatalf("Entries(%v, %v): wrong entry %v", lo, hi, e)
+			}
+		}
+	}
+	check(ps, 1, 50, 1)
+	check(ps, n-10, n+1, 1)
+
+	// a conflict far below the entries kept in memory.
+	ps.AppendLog([]Log{{Term: 2, Index: 100, Command: -1}, {Term: 2, Index: 101, Command: -1}})
+	check(ps, 90, 100, 1)
+	check(ps, 100, 102, 2)
+	if entries := ps.Entries(1, n+1); len(entries) != 101 {
+		t.Fatalf("log has %v entries after the conflict, expected 101", len(entries))
+	}
+
+	for i := 102; i <= n; i++ {
+		ps.AppendLog([]Log{{Term: 2, Index: i, Command: -1}})
+	}
+	ps.SaveSnapshot(SnapshotMeta{LastIncludedIndex: 50, LastIncludedTerm: 1}, []byte("snap"))
+	if len(ps.state.log) > 2*persisterCachedEntries {
+		t.Fatalf("persister keeps %v entries in memory after a snapshot", len(ps.state.log))
+	}
+	np := &Persister{}
+	np.SaveRaftState(ps.ReadRaftState())
+	hs, meta, log, ok := np.ReadState()
+	if !ok || hs.Term != 1 || meta.LastIncludedIndex != 50 || len(log) != n-50 || log[0].Index != 51 {
+		t.Fatalf("wrong state after restart: %v %v %v entries", hs, meta, len(log))
+	}
+	check(np, 60, 99, 1)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestChecksums2C(t *testing.T) {
+	fmt.Printf("Test (2C): corrupted state is detected ...\n")
+
+	// a flipped bit anywhere in raftstate or the snapshot.
+	ps := MakePersister()
+	for i := 1; i <= 10; i++ {
+		ps.AppendLog([]Log{{Term: 1, Index: i, Command: i}})
+	}
+	ps.SaveSnapshot(SnapshotMeta{LastIncludedIndex: 3, LastIncludedTerm: 1}, []byte("snap"))
+	ps.AppendLog([]Log{{Term: 1, Index: 11, Command: 11}})
+	if err := ps.Copy().Verify(); err != nil {
+		t.Fatalf("good state fails verification: %v", err)
+	}
+	state := ps.ReadRaftState()
+	for _, offset := range []int{0, len(state) / 2, len(state) - 1} {
+		bad := append([]byte{}, state...)
+		bad[offset] ^= 0x10
+		np := &Persister{}
+		np.SaveRaftState(bad)
+		if err := np.Verify(); err == nil {
+			t.Fatalf("corrupted byte %v of raftstate not detected", offset)
+		}
+	}
+	np := ps.Copy()
+	np.snapshot = append([]byte{}, np.snapshot...)
+	np.snapshot[1] ^= 0x10
+	if err := np.Verify(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("corrupted snapshot not detected: %v", err)
+	}
+
+	// a bad record in the middle of a WAL segment is corruption,
+	// not a torn write, and must not be cut off.
+	dir := t.TempDir()
+	fp, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 1; i <= 5; i++ {
+		fp.AppendLog([]Log{{Term: 1, Index: i, Command: i}})
+	}
+	fp.SaveHardState(1, 0)
+	fp.SaveSnapshot(SnapshotMeta{LastIncludedIndex: 1, LastIncludedTerm: 1}, []byte("snap"))
+	if err := fp.Verify(); err != nil {
+		t.Fatalf("good files fail verification: %v", err)
+	}
+	fp.Close()
+	for _, name := range []string{"wal-*.log", "state", "snapshot"} {
+		paths, _ := filepath.Glob(filepath.Join(dir, name))
+		if len(paths) != 1 {
+			t.Fatalf("expected one %v, got %v", name, paths)
+		}
+		data, _ := os.ReadFile(paths[0])
+		good := append([]byte{}, data...)
+		data[len(data)/2] ^= 0x10
+		os.WriteFile(paths[0], data, 0644)
+		if _, err := MakeFilePersister(dir); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("corrupted %v not detected: %v", name, err)
+		}
+		os.WriteFile(paths[0], good, 0644)
+	}
+	fp, err = MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer fp.Close()
+	if _, _, log, _ := fp.ReadState(); len(log) != 4 {
+		t.Fatalf("wrong log after restoring the files: %v", log)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a follower drops a snapshot that does not match its checksum,
+// and asks the leader to send it again from the start.
+func TestSnapshotChecksum2D(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (2D): corrupted InstallSnapshot is dropped")
+
+	cfg.one(1, servers, true)
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % servers
+	term, _ := cfg.rafts[leader].GetState()
+
+	data := []byte("a snapshot")
+	args := InstallSnapshotArgs{
+		Term:              term,
+		LeaderId:          leader,
+		LastIncludedIndex: 100,
+		LastIncludedTerm:  term,
+		Data:              data,
+		Done:              true,
+		Checksum:          checksum([]byte("another snapshot")),
+	}
+	reply := InstallSnapshotReply{}
+	rf := cfg.rafts[follower]
+	rf.InstallSnapshot(&args, &reply)
+	if reply.NextOffset != 0 {
+		t.Fatalf("follower expects offset %v after a corrupted snapshot", reply.NextOffset)
+	}
+	rf.mu.Lock()
+	received, staged := rf.received, len(rf.staging.data)
+	rf.mu.Unlock()
+	if received != nil || staged != 0 {
+		t.Fatalf("follower kept the corrupted snapshot")
+	}
+
+	cfg.one(2, servers, true)
+
+	cfg.end()
+}
+
+// 每次追加一条日志的代价不应随日志长度增长
+func BenchmarkPersistAppend(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("log=%d", n), func(b *testing.B) {
+			ps := MakePersister()
+			entries := make([]Log, n)
+			for i := range entries {
+				entries[i] = Log{Term: 1, Index: i + 1, Command: i}
+			}
+			ps.AppendLog(entries)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ps.AppendLog([]Log{{Term: 1, Index: n + i + 1, Command: i}})
+				ps.SaveHardState(1, i%3)
+			}
+		})
+	}
+}
+
+// 空闲集群的CPU占用：选举计时器只在超时时触发，CPU只花在心跳上
+func BenchmarkIdleCluster(b *testing.B) {
+	cfg := make_config(b, 5, false)
+	defer cfg.cleanup()
+	cfg.checkOneLeader()
+
+	var before, after syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &before)
+	start := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	b.StopTimer()
+	wall := time.Since(start)
+	syscall.Getrusage(syscall.RUSAGE_SELF, &after)
+	cpu := after.Utime.Nano() + after.Stime.Nano() - before.Utime.Nano() - before.Stime.Nano()
+	b.ReportMetric(float64(cpu)/float64(wall.Nanoseconds()), "cpu/wall")
+}
+
+// 从leader断开到其余节点选出新leader的时间
+func BenchmarkElectionConvergence(b *testing.B) {
+	cfg := make_config(b, 5, false)
+	defer cfg.cleanup()
+	leader := cfg.checkOneLeader()
+
+	var total time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		oldTerm, _ := cfg.rafts[leader].GetState()
+		cfg.disconnect(leader)
+		start := time.Now()
+		next := -1
+		for next == -1 {
+			if time.Since(start) > RaftElectionTimeout {
+				b.Fatalf("no leader elected after %v", RaftElectionTimeout)
+			}
+			time.Sleep(time.Millisecond)
+			for j := 0; j < cfg.n; j++ {
+				if term, isLeader := cfg.rafts[j].GetState(); cfg.connected[j] && isLeader && term > oldTerm {
+					next = j
+				}
+			}
+		}
+		total += time.Since(start)
+
+		b.StopTimer()
+		cfg.connect(leader)
+		cfg.one(i, cfg.n, true)
+		leader = next
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(total.Milliseconds())/float64(b.N), "ms/election")
+}
+
+func TestLogCache2C(t *testing.T) {
+	fmt.Printf("Test (2C): bounded log cache ...\n")
+
+	ps := MakePersister()
+	rl := makeRaftLog(ps, 0, 0, nil)
+	n := 4 * maxCachedEntries
+	for i := 1; i <= n; i++ {
+		entry := Log{Term: 1 + i/1000, Index: i, Command: i}
+		rl.Append([]Log{entry})
+		ps.AppendLog([]Log{entry})
+		rl.persistedTo(i)
+	}
+	if len(rl.cache) >= 2*maxCachedEntries {
+		t.Fatalf("cache holds %v entries", len(rl.cache))
+	}
+	// 旧日志从persister读取
+	entries := rl.Entries(10, 20)
+	if len(entries) != 10 || entries[0].Index != 10 || entries[9].Command != 19 {
+		t.Fatalf("wrong entries %v", entries)
+	}
+	if rl.Term(999) != 1 || rl.Term(1000) != 2 || rl.Term(n+1) != -1 {
+		t.Fatalf("wrong terms")
+	}
+
+	rl.TruncateSuffix(n - 10)
+	rl.Append([]Log{{Term: 9, Index: n - 10, Command: -1}})
+	if rl.LastIndex() != n-10 || rl.Term(n-10) != 9 || rl.lastIndexOfTerm(9) != n-10 {
+		t.Fatalf("wrong log after truncation")
+	}
+	rl.CompactPrefix(2000, rl.Term(2000))
+	if rl.FirstIndex() != 2001 || rl.Term(2000) != 3 || rl.firstIndexOfTerm(1) != -1 {
+		t.Fatalf("wrong log after compaction")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCompactionPolicy2D(t *testing.T) {
+	fmt.Printf("Test (2D): compaction policies ...\n")
+
+	s := CompactionStats{StateSize: 5000, Entries: 50, SinceLast: time.Second}
+	if !SizePolicy(4000).ShouldCompact(s) || SizePolicy(5000).ShouldCompact(s) {
+		t.Fatalf("wrong size policy")
+	}
+	if !EntryCountPolicy(10).ShouldCompact(s) || EntryCountPolicy(50).ShouldCompact(s) {
+		t.Fatalf("wrong entry count policy")
+	}
+	if !IntervalPolicy(500*time.Millisecond).ShouldCompact(s) || IntervalPolicy(2*time.Second).ShouldCompact(s) {
+		t.Fatalf("wrong interval policy")
+	}
+	// 没有新日志时不需要压缩
+	if IntervalPolicy(0).ShouldCompact(CompactionStats{SinceLast: time.Hour}) {
+		t.Fatalf("interval policy compacts an empty log")
+	}
+	if !(AnyPolicy{SizePolicy(9000), EntryCountPolicy(10)}).ShouldCompact(s) ||
+		(AnyPolicy{SizePolicy(9000), EntryCountPolicy(100)}).ShouldCompact(s) {
+		t.Fatalf("wrong combined policy")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// 模拟测试使用的种子，指定了-seed时只运行这一个
+func simSeeds(n int) []int64 {
+	if *simSeed != 0 {
+		return []int64{*simSeed}
+	}
+	seeds := []int64{}
+	for i := 0; i < n; i++ {
+		seeds = append(seeds, makeSeed())
+	}
+	return seeds
+}
+
+// Figure 8：不可靠的网络、长时间的乱序，leader不断断开，节点不断崩溃重启。
+// 所有的随机选择都来自cfg的随机数
+func simFigure8(cfg *config, iters int) {
+	servers := cfg.n
+	cfg.one(cfg.intn(10000), 1, true)
+
+	nup := servers
+	for i := 0; i < iters; i++ {
+		if i == iters/5 {
+			cfg.setlongreordering(true)
+		}
+		leader := -1
+		for j := 0; j < servers; j++ {
+			if cfg.rafts[j] != nil {
+				_, _, ok := cfg.rafts[j].Start(cfg.intn(10000))
+				if ok && cfg.connected[j] {
+					leader = j
+				}
+			}
+		}
+
+		if cfg.intn(1000) < 100 {
+			ms := cfg.int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
+			cfg.sleep(time.Duration(ms) * time.Millisecond)
+		} else {
+			cfg.sleep(time.Duration(cfg.int63()%13) * time.Millisecond)
+		}
+
+		if leader != -1 && cfg.intn(1000) < int(RaftElectionTimeout/time.Millisecond)/2 {
+			if cfg.intn(2) == 0 {
+				cfg.crash1(leader)
+			} else {
+				cfg.disconnect(leader)
+			}
+			nup -= 1
+		}
+
+		if nup < 3 {
+			s := cfg.intn(servers)
+			if cfg.rafts[s] == nil {
+				cfg.start1(s)
+				cfg.connect(s)
+				nup += 1
+			} else if cfg.connected[s] == false {
+				cfg.connect(s)
+				nup += 1
+			}
+		}
+	}
+
+	for i := 0; i < servers; i++ {
+		if cfg.rafts[i] == nil {
+			cfg.start1(i)
+		}
+		if cfg.connected[i] == false {
+			cfg.connect(i)
+		}
+	}
+
+	cfg.one(cfg.intn(10000), servers, true)
+}
+
+func TestSimFigure8Unreliable2C(t *testing.T) {
+	for _, seed := range simSeeds(3) {
+		t.Logf("seed %v", seed)
+		cfg := make_sim_config(t, 5, true, seed)
+		cfg.run(func() {
+			cfg.begin(fmt.Sprintf("Test (2C): simulated Figure 8 (unreliable), seed %v", seed))
+			simFigure8(cfg, 1000)
+			cfg.end()
+		})
+		cfg.cleanup()
+		if t.Failed() {
+			break
+		}
+	}
+}
+
+// 同一个种子两次运行的调度顺序和提交的日志完全相同
+func TestSimReplay2C(t *testing.T) {
+	seed := simSeeds(1)[0]
+	t.Logf("seed %v", seed)
+	fmt.Printf("Test (2C): simulated runs replay, seed %v ...\n", seed)
+
+	run := func() (uint64, int, map[int]interface{}) {
+		cfg := make_sim_config(t, 5, true, seed)
+		cfg.run(func() {
+			simFigure8(cfg, 200)
+		})
+		cfg.cleanup()
+		return cfg.sim.Fingerprint(), cfg.sim.Steps(), cfg.logs[0]
+	}
+
+	fp1, steps1, log1 := run()
+	fp2, steps2, log2 := run()
+	if fp1 != fp2 || steps1 != steps2 {
+		t.Fatalf("schedules differ: %v steps (%x) and %v steps (%x)", steps1, fp1, steps2, fp2)
+	}
+	if len(log1) != len(log2) {
+		t.Fatalf("committed %v and %v entries", len(log1), len(log2))
+	}
+	for index, cmd := range log1 {
+		if log2[index] != cmd {
+			t.Fatalf("index %v committed %v and %v", index, cmd, log2[index])
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
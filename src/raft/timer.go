@@ -0,0 +1,48 @@
+package raft
+
+//
+// the election timer.
+//
+// instead of a loop that sleeps and then checks how long ago the last
+// heartbeat arrived, each peer has one timer that is reset whenever it
+// hears from a leader, grants a vote or starts an election. it fires
+// only when the election timeout really elapsed, so an idle follower
+// does not wake up at all between heartbeats. a leader uses the same
+// timer to run CheckQuorum once per election timeout.
+//
+
+import "time"
+
+// 重新开始计时，使用新的随机选举超时
+// use it with lock
+func (rf *Raft) resetElectionTimer() {
+	rf.timeout = rf.randTimeout()
+	d := time.Duration(rf.timeout) * time.Millisecond
+	rf.electionDeadline = rf.now().Add(d)
+	rf.electionTimer.Reset(d)
+}
+
+// 计时器到期时在自己的goroutine中调用
+func (rf *Raft) electionTimerFired() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.killed() {
+		return
+	}
+	if rf.role == Role_Leader {
+		rf.checkQuorum()
+		// 退位时BecomeFollower已经重新计时
+		if rf.role == Role_Leader {
+			rf.electionTimer.Reset(time.Duration(electionTimeout) * time.Millisecond)
+		}
+		return
+	}
+	// 计时器被重置之前已经到期，回调仍然会运行一次
+	if wait := rf.electionDeadline.Sub(rf.now()); wait > 0 {
+		rf.electionTimer.Reset(wait)
+		return
+	}
+	// 预投票失败或者不能参加选举时，下一个超时之后再试
+	rf.resetElectionTimer()
+	rf.electionTimeoutElapsed()
+}
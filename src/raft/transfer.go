@@ -0,0 +1,143 @@
+package raft
+
+//
+// leadership transfer (thesis §3.10).
+//
+// rf.TransferLeadership(target)
+//   hand leadership to peers[target]. the leader stops accepting new
+//   commands, waits until the target's log is up to date, then sends
+//   it a TimeoutNow RPC so it starts an election right away. while
+//   the transfer is in progress GetState() does not report isLeader,
+//   so services send their clients elsewhere, as Start() would.
+// rf.GetTransferState() (target, inProgress)
+//   ask whether a transfer is in progress, and to whom.
+//
+
+import "time"
+
+// 领导权转移的目标，没有进行中的转移时为-1
+const noTransfer = -1
+
+type TimeoutNowArgs struct {
+	Term     int
+	LeaderId int
+}
+
+type TimeoutNowReply struct {
+	Term int
+}
+
+// 返回正在进行的领导权转移的目标，以及是否有转移在进行中。
+// 转移期间GetState()报告不是leader
+func (rf *Raft) GetTransferState() (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.transferTarget, rf.transferTarget != noTransfer
+}
+
+// TransferLeadership 把领导权交给peers[target]，只能由leader调用。
+// 转移期间Start()拒绝新的命令；如果在一个选举超时内没有完成，转移被放弃，
+// leader继续正常工作。只有在更高的term中确认target成为了leader时才返回true，
+// 选举超时内没有得到确认或者别的peer赢得了选举时返回false
+func (rf *Raft) TransferLeadership(target int) bool {
+	rf.mu.Lock()
+	if rf.role != Role_Leader || rf.transferTarget != noTransfer ||
+		target == rf.me || !rf.membership.isVoter(target) || rf.membership.isWitness(target) {
+		rf.mu.Unlock()
+		return false
+	}
+	term := rf.currentTerm
+	rf.transferTarget = target
+	// 已经排队的提议先追加并发送给target
+	rf.closeProposals()
+	rf.flushLog()
+	DPrintf("Leader %v starts transferring leadership to %v at term %v", rf.me, target, term)
+	rf.mu.Unlock()
+
+	defer func() {
+		rf.mu.Lock()
+		if rf.currentTerm == term {
+			rf.transferTarget = noTransfer
+			if rf.role == Role_Leader {
+				rf.resumeProposals()
+			}
+		}
+		rf.mu.Unlock()
+	}()
+
+	deadline := rf.now().Add(time.Duration(electionTimeout) * time.Millisecond)
+	// 等待target的日志追上leader
+	for {
+		if rf.killed() || rf.now().After(deadline) {
+			DPrintf("Leader %v gives up transferring leadership to %v", rf.me, target)
+			return false
+		}
+		rf.mu.Lock()
+		if rf.currentTerm != term || rf.role != Role_Leader {
+			rf.mu.Unlock()
+			return false
+		}
+		lastLogIndex, _ := rf.getLastLogInfo() // ok
+		if rf.matchIndex[target] >= lastLogIndex {
+			rf.mu.Unlock()
+			break
+		}
+		rf.mu.Unlock()
+		rf.sleep(10 * time.Millisecond)
+	}
+
+	args := TimeoutNowArgs{
+		Term:     term,
+		LeaderId: rf.me,
+	}
+	reply := TimeoutNowReply{}
+	if ok := rf.sendTimeoutNow(target, &args, &reply); !ok {
+		return false
+	}
+	rf.mu.Lock()
+	if reply.Term > rf.currentTerm {
+		rf.BecomeFollower(reply.Term)
+	}
+	rf.mu.Unlock()
+
+	// 等待target赢得选举：leader收到更高term后退位，之后收到target作为新leader
+	// 发来的AppendEntries才算转移成功。别的peer赢得了选举时返回false
+	deadline = rf.now().Add(time.Duration(electionTimeout) * time.Millisecond)
+	for !rf.killed() && rf.now().Before(deadline) {
+		rf.mu.Lock()
+		if rf.currentTerm == term && rf.role != Role_Leader {
+			rf.mu.Unlock()
+			return false
+		}
+		if rf.currentTerm > term && rf.leaderId != -1 {
+			won := rf.leaderId == target
+			rf.mu.Unlock()
+			DPrintf("Leader %v transferred leadership to %v: %v", rf.me, target, won)
+			return won
+		}
+		rf.mu.Unlock()
+		rf.sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// target收到TimeoutNow，不等选举超时、也不进行预投票，立即开始选举
+func (rf *Raft) TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if args.Term > rf.currentTerm {
+		rf.BecomeFollower(args.Term)
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm || !rf.membership.isVoter(rf.me) || rf.membership.isWitness(rf.me) {
+		return
+	}
+	DPrintf("Instance %v receives TimeoutNow from %v at term %v", rf.me, args.LeaderId, args.Term)
+	rf.BecomeCandidate()
+	rf.spawn(rf.StartElection)
+}
+
+func (rf *Raft) sendTimeoutNow(server int, args *TimeoutNowArgs, reply *TimeoutNowReply) bool {
+	ok := rf.peers[server].Call("Raft.TimeoutNow", args, reply)
+	return ok
+}
@@ -0,0 +1,159 @@
+package raft
+
+//
+// witnesses: voters that keep log metadata but no commands.
+//
+// a witness votes and acknowledges AppendEntries like any other voter,
+// so it counts toward elections, commits and CheckQuorum, but it never
+// starts an election, never becomes leader and has no state machine:
+// committed entries are skipped instead of applied, and its log is
+// compacted without a snapshot. two full replicas plus a witness
+// tolerate one failure while storing only a short tail of the log on
+// the third peer.
+//
+// the leader may commit an entry that only it and the witness hold, so
+// the witness keeps the commands of entries until they are on every
+// full replica. AppendEntriesArgs.ReplicatedIndex tells it how far that
+// is: the leader strips commands up to it (membership entries are kept,
+// Raft itself needs them) and the witness compacts only up to it. if
+// the leader fails, the remaining full replica asks the witness for its
+// vote, is refused because its log is behind, and gets the missing
+// entries in the reply. it appends them and wins the next election.
+//
+// MakeWithWitnesses(...)
+//   like Make(), but the peers listed in witnesses start as witnesses.
+//   every peer must be created with the same list.
+//
+// a witness stays a witness: AddServer() on it is a no-op, and
+// RemoveServer() removes it from the group.
+//
+
+import (
+	"cs651/labrpc"
+	"cs651/trace"
+)
+
+const (
+	// witness中可以压缩的日志超过这么多条之后压缩
+	witnessLogEntries = 64
+	// witness拒绝投票时最多附带这么多条日志，候选人在之后的选举中继续追赶
+	witnessCatchUpEntries = 1024
+)
+
+// MakeWithWitnesses 创建一个Raft节点，peers中下标在witnesses中的节点是witness，
+// 其余的是普通的voter
+func MakeWithWitnesses(peers []*labrpc.ClientEnd, me int,
+	persister Storage, applyCh chan ApplyMsg, witnesses []int) *Raft {
+	m := bootstrapMembership(len(peers))
+	m.Witnesses = append(m.Witnesses, witnesses...)
+	return makeRaft(peers, me, persister, applyCh, m, nil)
+}
+
+// 返回去掉了index不超过upTo的日志的命令之后的日志，成员配置的日志保持不变
+func stripPayloads(entries []Log, upTo int) []Log {
+	stripped := make([]Log, len(entries))
+	for i, entry := range entries {
+		stripped[i] = entry
+		if entry.Index > upTo {
+			continue
+		}
+		stripped[i] = Log{Term: entry.Term, Index: entry.Index}
+		if m, ok := entry.Command.(Membership); ok {
+			stripped[i].Command = m
+		}
+	}
+	return stripped
+}
+
+// leader返回已经复制到所有完整副本(不是witness的voter)并且已经提交的日志索引，
+// 发给witness时只去掉这之前的日志的命令
+// use it with lock
+func (rf *Raft) replicatedIndex() int {
+	index := rf.commitIndex
+	for _, id := range rf.membership.Voters {
+		if !rf.membership.isWitness(id) && rf.matchIndex[id] < index {
+			index = rf.matchIndex[id]
+		}
+	}
+	return index
+}
+
+// witness跳过已提交的日志，并在可以压缩的日志足够多时压缩。
+// 还不在所有完整副本上的日志保留下来，用于追赶新的leader
+// use it with lock
+func (rf *Raft) skipWitnessEntries() {
+	rf.lastApplied = rf.commitIndex
+	upTo := rf.lastApplied
+	if rf.witnessSafeIndex < upTo {
+		upTo = rf.witnessSafeIndex
+	}
+	if upTo-rf.lastIncludedIndex >= witnessLogEntries {
+		rf.compactLog(nil, upTo)
+	}
+}
+
+// witness因为候选人的日志不够新而拒绝投票时，返回候选人可能缺少的日志：
+// 最后一条被去掉命令的日志之后的日志都带有命令。
+// 候选人的最后一条日志与自己的匹配时，从它之后开始发送
+// use it with lock
+func (rf *Raft) witnessCatchUp(lastLogIndex int, lastLogTerm int) (int, int, []Log) {
+	last := rf.log.LastIndex()
+	prev := rf.lastIncludedIndex
+	entries := rf.log.Entries(prev+1, last+1)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Command == nil {
+			prev = entries[i].Index
+			break
+		}
+	}
+	if lastLogIndex > prev && lastLogIndex <= last && rf.log.Term(lastLogIndex) == lastLogTerm {
+		prev = lastLogIndex
+	}
+	hi := last + 1
+	if hi-prev-1 > witnessCatchUpEntries {
+		hi = prev + 1 + witnessCatchUpEntries
+	}
+	return prev, rf.log.Term(prev), rf.log.Entries(prev+1, hi)
+}
+
+// 候选人追加witness拒绝投票时附带的日志，就像收到了leader的AppendEntries。
+// 只有这些日志接在自己的日志上，并且比自己的日志更新时才追加：
+// 更新的日志一定包含了自己已经提交的所有日志，冲突时不会截断它们
+// use it with lock
+func (rf *Raft) adoptCatchUp(prevIndex int, prevTerm int, entries []Log) {
+	if len(entries) == 0 || rf.role == Role_Leader || rf.membership.isWitness(rf.me) {
+		return
+	}
+	if prevIndex < rf.lastIncludedIndex || rf.log.Term(prevIndex) != prevTerm {
+		return
+	}
+	last := entries[len(entries)-1]
+	myLastLogIndex, myLastLogTerm := rf.getLastLogInfo() // ok
+	if last.Term < myLastLogTerm || last.Term == myLastLogTerm && last.Index <= myLastLogIndex {
+		return
+	}
+	changedFrom, truncated := rf.mergeEntries(entries)
+	if changedFrom != -1 {
+		DPrintf("Instance %v catches up to %v from a witness", rf.me, rf.log.LastIndex())
+		rf.tracer.Emit(trace.EntriesAppended, rf.currentTerm, rf.log.LastIndex(),
+			"from %v witness truncated %v", changedFrom, truncated)
+	}
+}
+
+// witness直接安装快照的位置和成员配置
+// use it with lock
+func (rf *Raft) installWitnessSnapshot(args *InstallSnapshotArgs) {
+	DPrintf("Witness %v installs snapshot metadata at lastIncludedIndex %v", rf.me, args.LastIncludedIndex)
+	rf.staging = stagedSnapshot{}
+	rf.lastIncludedIndex = args.LastIncludedIndex
+	rf.lastIncludedTerm = args.LastIncludedTerm
+	rf.lastApplied = args.LastIncludedIndex
+	rf.commitIndex = args.LastIncludedIndex
+	rf.log.CompactPrefix(args.LastIncludedIndex, args.LastIncludedTerm)
+	rf.snapshotMembership = args.Membership
+	rf.refreshMembership()
+	rf.persistSnapshot(nil)
+	rf.lastCompaction = rf.now()
+	rf.incCounter(MetricSnapshotsInstalled)
+	rf.tracer.Emit(trace.Snapshot, rf.currentTerm, args.LastIncludedIndex, "witness installed metadata")
+}
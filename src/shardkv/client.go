@@ -118,6 +118,7 @@ func (ck *Clerk) PutAppend(key string, value string, op string) {
 	args.SeqNum = ck.GetSeqNumber()
 
 	for {
+		args.CfgNum = ck.config.Num
 		shard := key2shard(key)
 		gid := ck.config.Shards[shard]
 		if servers, ok := ck.config.Groups[gid]; ok {
@@ -146,3 +147,54 @@ func (ck *Clerk) Put(key string, value string) {
 func (ck *Clerk) Append(key string, value string) {
 	ck.PutAppend(key, value, "Append")
 }
+
+// 删除key，之后Get返回""，直到它再次被写入
+func (ck *Clerk) Delete(key string) {
+	ck.PutAppend(key, "", "Delete")
+}
+
+// 把gid组的第server个节点加入该组的raft集群，例如替换宕机的机器。
+// 换leader重试直到成功或者得到确定的错误；
+// 返回ErrCatchUpTimeout时它已经是learner，可以再次调用AddServer
+func (ck *Clerk) AddServer(gid int, server int) Err {
+	return ck.changeMembership("ShardKV.AddServer", gid, server)
+}
+
+// 把gid组的第server个节点作为learner加入该组的raft集群，之后可以用AddServer把它变成voter
+func (ck *Clerk) AddLearner(gid int, server int) Err {
+	return ck.changeMembership("ShardKV.AddLearner", gid, server)
+}
+
+// 把gid组的第server个节点移出该组的raft集群，换leader重试直到成功或者得到确定的错误
+func (ck *Clerk) RemoveServer(gid int, server int) Err {
+	return ck.changeMembership("ShardKV.RemoveServer", gid, server)
+}
+
+func (ck *Clerk) changeMembership(method string, gid int, server int) Err {
+	args := MembershipArgs{Server: server}
+	for {
+		if servers, ok := ck.config.Groups[gid]; ok {
+			for si := 0; si < len(servers); {
+				srv := ck.make_end(servers[si])
+				var reply MembershipReply
+				ok := srv.Call(method, &args, &reply)
+				if ok {
+					switch reply.Err {
+					case OK, ErrCatchUpTimeout, ErrLastVoter, ErrUnknownServer:
+						DPrintf("Client %v %v(%v, %v): %v", ck.id, method, gid, server, reply.Err)
+						return reply.Err
+					case ErrChangePending:
+						// 等上一个成员变更提交之后在同一个leader上重试
+						time.Sleep(100 * time.Millisecond)
+						continue
+					}
+				}
+				// ... not ok, or ErrWrongLeader
+				si++
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		// ask master for the latest configuration.
+		ck.config = ck.sm.Query(-1)
+	}
+}
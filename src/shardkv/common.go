@@ -15,16 +15,21 @@ const (
 	ErrNoKey       = "ErrNoKey"
 	ErrWrongGroup  = "ErrWrongGroup"
 	ErrWrongLeader = "ErrWrongLeader"
+	// 成员变更失败的原因
+	ErrChangePending  = "ErrChangePending"  // 上一个成员变更还没有提交，稍后重试
+	ErrCatchUpTimeout = "ErrCatchUpTimeout" // 新节点没有及时追上日志，它仍然是learner
+	ErrLastVoter      = "ErrLastVoter"      // 不能移除最后一个voter
+	ErrUnknownServer  = "ErrUnknownServer"  // servers中没有这个节点
 )
 
 type Err string
 
-// Put or Append
+// Put, Append or Delete
 type PutAppendArgs struct {
 	// You'll have to add definitions here.
 	Key   string
 	Value string
-	Op    string // "Put" or "Append"
+	Op    string // "Put", "Append" or "Delete"
 	// You'll have to add definitions here.
 	// Field names must start with capital letters,
 	// otherwise RPC will break.
@@ -71,3 +76,22 @@ type GarbageCollectionArgs struct {
 type GarbageCollectionReply struct {
 	Err Err // OK or Wrong Group
 }
+
+// AddServer or RemoveServer
+// Server是要加入或移除的节点在本组servers中的下标
+type MembershipArgs struct {
+	Server int
+}
+
+type MembershipReply struct {
+	Err Err
+}
+
+// 把本组的leader转移到servers[Server]
+type TransferLeaderArgs struct {
+	Server int
+}
+
+type TransferLeaderReply struct {
+	Err Err
+}
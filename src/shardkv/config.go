@@ -201,6 +201,19 @@ func (cfg *config) ShutdownGroup(gi int) {
 
 // start i'th server in gi'th group
 func (cfg *config) StartServer(gi int, i int) {
+	cfg.startServer(gi, i, false)
+}
+
+// start a replacement for i'th server in gi'th group with an
+// empty disk. it waits to be added to the group with AddServer.
+func (cfg *config) StartJoiningServer(gi int, i int) {
+	cfg.mu.Lock()
+	cfg.groups[gi].saved[i] = nil
+	cfg.mu.Unlock()
+	cfg.startServer(gi, i, true)
+}
+
+func (cfg *config) startServer(gi int, i int, joining bool) {
 	cfg.mu.Lock()
 
 	gg := cfg.groups[gi]
@@ -242,7 +255,11 @@ func (cfg *config) StartServer(gi int, i int) {
 	}
 	cfg.mu.Unlock()
 
-	gg.servers[i] = StartServer(ends, i, gg.saved[i], cfg.maxraftstate,
+	start := StartServer
+	if joining {
+		start = StartJoiningServer
+	}
+	gg.servers[i] = start(ends, i, gg.saved[i], cfg.maxraftstate,
 		gg.gid, mends,
 		func(servername string) *labrpc.ClientEnd {
 			name := randstring(20)
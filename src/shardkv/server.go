@@ -12,6 +12,7 @@ import (
 
 	"cs651/labgob"
 	"cs651/raft"
+	"cs651/trace"
 )
 
 const Debug = 0
@@ -32,6 +33,7 @@ const (
 	KvOp_Config            KvOp = 3
 	KvOp_Migration         KvOp = 4
 	KvOp_GarbageCollection KvOp = 5
+	KvOp_Delete            KvOp = 6
 )
 
 type Op struct {
@@ -83,6 +85,40 @@ type ShardKV struct {
 	oldshardsSeq map[int]map[int]map[int64]int64
 	// config id -> shard id
 	garbageList map[int]map[int]bool
+
+	// 后台循环的唤醒信号，有新工作时由processLog发送，见notify
+	configCh chan struct{}
+	shardsCh chan struct{}
+	gcCh     chan struct{}
+
+	tracer *trace.Tracer
+}
+
+const (
+	// shardmaster没有推送，只能定期查询新配置
+	configPollInterval = 100 * time.Millisecond
+	// 拉取分片或者GC失败时，隔一段时间重试
+	retryInterval = 100 * time.Millisecond
+)
+
+// 非阻塞地唤醒一个后台循环，已经有信号等待处理时直接返回
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// 等待唤醒信号；还有未完成的工作时最多等待retryInterval
+func (kv *ShardKV) waitFor(ch chan struct{}, pending bool) {
+	if !pending {
+		<-ch
+		return
+	}
+	select {
+	case <-ch:
+	case <-time.After(retryInterval):
+	}
 }
 
 // use it with lock, be careful :)
@@ -117,7 +153,35 @@ func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) {
 		kv.mu.Unlock()
 		return
 	}
-	// Your code here.
+	kv.mu.Unlock()
+
+	// 先尝试ReadIndex读，读请求不写入raft日志
+	if readIndex, ok := kv.rf.ReadIndex(); ok {
+		if !kv.waitApplied(readIndex) {
+			reply.Err = ErrWrongLeader
+			return
+		}
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		// 等待期间配置可能已经变化，重新检查分片
+		if _, shardOk := kv.availableShards[hashVal]; args.CfgNum != kv.latestConfig().Num || !shardOk {
+			reply.Err = ErrWrongGroup
+			return
+		}
+		value, exists := kv.db[hashVal][args.Key]
+		if exists {
+			reply.Err = OK
+			reply.Value = value
+		} else {
+			reply.Err = ErrNoKey
+		}
+		DPrintf("Server %v at group %v replies client Get(%v) at read index %v: %v",
+			kv.me, kv.gid, args.Key, readIndex, reply.Err)
+		return
+	}
+
+	// leader还没有在当前任期提交过日志，通过日志处理读请求
+	kv.mu.Lock()
 	op := Op{
 		OpType:       KvOp_Get,
 		Key:          args.Key,
@@ -161,6 +225,21 @@ func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) {
 	}
 }
 
+// 等待状态机应用到index处的日志，超时返回false
+func (kv *ShardKV) waitApplied(index int) bool {
+	deadline := time.Now().Add(800 * time.Millisecond)
+	for !kv.killed() && time.Now().Before(deadline) {
+		kv.mu.Lock()
+		lastApplied := kv.lastApplied
+		kv.mu.Unlock()
+		if lastApplied >= index {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
 func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
 	// Your code here.
 
@@ -188,8 +267,11 @@ func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
 
 	opType := KvOp_Put
 
-	if args.Op == "Append" {
+	switch args.Op {
+	case "Append":
 		opType = KvOp_Append
+	case "Delete":
+		opType = KvOp_Delete
 	}
 
 	op := Op{
@@ -268,10 +350,76 @@ func (kv *ShardKV) GetMigration(args *GetMigrationArgs, reply *GetMigrationReply
 // be needed again. you are not required to do anything
 // in Kill(), but it might be convenient to (for example)
 // turn off debug output from this instance.
+// 把本组的servers[args.Server]加入raft集群，用于替换宕机的机器
+func (kv *ShardKV) AddServer(args *MembershipArgs, reply *MembershipReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	DPrintf("Server %v at group %v adds server %v", kv.me, kv.gid, args.Server)
+	reply.Err = membershipErr(kv.rf.AddServer(args.Server))
+}
+
+// 把本组的servers[args.Server]作为learner加入raft集群，例如放在其他机房做热备
+func (kv *ShardKV) AddLearner(args *MembershipArgs, reply *MembershipReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	DPrintf("Server %v at group %v adds learner %v", kv.me, kv.gid, args.Server)
+	reply.Err = membershipErr(kv.rf.AddLearner(args.Server))
+}
+
+// 把本组的servers[args.Server]移出raft集群
+func (kv *ShardKV) RemoveServer(args *MembershipArgs, reply *MembershipReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	DPrintf("Server %v at group %v removes server %v", kv.me, kv.gid, args.Server)
+	reply.Err = membershipErr(kv.rf.RemoveServer(args.Server))
+}
+
+// 把raft成员变更的错误转换为返回给clerk的Err
+func membershipErr(err error) Err {
+	switch err {
+	case nil:
+		return OK
+	case raft.ErrChangePending:
+		return ErrChangePending
+	case raft.ErrCatchUpTimeout:
+		return ErrCatchUpTimeout
+	case raft.ErrLastVoter:
+		return ErrLastVoter
+	case raft.ErrUnknownPeer:
+		return ErrUnknownServer
+	default:
+		return ErrWrongLeader
+	}
+}
+
+// 把本组的leader转移到servers[args.Server]，例如转移到离客户端更近的机器
+func (kv *ShardKV) TransferLeader(args *TransferLeaderArgs, reply *TransferLeaderReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	DPrintf("Server %v at group %v transfers leadership to %v", kv.me, kv.gid, args.Server)
+	if args.Server == kv.me || kv.rf.TransferLeadership(args.Server) {
+		reply.Err = OK
+	} else {
+		reply.Err = ErrWrongLeader
+	}
+}
+
 func (kv *ShardKV) Kill() {
 	atomic.StoreInt32(&kv.dead, 1)
 	kv.rf.Kill()
 	// Your code here, if desired.
+	// 唤醒后台循环让它们退出
+	notify(kv.configCh)
+	notify(kv.shardsCh)
+	notify(kv.gcCh)
 }
 
 func (kv *ShardKV) killed() bool {
@@ -279,6 +427,11 @@ func (kv *ShardKV) killed() bool {
 	return z == 1
 }
 
+// 返回底层Raft的状态和计数器，用于诊断
+func (kv *ShardKV) RaftStatus() raft.Status {
+	return kv.rf.Status()
+}
+
 // servers[] contains the ports of the servers in this group.
 //
 // me is the index of the current server in servers[].
@@ -305,7 +458,17 @@ func (kv *ShardKV) killed() bool {
 //
 // StartServer() must return quickly, so it should start goroutines
 // for any long-running work.
-func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister, maxraftstate int, gid int, masters []*labrpc.ClientEnd, make_end func(string) *labrpc.ClientEnd) *ShardKV {
+func StartServer(servers []*labrpc.ClientEnd, me int, persister raft.Storage, maxraftstate int, gid int, masters []*labrpc.ClientEnd, make_end func(string) *labrpc.ClientEnd) *ShardKV {
+	return startServer(servers, me, persister, maxraftstate, gid, masters, make_end, false)
+}
+
+// StartJoiningServer 启动一个替换节点，它不参与选举，
+// 直到本组通过AddServer把它加入，然后从leader获取日志和快照
+func StartJoiningServer(servers []*labrpc.ClientEnd, me int, persister raft.Storage, maxraftstate int, gid int, masters []*labrpc.ClientEnd, make_end func(string) *labrpc.ClientEnd) *ShardKV {
+	return startServer(servers, me, persister, maxraftstate, gid, masters, make_end, true)
+}
+
+func startServer(servers []*labrpc.ClientEnd, me int, persister raft.Storage, maxraftstate int, gid int, masters []*labrpc.ClientEnd, make_end func(string) *labrpc.ClientEnd, joining bool) *ShardKV {
 	// call labgob.Register on structures you want
 	// Go's RPC library to marshall/unmarshall.
 	labgob.Register(Op{})
@@ -323,7 +486,14 @@ func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister,
 	// kv.mck = shardmaster.MakeClerk(kv.masters)
 
 	kv.applyCh = make(chan raft.ApplyMsg)
-	kv.rf = raft.Make(servers, me, persister, kv.applyCh)
+	if joining {
+		kv.rf = raft.MakeJoining(servers, me, persister, kv.applyCh)
+	} else {
+		kv.rf = raft.Make(servers, me, persister, kv.applyCh)
+	}
+	sink := trace.EnvSink(fmt.Sprintf("shardkv-%v-%v", gid, me))
+	kv.rf.SetTraceSink(sink, gid)
+	kv.tracer = trace.NewTracer(sink, "shardkv", gid, me)
 
 	for i := 0; i < shardmaster.NShards; i++ {
 		kv.db[i] = make(map[string]string)
@@ -343,10 +513,13 @@ func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister,
 	kv.oldshards = make(map[int]map[int]bool)
 	kv.oldshardsSeq = make(map[int]map[int]map[int64]int64)
 	kv.oldshardsData = make(map[int]map[int]map[string]string)
+	kv.configCh = make(chan struct{}, 1)
+	kv.shardsCh = make(chan struct{}, 1)
+	kv.gcCh = make(chan struct{}, 1)
 	kv.readSnapshotForInit()
 
 	if kv.maxraftstate != -1 {
-		go kv.doSnapshot()
+		kv.rf.SetCompaction(raft.SizePolicy(kv.maxraftstate), 0, kv.snapshot)
 	}
 	go kv.pullShards()
 	go kv.pullConfig()
@@ -358,23 +531,7 @@ func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister,
 func (kv *ShardKV) readSnapshotForInit() {
 	snapshot, lastIncludedIndex := kv.rf.GetSnapshot()
 	if snapshot != nil && len(snapshot) >= 1 {
-		r := bytes.NewBuffer(snapshot)
-		d := labgob.NewDecoder(r)
-
-		if d.Decode(&kv.db) != nil ||
-			d.Decode(&kv.clients) != nil ||
-			d.Decode(&kv.configs) != nil ||
-			d.Decode(&kv.oldConfig) != nil ||
-			d.Decode(&kv.availableShards) != nil ||
-			d.Decode(&kv.oldshards) != nil ||
-			d.Decode(&kv.requiredShards) != nil ||
-			d.Decode(&kv.oldshardsData) != nil ||
-			d.Decode(&kv.oldshardsSeq) != nil ||
-			d.Decode(&kv.garbageList) != nil {
-
-			log.Fatalf("Unable to read persisted snapshot")
-		}
-
+		kv.restoreSnapshot(snapshot)
 		kv.lastApplied = lastIncludedIndex
 	}
 }
@@ -398,7 +555,11 @@ func (kv *ShardKV) pullConfig() {
 				kv.mu.Unlock()
 			}
 		}
-		time.Sleep(50 * time.Millisecond)
+		// 上一个配置迁移完成时立即查询下一个配置
+		select {
+		case <-kv.configCh:
+		case <-time.After(configPollInterval):
+		}
 	}
 }
 
@@ -407,6 +568,8 @@ func (kv *ShardKV) pullShards() {
 		//only leader can pull shards
 		_, isLeader := kv.rf.GetState()
 		kv.mu.Lock()
+		// 还有没拉到的分片时定期重试，本节点之后可能成为leader
+		pending := len(kv.requiredShards) != 0
 		if isLeader && len(kv.requiredShards) != 0 {
 			// make a wait group here
 			neededShards := make(map[int]bool)
@@ -453,12 +616,15 @@ func (kv *ShardKV) pullShards() {
 		} else {
 			kv.mu.Unlock()
 		}
-		time.Sleep(50 * time.Millisecond)
+		kv.waitFor(kv.shardsCh, pending)
 	}
 	fmt.Println("Thread killed")
 }
 
-func (kv *ShardKV) createSnapshot() {
+// 返回状态机的快照和它包含的最后一条日志，由Raft按压缩策略调用
+func (kv *ShardKV) snapshot() ([]byte, int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 	w := new(bytes.Buffer)
 	e := labgob.NewEncoder(w)
 	e.Encode(kv.db)
@@ -471,24 +637,8 @@ func (kv *ShardKV) createSnapshot() {
 	e.Encode(kv.oldshardsData)
 	e.Encode(kv.oldshardsSeq)
 	e.Encode(kv.garbageList)
-	data := w.Bytes()
-	lastApplied := kv.lastApplied
-	//	DPrintf("Server %v at group %v generates snapshot at log intex %v", kv.me, kv.gid, lastApplied)
-	kv.rf.GenerateSnapshot(data, lastApplied)
-}
-
-func (kv *ShardKV) doSnapshot() {
-	for !kv.killed() {
-		if kv.rf.GetRaftStateSize() > kv.maxraftstate {
-			kv.mu.Lock()
-			kv.createSnapshot()
-			kv.mu.Unlock()
-
-		}
-		time.Sleep(20 * time.Millisecond)
-	}
-
-	fmt.Println("Thread killed")
+	//	DPrintf("Server %v at group %v generates snapshot at log intex %v", kv.me, kv.gid, kv.lastApplied)
+	return w.Bytes(), kv.lastApplied
 }
 
 func (kv *ShardKV) applyConfig(op *Op, msg *raft.ApplyMsg) {
@@ -499,6 +649,7 @@ func (kv *ShardKV) applyConfig(op *Op, msg *raft.ApplyMsg) {
 	// apply config one by one
 
 	if op.Config.Num == kv.latestConfig().Num+1 && len(kv.requiredShards) == 0 {
+		kv.tracer.Emit(trace.ConfigApplied, 0, msg.CommandIndex, "config %v shards %v", op.Config.Num, op.Config.Shards)
 
 		if op.Config.Num == 1 {
 			kv.oldConfig = kv.latestConfig()
@@ -570,7 +721,11 @@ func (kv *ShardKV) applyConfig(op *Op, msg *raft.ApplyMsg) {
 			// update the new available shards
 			kv.availableShards = availableShards
 		}
-
+		if len(kv.requiredShards) != 0 {
+			notify(kv.shardsCh)
+		} else {
+			notify(kv.configCh)
+		}
 	}
 	// remeber to update the lastapplied index :)
 	if kv.lastApplied < msg.CommandIndex {
@@ -583,9 +738,14 @@ func (kv *ShardKV) applyMigration(op *Op, msg *raft.ApplyMsg) {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 	DPrintf("Server %v at %v receives shard %v at config %v", kv.me, kv.gid, op.MigrationReply.Shard, op.MigrationReply.Num)
-	if op.MigrationReply.Num != kv.oldConfig.Num {
+	// 重复的迁移日志(例如重启后重放日志时又拉取了一次)，分片已经安装过，不能覆盖之后的写入
+	if _, ok := kv.requiredShards[op.MigrationReply.Shard]; op.MigrationReply.Num != kv.oldConfig.Num || !ok {
+		if kv.lastApplied < msg.CommandIndex {
+			kv.lastApplied = msg.CommandIndex
+		}
 		return
 	}
+	kv.tracer.Emit(trace.ShardPulled, 0, msg.CommandIndex, "shard %v config %v", op.MigrationReply.Shard, op.MigrationReply.Num)
 	// make shard available
 	delete(kv.requiredShards, op.MigrationReply.Shard)
 	kv.availableShards[op.MigrationReply.Shard] = true
@@ -615,7 +775,10 @@ func (kv *ShardKV) applyMigration(op *Op, msg *raft.ApplyMsg) {
 		kv.garbageList[op.MigrationReply.Num] = make(map[int]bool)
 	}
 	kv.garbageList[op.MigrationReply.Num][op.MigrationReply.Shard] = true
-
+	notify(kv.gcCh)
+	if len(kv.requiredShards) == 0 {
+		notify(kv.configCh)
+	}
 }
 
 func (kv *ShardKV) applyGarbageCollection(op *Op, msg *raft.ApplyMsg) {
@@ -659,6 +822,10 @@ func (kv *ShardKV) applyUserRequest(op *Op, msg *raft.ApplyMsg) {
 		ch, ok := kv.channels[msg.CommandIndex]
 		delete(kv.channels, msg.CommandIndex)
 
+		if kv.lastApplied < msg.CommandIndex {
+			kv.lastApplied = msg.CommandIndex
+		}
+
 		kv.mu.Unlock()
 		_, isLeader := kv.rf.GetState()
 		if ok && isLeader {
@@ -706,6 +873,13 @@ func (kv *ShardKV) applyUserRequest(op *Op, msg *raft.ApplyMsg) {
 				}
 				op.Err = OK
 			}
+		case KvOp_Delete:
+			{
+				// 分片迁移和快照都传送整个分片，删除的key不需要留下记录
+				delete(kv.db[hashVal], op.Key)
+				op.Err = OK
+				DPrintf("Op seq value:%v Delete(%v)", op.SeqNum, op.Key)
+			}
 		}
 		kv.clients[hashVal][op.Id] = op.SeqNum
 		ch, ok := kv.channels[msg.CommandIndex]
@@ -723,6 +897,10 @@ func (kv *ShardKV) applyUserRequest(op *Op, msg *raft.ApplyMsg) {
 		}
 		return
 	}
+	// 重复的操作不再执行，但lastApplied仍要更新
+	if kv.lastApplied < msg.CommandIndex {
+		kv.lastApplied = msg.CommandIndex
+	}
 	kv.mu.Unlock()
 }
 
@@ -730,10 +908,28 @@ func (kv *ShardKV) applySnapshot(msg *raft.ApplyMsg) {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
-	DPrintf("Server %v at %v applied snapshot from %v to %v", kv.me, kv.gid, kv.lastApplied, msg.LastIncludedIndex)
-	r := bytes.NewBuffer(msg.Command.([]byte))
-	d := labgob.NewDecoder(r)
+	DPrintf("Server %v at %v applied snapshot from %v to %v", kv.me, kv.gid, kv.lastApplied, msg.SnapshotIndex)
+	kv.restoreSnapshot(msg.Snapshot)
+	kv.lastApplied = msg.SnapshotIndex
+}
 
+// 用快照替换状态机的全部状态。
+// gob解码到已有的map时会和原来的内容合并，落后的节点会留下过期的分片，所以先清空
+// use it with lock
+func (kv *ShardKV) restoreSnapshot(snapshot []byte) {
+	kv.db = [shardmaster.NShards]map[string]string{}
+	kv.clients = [shardmaster.NShards]map[int64]int64{}
+	kv.configs = nil
+	kv.oldConfig = shardmaster.Config{}
+	kv.availableShards = nil
+	kv.oldshards = nil
+	kv.requiredShards = nil
+	kv.oldshardsData = nil
+	kv.oldshardsSeq = nil
+	kv.garbageList = nil
+
+	r := bytes.NewBuffer(snapshot)
+	d := labgob.NewDecoder(r)
 	if d.Decode(&kv.db) != nil ||
 		d.Decode(&kv.clients) != nil ||
 		d.Decode(&kv.configs) != nil ||
@@ -747,7 +943,6 @@ func (kv *ShardKV) applySnapshot(msg *raft.ApplyMsg) {
 
 		log.Fatalf("Unable to read persisted snapshot")
 	}
-	kv.lastApplied = msg.LastIncludedIndex
 }
 
 func (kv *ShardKV) processLog() {
@@ -755,7 +950,23 @@ func (kv *ShardKV) processLog() {
 		msg := <-kv.applyCh
 
 		if msg.CommandValid {
-			op := msg.Command.(Op)
+			kv.mu.Lock()
+			// 已经包含在安装的快照中
+			stale := msg.CommandIndex <= kv.lastApplied
+			kv.mu.Unlock()
+			if stale {
+				continue
+			}
+			op, isOp := msg.Command.(Op)
+			// raft的成员配置日志，不需要执行
+			if !isOp {
+				kv.mu.Lock()
+				if kv.lastApplied < msg.CommandIndex {
+					kv.lastApplied = msg.CommandIndex
+				}
+				kv.mu.Unlock()
+				continue
+			}
 			switch op.OpType {
 			case KvOp_Config:
 				kv.applyConfig(&op, &msg)
@@ -767,10 +978,12 @@ func (kv *ShardKV) processLog() {
 				kv.applyUserRequest(&op, &msg)
 			}
 
-		} else if msg.LastIncludedIndex > kv.lastApplied {
+		} else if msg.SnapshotValid && kv.rf.CondInstallSnapshot(msg.SnapshotTerm, msg.SnapshotIndex, msg.Snapshot) {
 			kv.applySnapshot(&msg)
+			// 快照中可能有未完成的迁移和GC
+			notify(kv.shardsCh)
+			notify(kv.gcCh)
 		}
-
 	}
 
 	fmt.Printf("server %v at group %v Thread killed\n", kv.me, kv.gid)
@@ -806,7 +1019,9 @@ func (kv *ShardKV) sendGCRequest() {
 					ok := clk.Call("ShardKV.GarbageCollectionRPC", &args, &reply)
 					if ok {
 						if reply.Err == OK {
+							kv.mu.Lock()
 							delete(kv.garbageList[args.Num], args.Shard)
+							kv.mu.Unlock()
 
 							break
 						} else if reply.Err == Deleting {
@@ -818,12 +1033,20 @@ func (kv *ShardKV) sendGCRequest() {
 			}(list[i])
 		}
 		wg.Wait()
-		time.Sleep(50 * time.Millisecond)
+		// 没有待清理的分片时一直等到applyMigration产生新的垃圾
+		kv.waitFor(kv.gcCh, len(list) != 0)
 	}
 }
 
 func (kv *ShardKV) GarbageCollectionRPC(args *GarbageCollectionArgs, reply *GarbageCollectionReply) {
 	kv.mu.Lock()
+	// 还没有应用args.Num之后的配置时，旧分片还没有生成，不能回复OK，
+	// 否则拉取方不再重试，分片永远不会被清理
+	if kv.latestConfig().Num <= args.Num {
+		reply.Err = ErrWrongLeader
+		kv.mu.Unlock()
+		return
+	}
 	oldConfig, configOK := kv.oldshards[args.Num]
 
 	if !configOK {
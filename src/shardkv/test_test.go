@@ -3,6 +3,8 @@ package shardkv
 import (
 	"cs651/models"
 	"cs651/porcupine"
+	"cs651/raft"
+	"cs651/shardmaster"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -22,6 +24,61 @@ func check(t *testing.T, ck *Clerk, key string, value string) {
 	}
 }
 
+// a migration entry applied twice (the leader pulled the shard again
+// before the first entry was applied) must not wipe out later writes.
+func TestDuplicateMigration(t *testing.T) {
+	fmt.Printf("Test: duplicate migration entries ...\n")
+
+	kv := &ShardKV{}
+	kv.oldConfig = shardmaster.Config{Num: 1}
+	kv.requiredShards = map[int]bool{0: true}
+	kv.availableShards = map[int]bool{}
+	kv.garbageList = map[int]map[int]bool{}
+	for i := range kv.db {
+		kv.db[i] = map[string]string{}
+		kv.clients[i] = map[int64]int64{}
+	}
+
+	op := Op{
+		OpType: KvOp_Migration,
+		MigrationReply: GetMigrationReply{
+			Num: 1, Shard: 0, Data: map[string]string{"a": "old"}, Seq: map[int64]int64{},
+		},
+	}
+	kv.applyMigration(&op, &raft.ApplyMsg{CommandIndex: 1})
+	// a Put applied after the shard arrived.
+	kv.db[0]["a"] = "new"
+	kv.applyMigration(&op, &raft.ApplyMsg{CommandIndex: 3})
+
+	if v := kv.db[0]["a"]; v != "new" {
+		t.Fatalf("duplicate migration overwrote a later write: %v", v)
+	}
+	if kv.lastApplied != 3 {
+		t.Fatalf("lastApplied %v after the duplicate entry at 3", kv.lastApplied)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a group that has not applied the configuration after args.Num has
+// not split off the old shard yet; answering OK would make the puller
+// stop asking, and the shard would never be collected.
+func TestEarlyGarbageCollection(t *testing.T) {
+	fmt.Printf("Test: garbage collection before the config change ...\n")
+
+	kv := &ShardKV{}
+	kv.configs = []shardmaster.Config{{Num: 0}, {Num: 1}}
+	kv.oldshards = map[int]map[int]bool{}
+
+	reply := GarbageCollectionReply{}
+	kv.GarbageCollectionRPC(&GarbageCollectionArgs{Num: 1, Shard: 0}, &reply)
+	if reply.Err == OK {
+		t.Fatalf("GarbageCollectionRPC answered OK before config 2 was applied")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
 // test static 2-way sharding, without shard movement.
 func TestStaticShards(t *testing.T) {
 	fmt.Printf("Test: static shards ...\n")
@@ -87,6 +144,64 @@ func TestStaticShards(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+// a dead server is replaced online: it is removed from its group,
+// a fresh server with an empty disk is added in its place, and the
+// group keeps its data.
+func TestReplaceServer(t *testing.T) {
+	fmt.Printf("Test: replace a dead server ...\n")
+
+	cfg := make_config(t, 3, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+	gid := cfg.groups[0].gid
+
+	n := 10
+	ka := make([]string, n)
+	va := make([]string, n)
+	for i := 0; i < n; i++ {
+		ka[i] = strconv.Itoa(i) // ensure multiple shards
+		va[i] = randstring(20)
+		ck.Put(ka[i], va[i])
+	}
+
+	// server 2 dies and is removed from its group.
+	cfg.ShutdownServer(0, 2)
+	if err := ck.RemoveServer(gid, 2); err != OK {
+		t.Fatalf("RemoveServer(%v, 2): %v", gid, err)
+	}
+	for i := 0; i < n; i++ {
+		x := randstring(20)
+		ck.Append(ka[i], x)
+		va[i] += x
+	}
+
+	// a replacement with an empty disk joins.
+	cfg.StartJoiningServer(0, 2)
+	if err := ck.AddServer(gid, 2); err != OK {
+		t.Fatalf("AddServer(%v, 2): %v", gid, err)
+	}
+	if m := cfg.groups[0].servers[2].rf.GetMembership(); len(m.Voters) != 3 {
+		t.Fatalf("expected 3 voters after AddServer, got %v", m.Voters)
+	}
+
+	// 1 and 2 must now serve the group on their own.
+	cfg.ShutdownServer(0, 0)
+	for i := 0; i < n; i++ {
+		check(t, ck, ka[i], va[i])
+		x := randstring(20)
+		ck.Append(ka[i], x)
+		va[i] += x
+	}
+	for i := 0; i < n; i++ {
+		check(t, ck, ka[i], va[i])
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
 func TestJoinLeave(t *testing.T) {
 	fmt.Printf("Test: join then leave ...\n")
 
@@ -208,6 +323,72 @@ func TestSnapshot(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+func TestDelete(t *testing.T) {
+	fmt.Printf("Test: deletes across shard moves and snapshots ...\n")
+
+	cfg := make_config(t, 3, false, 1000)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	n := 30
+	ka := make([]string, n)
+	va := make([]string, n)
+	for i := 0; i < n; i++ {
+		ka[i] = strconv.Itoa(i) // ensure multiple shards
+		va[i] = randstring(20)
+		ck.Put(ka[i], va[i])
+	}
+	for i := 0; i < n; i += 2 {
+		ck.Delete(ka[i])
+		va[i] = ""
+	}
+
+	// the deletes move with their shards.
+	cfg.join(1)
+	cfg.join(2)
+	cfg.leave(0)
+
+	for i := 0; i < n; i++ {
+		check(t, ck, ka[i], va[i])
+	}
+	for i := 1; i < n; i += 4 {
+		ck.Delete(ka[i])
+		va[i] = ""
+	}
+
+	cfg.leave(1)
+	cfg.join(0)
+
+	for i := 0; i < n; i++ {
+		check(t, ck, ka[i], va[i])
+	}
+
+	time.Sleep(1 * time.Second)
+
+	cfg.checklogs()
+
+	cfg.ShutdownGroup(0)
+	cfg.ShutdownGroup(1)
+	cfg.ShutdownGroup(2)
+
+	cfg.StartGroup(0)
+	cfg.StartGroup(1)
+	cfg.StartGroup(2)
+
+	for i := 0; i < n; i++ {
+		check(t, ck, ka[i], va[i])
+	}
+
+	// a deleted key can be written again.
+	ck.Append(ka[0], "x")
+	check(t, ck, ka[0], "x")
+
+	fmt.Printf("  ... Passed\n")
+}
+
 func TestMissChange(t *testing.T) {
 	fmt.Printf("Test: servers miss configuration changes...\n")
 
@@ -1,9 +1,12 @@
 package shardmaster
 
 import (
+	"bytes"
 	"cs651/labgob"
 	"cs651/labrpc"
 	"cs651/raft"
+	"cs651/trace"
+	"fmt"
 	"log"
 	"sort"
 	"sync"
@@ -31,9 +34,19 @@ type ShardMaster struct {
 	// record the timestamps
 	clients map[int64]int64
 	// index in Raft to reply channel
-	channels map[int]chan Op
+	channels    map[int]chan Op
+	lastApplied int
+
+	tracer *trace.Tracer
 }
 
+const (
+	// 快照之后应用了这么多条日志时压缩日志
+	snapshotEntries = 1000
+	// 压缩之后保留的日志条数，稍微落后的follower不需要安装快照
+	retainEntries = 100
+)
+
 type OpType int32
 
 const (
@@ -437,9 +450,29 @@ func (sm *ShardMaster) Raft() *raft.Raft {
 func (sm *ShardMaster) applyLog() {
 	for !sm.killed {
 		msg := <-sm.applyCh
-		op := msg.Command.(Op)
+		if msg.SnapshotValid {
+			if sm.rf.CondInstallSnapshot(msg.SnapshotTerm, msg.SnapshotIndex, msg.Snapshot) {
+				sm.mu.Lock()
+				sm.restoreSnapshot(msg.Snapshot)
+				sm.lastApplied = msg.SnapshotIndex
+				sm.mu.Unlock()
+			}
+			continue
+		}
 
 		sm.mu.Lock()
+		// 已经包含在安装的快照中
+		if msg.CommandIndex <= sm.lastApplied {
+			sm.mu.Unlock()
+			continue
+		}
+		sm.lastApplied = msg.CommandIndex
+		op, isOp := msg.Command.(Op)
+		// raft的成员配置日志，不需要执行
+		if !isOp {
+			sm.mu.Unlock()
+			continue
+		}
 
 		maxSeq, ok := sm.clients[op.ClientID]
 		if !ok || maxSeq < op.SeqNum {
@@ -463,6 +496,9 @@ func (sm *ShardMaster) applyLog() {
 				}
 			}
 			sm.clients[op.ClientID] = op.SeqNum
+			if op.Type != OpType_Query {
+				sm.tracer.Emit(trace.ConfigApplied, 0, msg.CommandIndex, "config %v", sm.configs[len(sm.configs)-1].Num)
+			}
 
 			ch, ok := sm.channels[msg.CommandIndex]
 
@@ -481,11 +517,44 @@ func (sm *ShardMaster) applyLog() {
 	}
 }
 
+// 返回配置和客户端的序号，以及包含的最后一条日志，由Raft按压缩策略调用
+func (sm *ShardMaster) snapshot() ([]byte, int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(sm.configs)
+	e.Encode(sm.clients)
+	return w.Bytes(), sm.lastApplied
+}
+
+// use it with lock
+func (sm *ShardMaster) restoreSnapshot(snapshot []byte) {
+	var configs []Config
+	var clients map[int64]int64
+	d := labgob.NewDecoder(bytes.NewBuffer(snapshot))
+	if d.Decode(&configs) != nil ||
+		d.Decode(&clients) != nil {
+		log.Fatalf("Unable to read persisted snapshot")
+	}
+	// gob把空的map解码为nil
+	if clients == nil {
+		clients = make(map[int64]int64)
+	}
+	for i := range configs {
+		if configs[i].Groups == nil {
+			configs[i].Groups = map[int][]string{}
+		}
+	}
+	sm.configs = configs
+	sm.clients = clients
+}
+
 // servers[] contains the ports of the set of
 // servers that will cooperate via Paxos to
 // form the fault-tolerant shardmaster service.
 // me is the index of the current server in servers[].
-func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister) *ShardMaster {
+func StartServer(servers []*labrpc.ClientEnd, me int, persister raft.Storage) *ShardMaster {
 	sm := new(ShardMaster)
 	sm.me = me
 
@@ -500,8 +569,16 @@ func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister)
 	DPrintf("Make raft")
 	sm.rf = raft.Make(servers, me, persister, sm.applyCh)
 	DPrintf("Make raft done")
+	sink := trace.EnvSink(fmt.Sprintf("shardmaster-%v", me))
+	sm.rf.SetTraceSink(sink, 0)
+	sm.tracer = trace.NewTracer(sink, "shardmaster", 0, me)
 	sm.clients = make(map[int64]int64)
 	sm.channels = make(map[int]chan Op)
+	if snapshot, lastIncludedIndex := sm.rf.GetSnapshot(); len(snapshot) > 0 {
+		sm.restoreSnapshot(snapshot)
+		sm.lastApplied = lastIncludedIndex
+	}
+	sm.rf.SetCompaction(raft.EntryCountPolicy(snapshotEntries), retainEntries, sm.snapshot)
 
 	DPrintf("Server %v starts", sm.me)
 	// Your code here.
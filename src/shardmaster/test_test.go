@@ -378,3 +378,58 @@ func TestMulti(t *testing.T) {
 
 	fmt.Printf("  ... Passed\n")
 }
+
+func TestSnapshot(t *testing.T) {
+	const nservers = 3
+	cfg := make_config(t, nservers, false)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	fmt.Printf("Test: Snapshots bound the log ...\n")
+
+	ck.Join(map[int][]string{1: []string{"x", "y", "z"}})
+	ck.Join(map[int][]string{2: []string{"a", "b", "c"}})
+	c1 := ck.Query(-1)
+	// 每个Query都写入日志
+	for i := 0; i < 3*snapshotEntries; i++ {
+		ck.Query(-1)
+	}
+	for i := 0; i < nservers; i++ {
+		st := cfg.servers[i].Raft().Status()
+		if st.LogLength > snapshotEntries+retainEntries+10 {
+			t.Fatalf("server %v keeps %v log entries", i, st.LogLength)
+		}
+		if st.LogLength < retainEntries {
+			t.Fatalf("server %v retains only %v log entries", i, st.LogLength)
+		}
+	}
+
+	// 重启之后从快照恢复配置
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+	}
+	for i := 0; i < nservers; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+	check_same_config(t, c1, ck.Query(-1))
+	check(t, []int{1, 2}, ck)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// maps that are nil or empty when the snapshot is taken may decode
+// as nil; the restored server must still be able to use them.
+func TestRestoreEmptySnapshot(t *testing.T) {
+	sm := &ShardMaster{}
+	sm.configs = make([]Config, 1)
+	snapshot, _ := sm.snapshot()
+
+	restored := &ShardMaster{}
+	restored.restoreSnapshot(snapshot)
+	if restored.clients == nil || restored.configs[0].Groups == nil {
+		t.Fatalf("restored nil maps: clients %v, groups %v", restored.clients, restored.configs[0].Groups)
+	}
+	restored.clients[1] = 1
+}
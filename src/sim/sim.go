@@ -0,0 +1,385 @@
+package sim
+
+//
+// deterministic simulation for Raft and labrpc.
+//
+// s := sim.New(seed)
+// s.Run(main) -- run main on the calling goroutine as the first task,
+//   together with every task it starts, until main returns.
+// s.Go(f) -- start a new task.
+// s.Now(), s.Sleep(d), s.AfterFunc(d, f) -- the virtual clock.
+// s.Await(ready, d) -- park until ready() returns true or d elapses.
+// s.Intn(n), s.Int63() -- the seeded random source.
+//
+// tasks are goroutines, but only one of them runs at a time. a task
+// runs until it parks in Sleep or Await, or returns. the scheduler
+// then resumes runnable tasks in the order they became runnable;
+// when there are none it asks each parked Await, in the order they
+// parked, whether it is ready now; only when nothing can run does
+// the virtual clock jump to the earliest timer. so the interleaving
+// depends on nothing but the seed, and running with the same seed
+// again replays it exactly. Fingerprint() summarizes the schedule,
+// so two runs can be compared.
+//
+// a task must not park while holding a lock, and must not block on
+// anything other than the primitives here: channels are polled with
+// a non-blocking select inside Await instead.
+//
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 虚拟时钟的起点，离零值足够远，time.Time{}仍然表示很久以前
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// 可以停止和重置的计时器，*time.Timer也实现了它
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type task struct {
+	id     int
+	wake   chan struct{}
+	ready  func() bool // 在Await中等待时的条件
+	timer  *timer      // Sleep或者Await的超时
+	result bool        // Await是否因为ready()返回
+}
+
+type Sim struct {
+	mu      sync.Mutex
+	seed    int64
+	rand    *rand.Rand
+	now     time.Time
+	seq     int // 计时器的序号，同一时刻到期的按创建顺序触发
+	timers  timerHeap
+	runq    []*task // 可以运行的task
+	waiters []*task // 在Await中等待的task
+	current *task
+	nextId  int
+	stopped bool // main已经返回，不再调度其他task
+	steps   int
+	fp      uint64 // 调度顺序的指纹
+}
+
+func New(seed int64) *Sim {
+	s := &Sim{}
+	s.seed = seed
+	s.rand = rand.New(rand.NewSource(seed))
+	s.now = epoch
+	s.fp = 14695981039346656037
+	return s
+}
+
+func (s *Sim) Seed() int64 {
+	return s.seed
+}
+
+// 在调用者的goroutine上把main作为第一个task运行，main返回之后其他task不再运行
+func (s *Sim) Run(main func()) {
+	s.mu.Lock()
+	t := s.newTask()
+	s.current = t
+	s.mu.Unlock()
+	defer func() {
+		// main也可能因为t.Fatal调用runtime.Goexit而结束
+		s.mu.Lock()
+		s.stopped = true
+		s.current = nil
+		s.mu.Unlock()
+	}()
+	main()
+}
+
+// 正在运行的task，只有task可以停下等待
+// use it with lock
+func (s *Sim) self() *task {
+	if s.current == nil {
+		s.mu.Unlock()
+		panic("sim: only a task can park")
+	}
+	return s.current
+}
+
+// 启动一个新的task，它在当前task停下之后才会开始运行
+func (s *Sim) Go(f func()) {
+	s.mu.Lock()
+	t := s.newTask()
+	s.runq = append(s.runq, t)
+	s.mu.Unlock()
+	go func() {
+		<-t.wake
+		defer s.exit()
+		f()
+	}()
+}
+
+// use it with lock
+func (s *Sim) newTask() *task {
+	t := &task{id: s.nextId, wake: make(chan struct{}, 1)}
+	s.nextId++
+	return t
+}
+
+func (s *Sim) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+func (s *Sim) Since(t time.Time) time.Duration {
+	return s.Now().Sub(t)
+}
+
+// 当前task停下d，d<=0时让其他可以运行的task先运行
+func (s *Sim) Sleep(d time.Duration) {
+	s.mu.Lock()
+	self := s.self()
+	if d <= 0 {
+		s.runq = append(s.runq, self)
+	} else {
+		s.schedule(d, func() {
+			s.runq = append(s.runq, self)
+		})
+	}
+	s.mu.Unlock()
+	s.park(self)
+}
+
+// 等待ready()返回true，最多等待d，d<0时不超时。返回ready()是否为true。
+// ready()在调度时被调用，可以获取锁，可以有副作用(例如从channel中取出一个值)
+func (s *Sim) Await(ready func() bool, d time.Duration) bool {
+	if ready() {
+		return true
+	}
+	if d == 0 {
+		return false
+	}
+	s.mu.Lock()
+	self := s.self()
+	self.ready = ready
+	self.result = false
+	s.waiters = append(s.waiters, self)
+	if d > 0 {
+		self.timer = s.schedule(d, func() {
+			self.timer = nil
+			s.removeWaiter(self)
+			s.runq = append(s.runq, self)
+		})
+	}
+	s.mu.Unlock()
+	s.park(self)
+	return self.result
+}
+
+// d之后在一个新的task中运行f
+func (s *Sim) AfterFunc(d time.Duration, f func()) Timer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.schedule(d, func() {
+		t := s.newTask()
+		s.runq = append(s.runq, t)
+		go func() {
+			<-t.wake
+			defer s.exit()
+			f()
+		}()
+	})
+}
+
+func (s *Sim) Intn(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Intn(n)
+}
+
+func (s *Sim) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Int63()
+}
+
+// 到目前为止task切换的次数
+func (s *Sim) Steps() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.steps
+}
+
+// 调度顺序的指纹：每次切换时运行的task和虚拟时间，
+// 相同的种子应该得到相同的指纹
+func (s *Sim) Fingerprint() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fp
+}
+
+// task结束，切换到下一个task
+func (s *Sim) exit() {
+	if next := s.next(); next != nil {
+		next.wake <- struct{}{}
+	}
+}
+
+// 停下self，直到调度器再次选中它
+func (s *Sim) park(self *task) {
+	next := s.next()
+	if next == self {
+		return
+	}
+	if next != nil {
+		next.wake <- struct{}{}
+	}
+	<-self.wake
+}
+
+// 选出下一个运行的task。main已经返回时返回nil
+func (s *Sim) next() *task {
+	for {
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return nil
+		}
+		if len(s.runq) > 0 {
+			t := s.runq[0]
+			s.runq = s.runq[1:]
+			s.current = t
+			s.steps++
+			s.fp = (s.fp ^ uint64(t.id)) * 1099511628211
+			s.fp = (s.fp ^ uint64(s.now.UnixNano())) * 1099511628211
+			s.mu.Unlock()
+			return t
+		}
+		waiters := append([]*task{}, s.waiters...)
+		s.mu.Unlock()
+
+		// 不持有s.mu调用ready()，它可能获取其他锁
+		woken := false
+		for _, w := range waiters {
+			if w.ready() {
+				s.mu.Lock()
+				s.removeWaiter(w)
+				if w.timer != nil {
+					w.timer.stop()
+					w.timer = nil
+				}
+				w.result = true
+				s.runq = append(s.runq, w)
+				s.mu.Unlock()
+				woken = true
+			}
+		}
+		if woken {
+			continue
+		}
+
+		s.mu.Lock()
+		if len(s.timers) == 0 {
+			s.mu.Unlock()
+			panic(fmt.Sprintf("sim: all tasks are blocked (seed %v)", s.seed))
+		}
+		t := heap.Pop(&s.timers).(*timer)
+		if t.when.After(s.now) {
+			s.now = t.when
+		}
+		t.fire()
+		s.mu.Unlock()
+	}
+}
+
+// use it with lock
+func (s *Sim) removeWaiter(w *task) {
+	for i, x := range s.waiters {
+		if x == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// use it with lock
+func (s *Sim) schedule(d time.Duration, fire func()) *timer {
+	t := &timer{s: s, fire: fire, index: -1}
+	t.start(d)
+	return t
+}
+
+// 虚拟时钟上的计时器，fire在持有s.mu时调用
+type timer struct {
+	s     *Sim
+	when  time.Time
+	seq   int
+	index int // 在堆中的位置，不在堆中时为-1
+	fire  func()
+}
+
+// use it with lock
+func (t *timer) start(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	t.when = t.s.now.Add(d)
+	t.seq = t.s.seq
+	t.s.seq++
+	heap.Push(&t.s.timers, t)
+}
+
+// use it with lock
+func (t *timer) stop() bool {
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.s.timers, t.index)
+	return true
+}
+
+func (t *timer) Stop() bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	return t.stop()
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	active := t.stop()
+	t.start(d)
+	return active
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].when.Equal(h[j].when) {
+		return h[i].when.Before(h[j].when)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,105 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	s := New(1)
+	s.Run(func() {
+		start := s.Now()
+		s.Sleep(3 * time.Second)
+		if d := s.Since(start); d != 3*time.Second {
+			t.Fatalf("slept %v, expected 3s", d)
+		}
+
+		order := []int{}
+		for _, ms := range []int{30, 10, 20, 10} {
+			ms := ms
+			s.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+				order = append(order, ms)
+			})
+		}
+		stopped := s.AfterFunc(15*time.Millisecond, func() {
+			t.Errorf("stopped timer fired")
+		})
+		stopped.Stop()
+		s.Sleep(time.Second)
+		expected := []int{10, 10, 20, 30}
+		for i := range expected {
+			if i >= len(order) || order[i] != expected[i] {
+				t.Fatalf("timers fired in order %v, expected %v", order, expected)
+			}
+		}
+	})
+}
+
+func TestAwait(t *testing.T) {
+	s := New(1)
+	s.Run(func() {
+		ch := make(chan int, 1)
+		recv := func() bool {
+			select {
+			case <-ch:
+				return true
+			default:
+				return false
+			}
+		}
+		s.Go(func() {
+			s.Sleep(50 * time.Millisecond)
+			ch <- 1
+		})
+		start := s.Now()
+		if !s.Await(recv, time.Second) {
+			t.Fatalf("Await timed out")
+		}
+		if d := s.Since(start); d != 50*time.Millisecond {
+			t.Fatalf("woken after %v, expected 50ms", d)
+		}
+		if s.Await(recv, 100*time.Millisecond) {
+			t.Fatalf("Await returned true without a value")
+		}
+		if d := s.Since(start); d != 150*time.Millisecond {
+			t.Fatalf("timed out after %v, expected 150ms", d)
+		}
+	})
+}
+
+// 同一个种子两次运行的调度顺序完全相同
+func TestReplay(t *testing.T) {
+	run := func(seed int64) ([]int, uint64) {
+		s := New(seed)
+		order := []int{}
+		s.Run(func() {
+			done := 0
+			for i := 0; i < 5; i++ {
+				i := i
+				s.Go(func() {
+					for j := 0; j < 10; j++ {
+						s.Sleep(time.Duration(s.Intn(20)) * time.Millisecond)
+						order = append(order, i)
+					}
+					done++
+				})
+			}
+			s.Await(func() bool { return done == 5 }, -1)
+		})
+		return order, s.Fingerprint()
+	}
+
+	order1, fp1 := run(42)
+	order2, fp2 := run(42)
+	if fp1 != fp2 || len(order1) != 50 || len(order2) != 50 {
+		t.Fatalf("fingerprints %x and %x differ", fp1, fp2)
+	}
+	for i := range order1 {
+		if order1[i] != order2[i] {
+			t.Fatalf("schedules differ at step %v", i)
+		}
+	}
+	if _, fp3 := run(43); fp3 == fp1 {
+		t.Fatalf("different seeds gave the same schedule")
+	}
+}
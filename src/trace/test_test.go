@@ -0,0 +1,82 @@
+package trace
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRingBuffer(t *testing.T) {
+	rb := NewRingBuffer(3)
+	tr := NewTracer(rb, "raft", 0, 1)
+	for i := 1; i <= 5; i++ {
+		tr.Emit(EntriesAppended, 1, i, "")
+	}
+	events := rb.Events()
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %v", len(events))
+	}
+	for i, e := range events {
+		if e.Index != i+3 || e.Peer != 1 || e.Kind != EntriesAppended {
+			t.Fatalf("unexpected event %v at %v", e, i)
+		}
+	}
+
+	// nil的Tracer什么也不做
+	var nilTracer *Tracer
+	nilTracer.Emit(Apply, 1, 1, "x %v", 1)
+	if NewTracer(nil, "raft", 0, 0) != nil {
+		t.Fatalf("tracer with nil sink should be nil")
+	}
+}
+
+func TestFileSinkMerge(t *testing.T) {
+	dir := t.TempDir()
+	p0 := filepath.Join(dir, "raft-0.jsonl")
+	p1 := filepath.Join(dir, "raft-1.jsonl")
+	fs0, err := NewFileSink(p0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs1, err := NewFileSink(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := NewTracer(fs0, "raft", 0, 0)
+	t1 := NewTracer(fs1, "raft", 0, 1)
+	t0.Emit(ElectionStart, 1, 0, "")
+	time.Sleep(time.Millisecond)
+	t1.Emit(VoteGranted, 1, 0, "for %v", 0)
+	time.Sleep(time.Millisecond)
+	t0.Emit(CommitAdvanced, 1, 1, "")
+	fs0.Close()
+	fs1.Close()
+
+	// 模拟崩溃时写了一半的最后一行
+	f, _ := os.OpenFile(p1, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"time":"20`))
+	f.Close()
+
+	e0, err := ReadFile(p0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e1, err := ReadFile(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e0) != 2 || len(e1) != 1 {
+		t.Fatalf("expected 2 and 1 events, got %v and %v", len(e0), len(e1))
+	}
+	if e1[0].Detail != "for 0" {
+		t.Fatalf("unexpected detail %q", e1[0].Detail)
+	}
+	merged := Merge(e0, e1)
+	kinds := []Kind{ElectionStart, VoteGranted, CommitAdvanced}
+	for i, e := range merged {
+		if e.Kind != kinds[i] {
+			t.Fatalf("event %v: expected %v, got %v", i, kinds[i], e.Kind)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package trace
+
+//
+// structured event tracing for Raft and the services built on it.
+//
+// each peer emits typed events (election started, vote granted,
+// entries appended, ...) through a Tracer to a Sink. a RingBuffer
+// keeps the last events in memory; a FileSink appends them to a
+// JSONL file, one event per line. the tracemerge tool merges the
+// per-peer files into one timeline.
+//
+// setting TRACE_DIR makes every peer write to TRACE_DIR/<name>.jsonl,
+// e.g. to keep the history of a failing test run.
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	ElectionStart   Kind = "election_start"
+	VoteGranted     Kind = "vote_granted"
+	EntriesAppended Kind = "entries_appended"
+	CommitAdvanced  Kind = "commit_advanced"
+	Apply           Kind = "apply"
+	Snapshot        Kind = "snapshot"
+	ConfigApplied   Kind = "config_applied"
+	ShardPulled     Kind = "shard_pulled"
+)
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"` // raft, kvraft, shardkv, shardmaster
+	Group   int       `json:"group"`   // shardkv的gid，其他服务为0
+	Peer    int       `json:"peer"`
+	Kind    Kind      `json:"kind"`
+	Term    int       `json:"term"`
+	Index   int       `json:"index"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%v %v/%v/%v %v term=%v index=%v",
+		e.Time.Format("15:04:05.000000"), e.Service, e.Group, e.Peer, e.Kind, e.Term, e.Index)
+	if e.Detail != "" {
+		s += " " + e.Detail
+	}
+	return s
+}
+
+// 接收事件。Emit可能在调用者持有锁时被调用，不能阻塞
+type Sink interface {
+	Emit(e Event)
+}
+
+// Tracer为一个节点发出事件，nil的Tracer什么也不做
+type Tracer struct {
+	sink    Sink
+	service string
+	group   int
+	peer    int
+}
+
+func NewTracer(sink Sink, service string, group int, peer int) *Tracer {
+	if sink == nil {
+		return nil
+	}
+	return &Tracer{sink: sink, service: service, group: group, peer: peer}
+}
+
+func (t *Tracer) Emit(kind Kind, term int, index int, format string, a ...interface{}) {
+	if t == nil {
+		return
+	}
+	detail := ""
+	if format != "" {
+		detail = fmt.Sprintf(format, a...)
+	}
+	t.sink.Emit(Event{
+		Time:    time.Now(),
+		Service: t.service,
+		Group:   t.group,
+		Peer:    t.peer,
+		Kind:    kind,
+		Term:    term,
+		Index:   index,
+		Detail:  detail,
+	})
+}
+
+// 只保留最近n个事件
+type RingBuffer struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+func NewRingBuffer(n int) *RingBuffer {
+	return &RingBuffer{events: make([]Event, n)}
+}
+
+func (rb *RingBuffer) Emit(e Event) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.events[rb.next] = e
+	rb.next = (rb.next + 1) % len(rb.events)
+	if rb.next == 0 {
+		rb.full = true
+	}
+}
+
+// 按发生顺序返回保留的事件
+func (rb *RingBuffer) Events() []Event {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if !rb.full {
+		return append([]Event{}, rb.events[:rb.next]...)
+	}
+	return append(append([]Event{}, rb.events[rb.next:]...), rb.events[:rb.next]...)
+}
+
+// 把事件追加到JSONL文件中
+type FileSink struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (fs *FileSink) Emit(e Event) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.enc.Encode(e)
+}
+
+func (fs *FileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.f.Close()
+}
+
+var (
+	envMu    sync.Mutex
+	envSinks = map[string]*FileSink{}
+)
+
+// 如果设置了TRACE_DIR，返回写入TRACE_DIR/name.jsonl的sink，否则返回nil。
+// 同一个name总是返回同一个sink，重启的节点继续写同一个文件
+func EnvSink(name string) Sink {
+	dir := os.Getenv("TRACE_DIR")
+	if dir == "" {
+		return nil
+	}
+	envMu.Lock()
+	defer envMu.Unlock()
+	if fs, ok := envSinks[name]; ok {
+		return fs
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil
+	}
+	fs, err := NewFileSink(filepath.Join(dir, name+".jsonl"))
+	if err != nil {
+		return nil
+	}
+	envSinks[name] = fs
+	return fs
+}
+
+// 读出JSONL文件中的事件
+func ReadFile(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	events := []Event{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// 进程崩溃时最后一行可能不完整
+			break
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// 把多个节点的事件按时间合并成一条时间线，时间相同的事件保持原来的顺序
+func Merge(traces ...[]Event) []Event {
+	all := []Event{}
+	for _, t := range traces {
+		all = append(all, t...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Time.Before(all[j].Time)
+	})
+	return all
+}
@@ -0,0 +1,58 @@
+package main
+
+//
+// merge per-peer trace files into one timeline.
+//
+// go run tracemerge.go [-json] [-kind k1,k2] [-peer p] trace1.jsonl trace2.jsonl ...
+//
+
+import (
+	"cs651/trace"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "print the merged events as JSONL")
+	kinds := flag.String("kind", "", "only print these comma-separated event kinds")
+	peer := flag.Int("peer", -1, "only print events of this peer")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: tracemerge [-json] [-kind k1,k2] [-peer p] trace.jsonl...\n")
+		os.Exit(1)
+	}
+
+	traces := [][]trace.Event{}
+	for _, path := range flag.Args() {
+		events, err := trace.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tracemerge: %v: %v\n", path, err)
+			os.Exit(1)
+		}
+		traces = append(traces, events)
+	}
+
+	wanted := map[trace.Kind]bool{}
+	for _, k := range strings.Split(*kinds, ",") {
+		if k != "" {
+			wanted[trace.Kind(k)] = true
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range trace.Merge(traces...) {
+		if len(wanted) > 0 && !wanted[e.Kind] {
+			continue
+		}
+		if *peer != -1 && e.Peer != *peer {
+			continue
+		}
+		if *asJSON {
+			enc.Encode(e)
+		} else {
+			fmt.Println(e)
+		}
+	}
+}